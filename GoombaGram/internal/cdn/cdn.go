@@ -0,0 +1,292 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// https://core.telegram.org/cdn
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto/aes"
+	"io"
+	"sync"
+)
+
+// Size of the parts checked with upload.getCdnFileHashes (and downloaded at once)
+const PartSize = 128 * 1024
+
+// Maximum number of upload.reuploadCdnFile calls for the same part
+const maxReuploads = 3
+
+// fileHash#f39b035c offset:long limit:int hash:bytes = FileHash;
+type FileHash struct {
+	Offset int64
+	Limit  int32
+	Hash   []byte
+}
+
+// upload.fileCdnRedirect#f18cda44 dc_id:int file_token:bytes encryption_key:bytes encryption_iv:bytes file_hashes:Vector<FileHash> = upload.File;
+type Redirect struct {
+	DCID          int32
+	FileToken     []byte
+	EncryptionKey []byte
+	EncryptionIV  []byte
+	FileHashes    []FileHash
+}
+
+// upload.cdnFileReuploadNeeded#eea8e46e request_token:bytes = upload.CdnFile;
+type ReuploadNeededError struct {
+	RequestToken []byte
+}
+
+func (err *ReuploadNeededError) Error() string {
+	return "cdn: file must be uploaded again to the CDN"
+}
+
+// Methods sent to the DC that stores the file, implemented by the API client
+type Client interface {
+	// upload.reuploadCdnFile
+	ReuploadCdnFile(ctx context.Context, fileToken, requestToken []byte) ([]FileHash, error)
+	// upload.getCdnFileHashes#91dc3f31 file_token:bytes offset:long
+	GetCdnFileHashes(ctx context.Context, fileToken []byte, offset int64) ([]FileHash, error)
+}
+
+// Connection to a CDN DC
+type Conn interface {
+	// upload.getCdnFile#395f69da file_token:bytes offset:long limit:int, returns upload.cdnFile bytes or *ReuploadNeededError
+	GetCdnFile(ctx context.Context, fileToken []byte, offset int64, limit int32) ([]byte, error)
+	Close() error
+}
+
+// Parse the CDN public keys of help.getCdnConfig (cdnPublicKey dc_id and public_key)
+func Keys(publicKeys map[int32]string) (map[int32]*crypto.RSAPublicKey, error) {
+	result := make(map[int32]*crypto.RSAPublicKey, len(publicKeys))
+	for dcID, publicKey := range publicKeys {
+		key, err := crypto.ParseRSAPublicKey([]byte(publicKey))
+		if err != nil {
+			return nil, fmt.Errorf("cdn dc %d: %v", dcID, err)
+		}
+		result[dcID] = key
+	}
+
+	return result, nil
+}
+
+// Connections to the CDN DCs, opened when a file is redirected to them and reused by the next downloads
+type Pool struct {
+	mutex   sync.Mutex
+	keys    map[int32]*crypto.RSAPublicKey
+	connect func(ctx context.Context, dcID int32, key *crypto.RSAPublicKey) (Conn, error)
+	conns   map[int32]Conn
+}
+
+// New pool, keys come from help.getCdnConfig (Keys).
+// connect must open a connection to the CDN DC, creating its auth key with the RSA key given
+// (CDN DCs aren't in the list of the client keys).
+func PoolNew(keys map[int32]*crypto.RSAPublicKey, connect func(ctx context.Context, dcID int32, key *crypto.RSAPublicKey) (Conn, error)) *Pool {
+	return &Pool{
+		keys:    keys,
+		connect: connect,
+		conns:   make(map[int32]Conn),
+	}
+}
+
+// Connection to a CDN DC, connected at the first use
+func (pool *Pool) Conn(ctx context.Context, dcID int32) (Conn, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if conn, ok := pool.conns[dcID]; ok {
+		return conn, nil
+	}
+
+	key, ok := pool.keys[dcID]
+	if !ok {
+		return nil, fmt.Errorf("cdn: public key of dc %d is missing, help.getCdnConfig must be called again", dcID)
+	}
+
+	conn, err := pool.connect(ctx, dcID, key)
+	if err != nil {
+		return nil, fmt.Errorf("cdn dc %d: %w", dcID, err)
+	}
+
+	pool.conns[dcID] = conn
+	return conn, nil
+}
+
+// Close the connection to a CDN DC if it's still conn (after an error), the next use connects again
+func (pool *Pool) drop(dcID int32, conn Conn) {
+	pool.mutex.Lock()
+	if pool.conns[dcID] == conn {
+		delete(pool.conns, dcID)
+	}
+	pool.mutex.Unlock()
+
+	_ = conn.Close()
+}
+
+// Close every connection
+func (pool *Pool) Close() error {
+	pool.mutex.Lock()
+	conns := pool.conns
+	pool.conns = make(map[int32]Conn)
+	pool.mutex.Unlock()
+
+	var errs []error
+	for _, conn := range conns {
+		errs = append(errs, conn.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// Decrypt a part received from the CDN.
+// AES-256-CTR with the iv of the redirect whose last 4 bytes are replaced by offset/16 (big endian).
+func DecryptPart(key, iv []byte, offset int64, data []byte) error {
+	if len(key) != 32 || len(iv) != 16 {
+		return errors.New("cdn: wrong encryption key or iv length")
+	}
+	if offset < 0 || offset%16 != 0 {
+		return errors.New("cdn: offset must be a positive multiple of 16")
+	}
+	if offset/16 > 0xFFFFFFFF {
+		return errors.New("cdn: offset is too big")
+	}
+
+	partIV := make([]byte, 16)
+	copy(partIV, iv)
+	binary.BigEndian.PutUint32(partIV[12:], uint32(offset/16))
+
+	ctr := aes.AES256CTRNew(key, partIV)
+	if ctr == nil {
+		return errors.New("cdn: wrong encryption key")
+	}
+
+	ctr.EncryptDecrypt(data)
+	return nil
+}
+
+// Known hashes of a file by offset
+type hashes map[int64]FileHash
+
+func (h hashes) add(fileHashes []FileHash) {
+	for _, fileHash := range fileHashes {
+		h[fileHash.Offset] = fileHash
+	}
+}
+
+// Check a decrypted part (data starts at offset) against the SHA-256 hashes
+func (h hashes) check(offset int64, data []byte) error {
+	for start := 0; start < len(data); {
+		fileHash, ok := h[offset+int64(start)]
+		if !ok || fileHash.Limit <= 0 {
+			return fmt.Errorf("cdn: hash of offset %d is missing", offset+int64(start))
+		}
+
+		end := start + int(fileHash.Limit)
+		if end > len(data) {
+			end = len(data)
+		}
+
+		sum := sha256.Sum256(data[start:end])
+		if !bytes.Equal(sum[:], fileHash.Hash) {
+			return fmt.Errorf("cdn: hash mismatch at offset %d", offset+int64(start))
+		}
+
+		start = end
+	}
+
+	return nil
+}
+
+// Download a file redirected to a CDN (upload.fileCdnRedirect), write the decrypted and verified data to dst.
+// It returns the number of bytes written.
+func Download(ctx context.Context, client Client, pool *Pool, redirect *Redirect, dst io.Writer) (int64, error) {
+	known := make(hashes)
+	known.add(redirect.FileHashes)
+
+	var written int64
+	for offset := int64(0); ; offset += PartSize {
+		data, err := getPart(ctx, client, pool, redirect, known, offset)
+		if err != nil {
+			return written, err
+		}
+
+		err = DecryptPart(redirect.EncryptionKey, redirect.EncryptionIV, offset, data)
+		if err != nil {
+			return written, err
+		}
+
+		// Get the missing hashes of this part
+		if _, ok := known[offset]; !ok && len(data) > 0 {
+			fileHashes, err := client.GetCdnFileHashes(ctx, redirect.FileToken, offset)
+			if err != nil {
+				return written, err
+			}
+			known.add(fileHashes)
+		}
+
+		err = known.check(offset, data)
+		if err != nil {
+			return written, err
+		}
+
+		n, err := dst.Write(data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+
+		// Last part
+		if len(data) < PartSize {
+			return written, nil
+		}
+	}
+}
+
+// Get an encrypted part from the CDN DC, asking the DC to upload the file to the CDN again if needed
+func getPart(ctx context.Context, client Client, pool *Pool, redirect *Redirect, known hashes, offset int64) ([]byte, error) {
+	for reuploads := 0; ; reuploads++ {
+		conn, err := pool.Conn(ctx, redirect.DCID)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := conn.GetCdnFile(ctx, redirect.FileToken, offset, PartSize)
+
+		var reupload *ReuploadNeededError
+		if errors.As(err, &reupload) && reuploads < maxReuploads {
+			fileHashes, err := client.ReuploadCdnFile(ctx, redirect.FileToken, reupload.RequestToken)
+			if err != nil {
+				return nil, err
+			}
+			known.add(fileHashes)
+			continue
+		}
+
+		// The connection may be broken, the next part connects again
+		if err != nil && reupload == nil && ctx.Err() == nil {
+			pool.drop(redirect.DCID, conn)
+		}
+
+		return data, err
+	}
+}
@@ -0,0 +1,384 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Deterministic test data
+func testBytes(length int, seed byte) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(i*7) ^ seed
+	}
+	return data
+}
+
+func TestDecryptPartVector(t *testing.T) {
+	// NIST SP 800-38A F.5.5 (CTR-AES256), its counter block f0f1...fcfdfeff is the redirect iv
+	// with offset 0xfcfdfeff*16, over 2^31
+	key := decodeHex(t, "603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4")
+	iv := decodeHex(t, "f0f1f2f3f4f5f6f7f8f9fafb00000000")
+	plain := decodeHex(t, "6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51"+
+		"30c81c46a35ce411e5fbc1191a0a52eff69f2445df4f9b17ad2b417be66c3710")
+	encrypted := decodeHex(t, "601ec313775789a5b7a7f504bbf3d228f443e3ca4d62b59aca84e990cacaf5c5"+
+		"2b0930daa23de94ce87017ba2d84988ddfc9c58db67aada613c2dd08457941a6")
+
+	for block := int64(0); block < 4; block++ {
+		offset := 0xfcfdfeff*16 + block*16
+		data := append([]byte{}, encrypted[block*16:]...)
+		if err := DecryptPart(key, iv, offset, data); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, plain[block*16:]) {
+			t.Fatalf("offset %d: %x", offset, data)
+		}
+	}
+
+	// The last 4 bytes of the redirect iv are ignored
+	data := append([]byte{}, encrypted...)
+	if err := DecryptPart(key, decodeHex(t, "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"), 0xfcfdfeff*16, data); err != nil || !bytes.Equal(data, plain) {
+		t.Fatalf("%x %v", data, err)
+	}
+}
+
+func TestDecryptPartWholeFile(t *testing.T) {
+	key := testBytes(32, 1)
+	iv := make([]byte, 16)
+	copy(iv, testBytes(12, 2))
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := testBytes(3*PartSize+100, 3)
+	encrypted := make([]byte, len(plain))
+	cipher.NewCTR(block, iv).XORKeyStream(encrypted, plain)
+
+	// Every part decrypted alone is the same slice of the whole file
+	for offset := int64(0); offset < int64(len(plain)); offset += PartSize {
+		end := offset + PartSize
+		if end > int64(len(plain)) {
+			end = int64(len(plain))
+		}
+
+		data := append([]byte{}, encrypted[offset:end]...)
+		if err := DecryptPart(key, iv, offset, data); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, plain[offset:end]) {
+			t.Fatalf("wrong part at offset %d", offset)
+		}
+	}
+}
+
+func TestDecryptPartErrors(t *testing.T) {
+	key := testBytes(32, 1)
+	iv := testBytes(16, 2)
+
+	for _, test := range []struct {
+		name   string
+		key    []byte
+		iv     []byte
+		offset int64
+	}{
+		{"short iv", key, iv[:15], 0},
+		{"short key", key[:16], iv, 0},
+		{"negative offset", key, iv, -16},
+		{"unaligned offset", key, iv, 100},
+		{"counter overflow", key, iv, 0x100000000 * 16},
+	} {
+		if err := DecryptPart(test.key, test.iv, test.offset, make([]byte, 16)); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func sum(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+func TestHashesCheck(t *testing.T) {
+	data := testBytes(PartSize, 4)
+	half := int64(PartSize / 2)
+
+	known := make(hashes)
+	known.add([]FileHash{
+		{Offset: 1 << 32, Limit: int32(half), Hash: sum(data[:half])},
+		{Offset: 1<<32 + half, Limit: int32(half), Hash: sum(data[half:])},
+	})
+	if err := known.check(1<<32, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shorter last part
+	if err := known.check(1<<32+half, data[half:half+10]); err == nil {
+		t.Fatal("hash of a truncated part accepted")
+	}
+
+	tampered := append([]byte{}, data...)
+	tampered[half+1] ^= 1
+	if err := known.check(1<<32, tampered); err == nil {
+		t.Fatal("tampered part accepted")
+	}
+
+	if err := known.check(0, data); err == nil {
+		t.Fatal("part without hashes accepted")
+	}
+}
+
+// Fake DC and CDN DC that store an encrypted file
+type fakeCDN struct {
+	mutex sync.Mutex
+
+	plain, encrypted []byte
+	key, iv          []byte
+	hashes           []FileHash
+
+	reuploadNeeded int // upload.cdnFileReuploadNeeded answers left
+	hashesCalls    []int64
+	reuploads      int
+	connects       int
+	closed         int
+	fail           error // next GetCdnFile error
+}
+
+func fakeCDNNew(t *testing.T, length int) *fakeCDN {
+	cdn := &fakeCDN{
+		plain: testBytes(length, 5),
+		key:   testBytes(32, 6),
+		iv:    make([]byte, 16),
+	}
+	copy(cdn.iv, testBytes(12, 7))
+
+	block, err := aes.NewCipher(cdn.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdn.encrypted = make([]byte, length)
+	cipher.NewCTR(block, cdn.iv).XORKeyStream(cdn.encrypted, cdn.plain)
+
+	// Hashes of 64 KB like the DCs
+	for offset := 0; offset < length; offset += PartSize / 2 {
+		end := offset + PartSize/2
+		if end > length {
+			end = length
+		}
+		cdn.hashes = append(cdn.hashes, FileHash{Offset: int64(offset), Limit: int32(end - offset), Hash: sum(cdn.plain[offset:end])})
+	}
+
+	return cdn
+}
+
+func (cdn *fakeCDN) redirect() *Redirect {
+	fileHashes := cdn.hashes
+	if len(fileHashes) > 2 {
+		fileHashes = fileHashes[:2]
+	}
+
+	return &Redirect{
+		DCID:          203,
+		FileToken:     []byte("token"),
+		EncryptionKey: cdn.key,
+		EncryptionIV:  cdn.iv,
+		FileHashes:    fileHashes,
+	}
+}
+
+func (cdn *fakeCDN) pool() *Pool {
+	keys := map[int32]*crypto.RSAPublicKey{203: {Fingerprint: 203}}
+	return PoolNew(keys, func(ctx context.Context, dcID int32, key *crypto.RSAPublicKey) (Conn, error) {
+		cdn.mutex.Lock()
+		defer cdn.mutex.Unlock()
+
+		if key.Fingerprint != int64(dcID) {
+			return nil, errors.New("wrong key")
+		}
+		cdn.connects++
+		return fakeConn{cdn}, nil
+	})
+}
+
+func (cdn *fakeCDN) ReuploadCdnFile(ctx context.Context, fileToken, requestToken []byte) ([]FileHash, error) {
+	cdn.mutex.Lock()
+	defer cdn.mutex.Unlock()
+
+	if string(requestToken) != "request" {
+		return nil, errors.New("wrong request token")
+	}
+	cdn.reuploads++
+	return nil, nil
+}
+
+func (cdn *fakeCDN) GetCdnFileHashes(ctx context.Context, fileToken []byte, offset int64) ([]FileHash, error) {
+	cdn.mutex.Lock()
+	defer cdn.mutex.Unlock()
+
+	cdn.hashesCalls = append(cdn.hashesCalls, offset)
+	for i, fileHash := range cdn.hashes {
+		if fileHash.Offset == offset {
+			end := i + 2
+			if end > len(cdn.hashes) {
+				end = len(cdn.hashes)
+			}
+			return cdn.hashes[i:end], nil
+		}
+	}
+	return nil, nil
+}
+
+type fakeConn struct {
+	cdn *fakeCDN
+}
+
+func (conn fakeConn) GetCdnFile(ctx context.Context, fileToken []byte, offset int64, limit int32) ([]byte, error) {
+	cdn := conn.cdn
+	cdn.mutex.Lock()
+	defer cdn.mutex.Unlock()
+
+	if cdn.fail != nil {
+		err := cdn.fail
+		cdn.fail = nil
+		return nil, err
+	}
+	if cdn.reuploadNeeded > 0 {
+		cdn.reuploadNeeded--
+		return nil, &ReuploadNeededError{RequestToken: []byte("request")}
+	}
+
+	if offset >= int64(len(cdn.encrypted)) {
+		return []byte{}, nil
+	}
+	end := offset + int64(limit)
+	if end > int64(len(cdn.encrypted)) {
+		end = int64(len(cdn.encrypted))
+	}
+	return append([]byte{}, cdn.encrypted[offset:end]...), nil
+}
+
+func (conn fakeConn) Close() error {
+	conn.cdn.mutex.Lock()
+	conn.cdn.closed++
+	conn.cdn.mutex.Unlock()
+	return nil
+}
+
+func TestDownload(t *testing.T) {
+	cdn := fakeCDNNew(t, 2*PartSize+1000)
+	cdn.reuploadNeeded = 1
+	pool := cdn.pool()
+
+	var out bytes.Buffer
+	written, err := Download(context.Background(), cdn, pool, cdn.redirect(), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(len(cdn.plain)) || !bytes.Equal(out.Bytes(), cdn.plain) {
+		t.Fatalf("wrong file, %d bytes", written)
+	}
+
+	// The first part is covered by the redirect hashes
+	if len(cdn.hashesCalls) != 2 || cdn.hashesCalls[0] != PartSize || cdn.hashesCalls[1] != 2*PartSize {
+		t.Fatalf("upload.getCdnFileHashes offsets %v", cdn.hashesCalls)
+	}
+	if cdn.reuploads != 1 || cdn.connects != 1 {
+		t.Fatalf("%d reuploads, %d connections", cdn.reuploads, cdn.connects)
+	}
+
+	if err := pool.Close(); err != nil || cdn.closed != 1 {
+		t.Fatal(err, cdn.closed)
+	}
+}
+
+func TestDownloadHashMismatch(t *testing.T) {
+	cdn := fakeCDNNew(t, PartSize+10)
+	cdn.encrypted[PartSize+3] ^= 1
+
+	var out bytes.Buffer
+	written, err := Download(context.Background(), cdn, cdn.pool(), cdn.redirect(), &out)
+	if err == nil {
+		t.Fatal("tampered file accepted")
+	}
+	// Only the verified part is written
+	if written != PartSize || !bytes.Equal(out.Bytes(), cdn.plain[:PartSize]) {
+		t.Fatalf("%d bytes written", written)
+	}
+}
+
+func TestDownloadReuploadLimit(t *testing.T) {
+	cdn := fakeCDNNew(t, 100)
+	cdn.reuploadNeeded = maxReuploads + 1
+
+	_, err := Download(context.Background(), cdn, cdn.pool(), cdn.redirect(), &bytes.Buffer{})
+	var reupload *ReuploadNeededError
+	if !errors.As(err, &reupload) || cdn.reuploads != maxReuploads {
+		t.Fatal(err, cdn.reuploads)
+	}
+}
+
+func TestDownloadReconnect(t *testing.T) {
+	cdn := fakeCDNNew(t, 100)
+	cdn.fail = errors.New("connection reset")
+	pool := cdn.pool()
+
+	if _, err := Download(context.Background(), cdn, pool, cdn.redirect(), &bytes.Buffer{}); err == nil {
+		t.Fatal("no error")
+	}
+	if cdn.closed != 1 {
+		t.Fatal("broken connection not closed")
+	}
+
+	// The next download connects again
+	var out bytes.Buffer
+	if _, err := Download(context.Background(), cdn, pool, cdn.redirect(), &out); err != nil || !bytes.Equal(out.Bytes(), cdn.plain) {
+		t.Fatal(err)
+	}
+	if cdn.connects != 2 {
+		t.Fatalf("%d connections", cdn.connects)
+	}
+}
+
+func TestPoolMissingKey(t *testing.T) {
+	cdn := fakeCDNNew(t, 100)
+	redirect := cdn.redirect()
+	redirect.DCID = 204
+
+	if _, err := Download(context.Background(), cdn, cdn.pool(), redirect, &bytes.Buffer{}); err == nil || cdn.connects != 0 {
+		t.Fatal(err)
+	}
+}
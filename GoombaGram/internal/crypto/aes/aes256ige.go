@@ -18,105 +18,195 @@ package aes
 
 import (
 	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
 )
 
 type AES256IGE struct {
-	aesKey, aesIV []byte
+	block cipher.Block // AES cipher, created only once
+	aesIV []byte
 }
 
-func AES256IGENew(aesKey, aesIV []byte) *AES256IGE {
-	if (len(aesIV)) < aes.BlockSize {
-		return nil
+// AES-256 in IGE mode, key must be 32 bytes long and iv 32 bytes long
+func AES256IGENew(aesKey, aesIV []byte) (*AES256IGE, error) {
+	if len(aesKey) != 32 {
+		return nil, errors.New("IGE key length must be 32 bytes")
+	}
+	if len(aesIV) != 2*aes.BlockSize {
+		return nil, errors.New("IGE iv length must be 32 bytes")
 	}
 
-	if !(len(aesKey) == 16 || len(aesKey) == 24 || len(aesKey) == 32) {
-		return nil
+	// Create a new AES cipher with the key
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
 	}
 
+	iv := make([]byte, len(aesIV))
+	copy(iv, aesIV)
+
 	return &AES256IGE{
-		aesKey: aesKey,
-		aesIV:  aesIV,
-	}
+		block: block,
+		aesIV: iv,
+	}, nil
 }
 
-// Function that make a byte xor between two byte slices
-func xorSlice(dst, src []byte) {
-	for i := range dst {
-		dst[i] = dst[i] ^ src[i]
-	}
+// IGE block mode (implements cipher.BlockMode)
+//
+// Encrypt: y[i] = E(x[i] ^ y[i-1]) ^ x[i-1]
+// Decrypt: x[i] = D(y[i] ^ x[i-1]) ^ y[i-1]
+//
+// Consecutive CryptBlocks calls continue the same chain, like the cipher package CBC mode.
+type ige struct {
+	block   cipher.Block
+	encrypt bool
+	prevIn  [aes.BlockSize]byte // previous input block (or second part of iv)
+	prevOut [aes.BlockSize]byte // previous output block (or first part of iv)
+	buffer  [aes.BlockSize]byte
 }
 
-// Encrypt or Decrypt an input slice using AES IGE
-func encryptDecryptIGE(in, key, iv []byte, encrypt bool) []byte{
-	// Check the inputs
-	if len(in) % aes.BlockSize != 0 && len(in) != 0{
-		return nil
-	}
+// Create a new IGE encrypter, iv must be 32 bytes long (y[0] followed by x[0])
+func NewIGEEncrypter(block cipher.Block, iv []byte) cipher.BlockMode {
+	return newIGE(block, iv, true)
+}
 
-	// Create a new AES cipher with the key
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil
-	}
+// Create a new IGE decrypter, iv must be 32 bytes long (y[0] followed by x[0])
+func NewIGEDecrypter(block cipher.Block, iv []byte) cipher.BlockMode {
+	return newIGE(block, iv, false)
+}
 
-	// Create the result variable
-	result := make([]byte, len(in))
+func newIGE(block cipher.Block, iv []byte, encrypt bool) *ige {
+	if block.BlockSize() != aes.BlockSize {
+		panic("IGE: block size must be 16 bytes")
+	}
+	if len(iv) != 2*aes.BlockSize {
+		panic("IGE: iv length must be 32 bytes")
+	}
 
-	// First part of IV (its length is 1 block)
-	iv1 := make([]byte, aes.BlockSize)
-	// Second part of IV (its length is 1 block)
-	iv2 := make([]byte, aes.BlockSize)
+	mode := &ige{block: block, encrypt: encrypt}
 
-	// Encrypt and decrypt (inverting iv1 and iv2)
+	// Encrypt and decrypt (inverting iv parts)
 	if encrypt {
-		copy(iv1, iv[:aes.BlockSize])
-		copy(iv2, iv[aes.BlockSize:])
+		copy(mode.prevOut[:], iv[:aes.BlockSize])
+		copy(mode.prevIn[:], iv[aes.BlockSize:])
 	} else {
-		copy(iv1, iv[aes.BlockSize:])
-		copy(iv2, iv[:aes.BlockSize])
+		copy(mode.prevIn[:], iv[:aes.BlockSize])
+		copy(mode.prevOut[:], iv[aes.BlockSize:])
 	}
 
-	// AES expandedKey (256 bit)
-	expandedKey := make([]byte, aes.BlockSize)
+	return mode
+}
 
-	// Iterate over input slice
-	for i := 0; i < len(in); i += aes.BlockSize {
-		// current byte chunk (16 bytes length)
-		chunk := in[i:i+aes.BlockSize]
+func (mode *ige) BlockSize() int {
+	return aes.BlockSize
+}
+
+// Encrypt or decrypt src to dst, dst and src can be the same slice
+func (mode *ige) CryptBlocks(dst, src []byte) {
+	if len(src)%aes.BlockSize != 0 {
+		panic("IGE: input not full blocks")
+	}
+	if len(dst) < len(src) {
+		panic("IGE: output smaller than input")
+	}
 
-		// iv1 = previous output (or iv) ^ current input
-		xorSlice(iv1, chunk)
+	for i := 0; i < len(src); i += aes.BlockSize {
+		in := src[i : i+aes.BlockSize]
+		out := dst[i : i+aes.BlockSize]
 
-		if encrypt {
-			// AES256 encrypt (aes package)
-			block.Encrypt(expandedKey, iv1)
+		// buffer = current input ^ previous output
+		xorBlock(mode.buffer[:], in, mode.prevOut[:])
+
+		// Save current input before it is overwritten (in place)
+		copy(mode.prevOut[:], in)
+
+		if mode.encrypt {
+			mode.block.Encrypt(out, mode.buffer[:])
 		} else {
-			// AES256 decrypt (aes package)
-			block.Decrypt(expandedKey, iv1)
+			mode.block.Decrypt(out, mode.buffer[:])
 		}
 
-		// AddRoundKey passage
-		// expandedKey = sessionKey ^ previous input (or iv)
-		xorSlice(expandedKey, iv2)
+		// output ^= previous input
+		xorBlock(out, out, mode.prevIn[:])
+
+		// Next iteration: previous input = current input, previous output = current output
+		mode.prevIn, mode.prevOut = mode.prevOut, mode.prevIn
+		copy(mode.prevOut[:], out)
+	}
+}
 
-		// Reassign iv1 and iv2 for next iteration
-		// iv1: output just obtained
-		// iv2: input just used
-		iv1, iv2 = expandedKey, chunk
+// dst = a ^ b (16 bytes)
+func xorBlock(dst, a, b []byte) {
+	binary.LittleEndian.PutUint64(dst[:8], binary.LittleEndian.Uint64(a[:8])^binary.LittleEndian.Uint64(b[:8]))
+	binary.LittleEndian.PutUint64(dst[8:16], binary.LittleEndian.Uint64(a[8:16])^binary.LittleEndian.Uint64(b[8:16]))
+}
 
-		// Copy iteration result to result variable
-		copy(result[i:], expandedKey)
+// Check the inputs of an encrypt/decrypt operation
+func checkIGE(dst, src []byte) error {
+	if len(src)%aes.BlockSize != 0 {
+		return errors.New("input data length isn't a multiple of the block size")
 	}
 
-	return result
+	if len(dst) < len(src) {
+		return errors.New("output buffer is smaller than input data")
+	}
+
+	return nil
+}
+
+// New IGE encrypter that starts from the stored iv
+func (aesIge *AES256IGE) Encrypter() cipher.BlockMode {
+	return NewIGEEncrypter(aesIge.block, aesIge.aesIV)
+}
+
+// New IGE decrypter that starts from the stored iv
+func (aesIge *AES256IGE) Decrypter() cipher.BlockMode {
+	return NewIGEDecrypter(aesIge.block, aesIge.aesIV)
+}
+
+// Encrypt src to dst with AES IGE (without allocations), dst and src can be the same slice
+func (aesIge *AES256IGE) EncryptTo(dst, src []byte) error {
+	err := checkIGE(dst, src)
+	if err != nil {
+		return err
+	}
+
+	mode := newIGE(aesIge.block, aesIge.aesIV, true)
+	mode.CryptBlocks(dst, src)
+	return nil
+}
+
+// Decrypt src to dst with AES IGE (without allocations), dst and src can be the same slice
+func (aesIge *AES256IGE) DecryptTo(dst, src []byte) error {
+	err := checkIGE(dst, src)
+	if err != nil {
+		return err
+	}
+
+	mode := newIGE(aesIge.block, aesIge.aesIV, false)
+	mode.CryptBlocks(dst, src)
+	return nil
 }
 
 // Encrypt data with AES IGE
-func (aes AES256IGE) Encrypt(in []byte) []byte {
-	return encryptDecryptIGE(in, aes.aesKey, aes.aesIV, true)
+func (aesIge *AES256IGE) Encrypt(in []byte) ([]byte, error) {
+	result := make([]byte, len(in))
+	err := aesIge.EncryptTo(result, in)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
 
 // Decrypt data with AES IGE
-func (aes AES256IGE) Decrypt(in []byte) []byte {
-	return encryptDecryptIGE(in, aes.aesKey, aes.aesIV, false)
-}
\ No newline at end of file
+func (aesIge *AES256IGE) Decrypt(in []byte) ([]byte, error) {
+	result := make([]byte, len(in))
+	err := aesIge.DecryptTo(result, in)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
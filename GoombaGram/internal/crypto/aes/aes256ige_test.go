@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package aes
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+// Test vectors of OpenSSL (test/igetest.c), AES-128 keys
+var igeVectors = []struct {
+	key, iv, plaintext, ciphertext string
+}{
+	{
+		key:        "000102030405060708090a0b0c0d0e0f",
+		iv:         "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		plaintext:  "0000000000000000000000000000000000000000000000000000000000000000",
+		ciphertext: "1a8519a6557be652e9da8e43da4ef4453cf456b4ca488aa383c79c98b34797cb",
+	},
+	{
+		key:        "5468697320697320616e20696d706c65",
+		iv:         "6d656e746174696f6e206f6620494745206d6f646520666f72204f70656e5353",
+		plaintext:  "99706487a1cde613bc6de0b6f24b1c7aa448c8b9c3403e3467a8cad89340f53b",
+		ciphertext: "4c2e204c6574277320686f70652042656e20676f74206974207269676874210a",
+	},
+}
+
+func decodeHex(t testing.TB, s string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestIGEVectors(t *testing.T) {
+	for _, vector := range igeVectors {
+		block, err := aes.NewCipher(decodeHex(t, vector.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		iv, plaintext, ciphertext := decodeHex(t, vector.iv), decodeHex(t, vector.plaintext), decodeHex(t, vector.ciphertext)
+
+		out := make([]byte, len(plaintext))
+		NewIGEEncrypter(block, iv).CryptBlocks(out, plaintext)
+		if !bytes.Equal(out, ciphertext) {
+			t.Fatalf("encrypted %x, expected %x", out, ciphertext)
+		}
+
+		NewIGEDecrypter(block, iv).CryptBlocks(out, out)
+		if !bytes.Equal(out, plaintext) {
+			t.Fatalf("decrypted %x, expected %x", out, plaintext)
+		}
+
+		// Consecutive calls continue the chain
+		mode := NewIGEDecrypter(block, iv)
+		out = append(out[:0], ciphertext...)
+		mode.CryptBlocks(out[:16], out[:16])
+		mode.CryptBlocks(out[16:], out[16:])
+		if !bytes.Equal(out, plaintext) {
+			t.Fatalf("decrypted in two calls %x, expected %x", out, plaintext)
+		}
+	}
+}
+
+// IGE computed block by block from its definition
+func referenceIGE(key, iv, in []byte, encrypt bool) []byte {
+	block, _ := aes.NewCipher(key)
+	prevOut, prevIn := iv[:16], iv[16:]
+	if !encrypt {
+		prevOut, prevIn = prevIn, prevOut
+	}
+
+	out := make([]byte, len(in))
+	buffer := make([]byte, 16)
+	for i := 0; i < len(in); i += 16 {
+		for j := range buffer {
+			buffer[j] = in[i+j] ^ prevOut[j]
+		}
+		if encrypt {
+			block.Encrypt(out[i:i+16], buffer)
+		} else {
+			block.Decrypt(out[i:i+16], buffer)
+		}
+		for j := range buffer {
+			out[i+j] ^= prevIn[j]
+		}
+		prevIn, prevOut = in[i:i+16], out[i:i+16]
+	}
+
+	return out
+}
+
+func TestAES256IGE(t *testing.T) {
+	key, iv, plaintext := make([]byte, 32), make([]byte, 32), make([]byte, 1024)
+	for _, data := range [][]byte{key, iv, plaintext} {
+		_, _ = rand.Read(data)
+	}
+
+	aesIge, err := AES256IGENew(key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := aesIge.Encrypt(plaintext)
+	if err != nil || !bytes.Equal(ciphertext, referenceIGE(key, iv, plaintext, true)) {
+		t.Fatal("wrong ciphertext", err)
+	}
+	decrypted, err := aesIge.Decrypt(ciphertext)
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("wrong plaintext", err)
+	}
+
+	// In place
+	buffer := append([]byte{}, plaintext...)
+	if err := aesIge.EncryptTo(buffer, buffer); err != nil || !bytes.Equal(buffer, ciphertext) {
+		t.Fatal("wrong ciphertext in place", err)
+	}
+	if err := aesIge.DecryptTo(buffer, buffer); err != nil || !bytes.Equal(buffer, plaintext) {
+		t.Fatal("wrong plaintext in place", err)
+	}
+
+	if allocs := testing.AllocsPerRun(10, func() { _ = aesIge.EncryptTo(buffer, buffer) }); allocs > 1 {
+		t.Fatalf("%v allocations", allocs)
+	}
+
+	if _, err := aesIge.Encrypt(make([]byte, 17)); err == nil {
+		t.Fatal("partial block accepted")
+	}
+	if err := aesIge.DecryptTo(make([]byte, 16), make([]byte, 32)); err == nil {
+		t.Fatal("short output accepted")
+	}
+}
+
+func TestAES256IGENew(t *testing.T) {
+	for _, length := range []int{0, 16, 24, 31, 33, 64} {
+		if _, err := AES256IGENew(make([]byte, length), make([]byte, 32)); err == nil {
+			t.Fatalf("%d bytes key accepted", length)
+		}
+	}
+
+	for _, length := range []int{0, 16, 31, 33} {
+		if _, err := AES256IGENew(make([]byte, 32), make([]byte, length)); err == nil {
+			t.Fatalf("%d bytes iv accepted", length)
+		}
+	}
+}
+
+func benchmarkIGE(b *testing.B, size int, encrypt bool) {
+	aesIge, err := AES256IGENew(make([]byte, 32), make([]byte, 32))
+	if err != nil {
+		b.Fatal(err)
+	}
+	buffer := make([]byte, size)
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if encrypt {
+			_ = aesIge.EncryptTo(buffer, buffer)
+		} else {
+			_ = aesIge.DecryptTo(buffer, buffer)
+		}
+	}
+}
+
+func BenchmarkIGEEncrypt1K(b *testing.B)   { benchmarkIGE(b, 1024, true) }
+func BenchmarkIGEEncrypt512K(b *testing.B) { benchmarkIGE(b, 512*1024, true) }
+func BenchmarkIGEDecrypt1K(b *testing.B)   { benchmarkIGE(b, 1024, false) }
+func BenchmarkIGEDecrypt512K(b *testing.B) { benchmarkIGE(b, 512*1024, false) }
@@ -0,0 +1,277 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crypto
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto/aes"
+	"sync"
+	"time"
+)
+
+// https://core.telegram.org/api/pfs
+
+// Default lifetime of a temporary auth key
+const DefaultTempKeyLifetime = 24 * time.Hour
+
+// A temporary key is replaced when less than this time is left before it expires
+const TempKeyRenewMargin = 5 * time.Minute
+
+// Shortest lifetime of the temporary keys, a key must be usable for a while before its renewal
+const MinTempKeyLifetime = 2 * TempKeyRenewMargin
+
+// Wait before a failed temporary key renewal is tried again
+var tempKeyRetryDelay = 10 * time.Second
+
+// bind_auth_key_inner#75a3f765 nonce:long temp_auth_key_id:long perm_auth_key_id:long temp_session_id:long expires_at:int = BindAuthKeyInner;
+const crcBindAuthKeyInner = 0x75a3f765
+
+// Authorization key (2048 bit)
+type AuthKey struct {
+	Key       []byte
+	ID        []byte    // lower 64 bits of SHA1(key)
+	ExpiresAt time.Time // zero for a permanent key
+}
+
+// Permanent auth key
+func AuthKeyNew(key []byte) *AuthKey {
+	hash := sha1.Sum(key)
+
+	return &AuthKey{
+		Key: key,
+		ID:  hash[12:20],
+	}
+}
+
+// Temporary auth key, created with p_q_inner_data_temp_dc.
+// created is the (server) time of the handshake and expiresIn the expires_in sent in p_q_inner_data_temp_dc:
+// the key expires at the time checked by the server, not at the time it has been received.
+func TempAuthKeyNew(key []byte, created time.Time, expiresIn int32) *AuthKey {
+	authKey := AuthKeyNew(key)
+	authKey.ExpiresAt = created.Add(time.Duration(expiresIn) * time.Second)
+
+	return authKey
+}
+
+// Auth key id as int64 (little endian)
+func (key *AuthKey) IDInt() int64 {
+	return int64(binary.LittleEndian.Uint64(key.ID))
+}
+
+// Check if the key is temporary
+func (key *AuthKey) Temporary() bool {
+	return !key.ExpiresAt.IsZero()
+}
+
+// Check if a temporary key must be replaced (expired or about to expire)
+func (key *AuthKey) NeedsRenewal(now time.Time) bool {
+	return key.Temporary() && !now.Before(key.ExpiresAt.Add(-TempKeyRenewMargin))
+}
+
+// Create the encrypted_message parameter of auth.bindTempAuthKey.
+// bind_auth_key_inner is encrypted with the permanent key using MTProto 1.0,
+// msgID must be the same msg_id of the auth.bindTempAuthKey request.
+func BindTempAuthKeyMessage(permKey, tempKey *AuthKey, msgID, nonce, tempSessionID int64) ([]byte, error) {
+	if permKey.Temporary() || !tempKey.Temporary() {
+		return nil, errors.New("a permanent key can be bound only to a temporary key")
+	}
+
+	// bind_auth_key_inner
+	inner := make([]byte, 40)
+	binary.LittleEndian.PutUint32(inner[0:], crcBindAuthKeyInner)
+	binary.LittleEndian.PutUint64(inner[4:], uint64(nonce))
+	copy(inner[12:20], tempKey.ID)
+	copy(inner[20:28], permKey.ID)
+	binary.LittleEndian.PutUint64(inner[28:], uint64(tempSessionID))
+	binary.LittleEndian.PutUint32(inner[36:], uint32(tempKey.ExpiresAt.Unix()))
+
+	// random:int128 (salt and session id), msg_id:long, seqno:int = 0, message_data_length:int
+	plaintext := make([]byte, 32, 32+len(inner)+16)
+	_, err := ReadRandom(plaintext[:16])
+	if err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint64(plaintext[16:], uint64(msgID))
+	binary.LittleEndian.PutUint32(plaintext[24:], 0)
+	binary.LittleEndian.PutUint32(plaintext[28:], uint32(len(inner)))
+	plaintext = append(plaintext, inner...)
+
+	// MTProto 1.0: message key is computed without padding
+	msgKey := MessageKeyV1(plaintext)
+
+	// Random padding to a multiple of 16 bytes
+	padding := make([]byte, (16-len(plaintext)%16)%16)
+	_, err = ReadRandom(padding)
+	if err != nil {
+		return nil, err
+	}
+	plaintext = append(plaintext, padding...)
+
+	aesKey, aesIV := KDFV1(permKey.Key, msgKey, KDFClient)
+	ige, err := aes.AES256IGENew(aesKey, aesIV)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ige.EncryptTo(plaintext, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	// perm_auth_key_id + msg_key + encrypted data
+	return concat(permKey.ID, msgKey, plaintext), nil
+}
+
+// Permanent key and temporary key bound to it (Perfect Forward Secrecy).
+// When PFS is enabled the permanent key is never used to encrypt user traffic.
+type AuthKeySet struct {
+	mutex    sync.RWMutex
+	perm     *AuthKey
+	temp     *AuthKey
+	pfs      bool
+	lifetime time.Duration
+}
+
+// New key set, lifetime is used only with PFS (0 means DefaultTempKeyLifetime).
+// Shorter lifetimes than MinTempKeyLifetime are raised to it, otherwise every new key would need a renewal at once.
+func AuthKeySetNew(perm *AuthKey, pfs bool, lifetime time.Duration) *AuthKeySet {
+	if lifetime <= 0 {
+		lifetime = DefaultTempKeyLifetime
+	} else if lifetime < MinTempKeyLifetime {
+		lifetime = MinTempKeyLifetime
+	}
+
+	return &AuthKeySet{
+		perm:     perm,
+		pfs:      pfs,
+		lifetime: lifetime,
+	}
+}
+
+// Permanent key
+func (set *AuthKeySet) Permanent() *AuthKey {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+	return set.perm
+}
+
+// Check if temporary keys are used
+func (set *AuthKeySet) PFS() bool {
+	return set.pfs
+}
+
+// Lifetime of the temporary keys
+func (set *AuthKeySet) Lifetime() time.Duration {
+	return set.lifetime
+}
+
+// expires_in of p_q_inner_data_temp_dc (seconds)
+func (set *AuthKeySet) ExpiresIn() int32 {
+	return int32(set.lifetime / time.Second)
+}
+
+// Save a temporary key after auth.bindTempAuthKey returned boolTrue
+func (set *AuthKeySet) SetBoundTemp(temp *AuthKey) error {
+	if temp == nil || !temp.Temporary() {
+		return errors.New("the key isn't temporary")
+	}
+
+	set.mutex.Lock()
+	set.temp = temp
+	set.mutex.Unlock()
+
+	return nil
+}
+
+// Check if a new temporary key must be created and bound
+func (set *AuthKeySet) NeedsRenewal(now time.Time) bool {
+	if !set.pfs {
+		return false
+	}
+
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+	return set.temp == nil || set.temp.NeedsRenewal(now)
+}
+
+// Key used to encrypt traffic
+func (set *AuthKeySet) TrafficKey() (*AuthKey, error) {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	if !set.pfs {
+		if set.perm == nil {
+			return nil, errors.New("auth key is missing")
+		}
+		return set.perm, nil
+	}
+
+	if set.temp == nil || !time.Now().Before(set.temp.ExpiresAt) {
+		return nil, errors.New("no valid temporary auth key bound")
+	}
+
+	return set.temp, nil
+}
+
+// Keep a bound temporary key until ctx is done, replacing it before it expires.
+// renew must create a key with p_q_inner_data_temp_dc (expires_in = expiresIn), bind it with
+// auth.bindTempAuthKey and return it. A failed renewal is tried again after a while.
+func (set *AuthKeySet) Rotate(ctx context.Context, renew func(ctx context.Context, expiresIn int32) (*AuthKey, error)) error {
+	if !set.pfs {
+		return errors.New("temporary keys are used only with PFS")
+	}
+
+	for {
+		var wait time.Duration
+		if set.NeedsRenewal(time.Now()) {
+			temp, err := renew(ctx, set.ExpiresIn())
+			if err == nil && temp == nil {
+				err = errors.New("no temporary key returned")
+			}
+			if err == nil && temp.NeedsRenewal(time.Now()) {
+				err = errors.New("the new temporary key expires too soon")
+			}
+			if err == nil {
+				err = set.SetBoundTemp(temp)
+			}
+
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				wait = tempKeyRetryDelay
+			}
+		}
+
+		if wait == 0 {
+			set.mutex.RLock()
+			wait = time.Until(set.temp.ExpiresAt.Add(-TempKeyRenewMargin))
+			set.mutex.RUnlock()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
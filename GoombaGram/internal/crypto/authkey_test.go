@@ -0,0 +1,283 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto/aes"
+)
+
+func randomKey(t *testing.T) []byte {
+	t.Helper()
+
+	key := make([]byte, 256)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestTempAuthKeyNew(t *testing.T) {
+	created := time.Unix(1600000000, 0)
+	temp := TempAuthKeyNew(randomKey(t), created, 3600)
+
+	if !temp.Temporary() || !temp.ExpiresAt.Equal(created.Add(time.Hour)) {
+		t.Fatal(temp.ExpiresAt)
+	}
+	if temp.NeedsRenewal(created.Add(time.Hour - TempKeyRenewMargin - time.Second)) {
+		t.Fatal("renewal before the margin")
+	}
+	if !temp.NeedsRenewal(created.Add(time.Hour - TempKeyRenewMargin)) {
+		t.Fatal("no renewal within the margin")
+	}
+
+	if AuthKeyNew(randomKey(t)).Temporary() {
+		t.Fatal("permanent key is temporary")
+	}
+}
+
+func TestBindTempAuthKeyMessage(t *testing.T) {
+	permKey, tempKey := randomKey(t), randomKey(t)
+	perm := AuthKeyNew(permKey)
+	temp := TempAuthKeyNew(tempKey, time.Unix(1600000000, 0), 86400)
+
+	message, err := BindTempAuthKeyMessage(perm, temp, 77, 5, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message[:8], perm.ID) {
+		t.Fatal("wrong perm_auth_key_id")
+	}
+
+	aesKey, aesIV := KDFV1(permKey, message[8:24], KDFClient)
+	aesIge, err := aes.AES256IGENew(aesKey, aesIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := aesIge.Decrypt(message[24:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	length := binary.LittleEndian.Uint32(plaintext[28:])
+	if binary.LittleEndian.Uint64(plaintext[16:]) != 77 || length != 40 || !bytes.Equal(MessageKeyV1(plaintext[:32+length]), message[8:24]) {
+		t.Fatal("wrong message header")
+	}
+
+	inner := plaintext[32 : 32+length]
+	if binary.LittleEndian.Uint32(inner) != crcBindAuthKeyInner || binary.LittleEndian.Uint64(inner[4:]) != 5 ||
+		!bytes.Equal(inner[12:20], temp.ID) || !bytes.Equal(inner[20:28], perm.ID) ||
+		binary.LittleEndian.Uint64(inner[28:]) != 9 || binary.LittleEndian.Uint32(inner[36:]) != 1600086400 {
+		t.Fatalf("wrong bind_auth_key_inner %x", inner)
+	}
+
+	if _, err := BindTempAuthKeyMessage(temp, perm, 77, 5, 9); err == nil {
+		t.Fatal("permanent key bound to a permanent key")
+	}
+}
+
+func TestAuthKeySet(t *testing.T) {
+	perm := AuthKeyNew(randomKey(t))
+
+	set := AuthKeySetNew(perm, false, 0)
+	if key, err := set.TrafficKey(); err != nil || key != perm || set.NeedsRenewal(time.Now()) {
+		t.Fatal("wrong key without PFS", err)
+	}
+
+	set = AuthKeySetNew(perm, true, 0)
+	if set.ExpiresIn() != 86400 {
+		t.Fatal(set.ExpiresIn())
+	}
+	if _, err := set.TrafficKey(); err == nil || !set.NeedsRenewal(time.Now()) {
+		t.Fatal("permanent key used with PFS")
+	}
+
+	if err := set.SetBoundTemp(perm); err == nil {
+		t.Fatal("permanent key bound as temporary")
+	}
+	if err := set.SetBoundTemp(nil); err == nil {
+		t.Fatal("nil key bound")
+	}
+
+	temp := TempAuthKeyNew(randomKey(t), time.Now(), 3600)
+	if err := set.SetBoundTemp(temp); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := set.TrafficKey(); err != nil || key != temp {
+		t.Fatal("temporary key not used", err)
+	}
+	if set.NeedsRenewal(time.Now()) || !set.NeedsRenewal(time.Now().Add(56*time.Minute)) {
+		t.Fatal("wrong renewal time")
+	}
+}
+
+// Handshake and binding of a fake temporary key, the key must be renewed after delay
+type fakeRenewer struct {
+	t        *testing.T
+	delay    time.Duration
+	failures int
+
+	lock    sync.Mutex
+	renewed []*AuthKey
+	calls   int
+}
+
+func (renewer *fakeRenewer) renew(ctx context.Context, expiresIn int32) (*AuthKey, error) {
+	renewer.lock.Lock()
+	defer renewer.lock.Unlock()
+
+	renewer.calls++
+	if expiresIn != 3600 {
+		renewer.t.Errorf("expires_in %d", expiresIn)
+	}
+	if renewer.calls <= renewer.failures {
+		return nil, errors.New("handshake failed")
+	}
+
+	// The lifetime is shortened to renew the key soon
+	temp := TempAuthKeyNew(randomKey(renewer.t), time.Now(), 0)
+	temp.ExpiresAt = time.Now().Add(TempKeyRenewMargin + renewer.delay)
+	renewer.renewed = append(renewer.renewed, temp)
+	return temp, nil
+}
+
+func (renewer *fakeRenewer) keys() []*AuthKey {
+	renewer.lock.Lock()
+	defer renewer.lock.Unlock()
+	return append([]*AuthKey{}, renewer.renewed...)
+}
+
+func TestAuthKeySetRotate(t *testing.T) {
+	set := AuthKeySetNew(AuthKeyNew(randomKey(t)), true, time.Hour)
+	renewer := &fakeRenewer{t: t, delay: 30 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if err := set.Rotate(ctx, renewer.renew); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	keys := renewer.keys()
+	if len(keys) < 3 || len(keys) > 8 {
+		t.Fatalf("%d keys in 200ms, one every 30ms expected", len(keys))
+	}
+	if key, err := set.TrafficKey(); err != nil || key != keys[len(keys)-1] {
+		t.Fatal("last key not used", err)
+	}
+}
+
+func TestAuthKeySetRotateRetry(t *testing.T) {
+	defer func(delay time.Duration) { tempKeyRetryDelay = delay }(tempKeyRetryDelay)
+	tempKeyRetryDelay = 10 * time.Millisecond
+
+	set := AuthKeySetNew(AuthKeyNew(randomKey(t)), true, time.Hour)
+	renewer := &fakeRenewer{t: t, delay: time.Hour, failures: 2}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- set.Rotate(ctx, renewer.renew) }()
+
+	for len(renewer.keys()) == 0 && ctx.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	if keys := renewer.keys(); len(keys) != 1 {
+		t.Fatal("key not renewed after the failures")
+	}
+
+	// The key isn't renewed again before it expires
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if keys := renewer.keys(); len(keys) != 1 || renewer.calls != 3 {
+		t.Fatalf("%d keys after %d renewals", len(keys), renewer.calls)
+	}
+}
+
+func TestAuthKeySetRotateErrors(t *testing.T) {
+	renewer := &fakeRenewer{t: t}
+
+	if err := AuthKeySetNew(AuthKeyNew(randomKey(t)), false, 0).Rotate(context.Background(), renewer.renew); err == nil {
+		t.Fatal("rotation without PFS")
+	}
+
+	// A key that already needs a renewal isn't used
+	defer func(delay time.Duration) { tempKeyRetryDelay = delay }(tempKeyRetryDelay)
+	tempKeyRetryDelay = 10 * time.Millisecond
+
+	set := AuthKeySetNew(AuthKeyNew(randomKey(t)), true, time.Hour)
+	expired := func(ctx context.Context, expiresIn int32) (*AuthKey, error) {
+		return TempAuthKeyNew(randomKey(t), time.Now(), 60), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := set.Rotate(ctx, expired); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if _, err := set.TrafficKey(); err == nil {
+		t.Fatal("key expiring within the margin bound")
+	}
+	// A renewal without key is an error, not a panic
+	set = AuthKeySetNew(AuthKeyNew(randomKey(t)), true, time.Hour)
+	missing := func(ctx context.Context, expiresIn int32) (*AuthKey, error) {
+		return nil, nil
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := set.Rotate(ctx, missing); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if _, err := set.TrafficKey(); err == nil {
+		t.Fatal("no key bound but traffic key available")
+	}
+}
+
+func TestAuthKeySetLifetime(t *testing.T) {
+	for _, test := range []struct {
+		lifetime, expected time.Duration
+	}{
+		{0, DefaultTempKeyLifetime},
+		{-time.Minute, DefaultTempKeyLifetime},
+		{time.Second, MinTempKeyLifetime},
+		{TempKeyRenewMargin, MinTempKeyLifetime},
+		{MinTempKeyLifetime, MinTempKeyLifetime},
+		{time.Hour, time.Hour},
+	} {
+		set := AuthKeySetNew(AuthKeyNew(randomKey(t)), true, test.lifetime)
+		if set.Lifetime() != test.expected {
+			t.Errorf("lifetime %v: %v", test.lifetime, set.Lifetime())
+		}
+
+		// A key created with the lifetime of the set doesn't need a renewal at once
+		temp := TempAuthKeyNew(randomKey(t), time.Now(), set.ExpiresIn())
+		if temp.NeedsRenewal(time.Now()) {
+			t.Errorf("lifetime %v: new key needs a renewal", test.lifetime)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// https://core.telegram.org/mtproto/auth_key#dh-key-exchange-complete
+// https://core.telegram.org/mtproto/security_guidelines
+
+// Diffie-Hellman prime length (bits)
+const dhPrimeBits = 2048
+
+// Prime currently sent by Telegram servers
+const telegramDHPrime = "c71caeb9c6b1c9048e6c522f70f13f73980d40238e3e21c14934d037563d930f" +
+	"48198a0aa7c14058229493d22530f4dbfa336f6e0ac925139543aed44cce7c37" +
+	"20fd51f69458705ac68cd4fe6b6b13abdc9746512969328454f18faf8c595f64" +
+	"2477fe96bb2a941d5bcd1d4ac8cc49880708fa9b378e3c4f3a9060bee67cf9a4" +
+	"a4a695811051907e162753b56b0f6b410dba74d8a84b2a14b3144e0ef1284754" +
+	"fd17ed950d5965b4b9dd46582db1178d169c6bc465b0d6ff9ca3928fef5b9ae4" +
+	"e418fc15e83ebea0f87fa9ff5eed70050ded2849f47bf959d956850ce929851f" +
+	"0d8115f635b105ee2e4e15d04b2454bf6f4fadf034b10403119cd8e3b92fcc5b"
+
+// Number of Miller-Rabin rounds used to check a new prime
+const primalityRounds = 64
+
+// Cache of the primes that have already been checked as safe (key: big endian bytes)
+var (
+	safePrimes     = map[string]bool{}
+	safePrimesLock sync.RWMutex
+)
+
+func init() {
+	prime, _ := new(big.Int).SetString(telegramDHPrime, 16)
+	safePrimes[string(prime.Bytes())] = true
+}
+
+// Check that dhPrime is a 2048-bit safe prime (p and (p-1)/2 both prime).
+// A prime that passes the check is cached, so the primality test runs only the first time.
+func CheckSafePrime(dhPrime *big.Int) error {
+	if dhPrime == nil || dhPrime.Sign() <= 0 {
+		return errors.New("dh_prime is missing")
+	}
+
+	if dhPrime.BitLen() != dhPrimeBits {
+		return fmt.Errorf("dh_prime is %d bits long, %d bits required", dhPrime.BitLen(), dhPrimeBits)
+	}
+
+	key := string(dhPrime.Bytes())
+
+	safePrimesLock.RLock()
+	known := safePrimes[key]
+	safePrimesLock.RUnlock()
+	if known {
+		return nil
+	}
+
+	if !dhPrime.ProbablyPrime(primalityRounds) {
+		return errors.New("dh_prime isn't a prime number")
+	}
+
+	// (p-1)/2
+	half := new(big.Int).Rsh(dhPrime, 1)
+	if !half.ProbablyPrime(primalityRounds) {
+		return errors.New("dh_prime isn't a safe prime")
+	}
+
+	safePrimesLock.Lock()
+	safePrimes[key] = true
+	safePrimesLock.Unlock()
+
+	return nil
+}
+
+// Check that the generator g is a quadratic residue mod dhPrime, so that it generates
+// a cyclic subgroup of prime order (p-1)/2.
+//
+// g = 2: p mod 8 = 7
+// g = 3: p mod 3 = 2
+// g = 4: no extra condition
+// g = 5: p mod 5 = 1 or 4
+// g = 6: p mod 24 = 19 or 23
+// g = 7: p mod 7 = 3, 5 or 6
+func CheckGenerator(g int32, dhPrime *big.Int) error {
+	mod := func(m int64) int64 {
+		return new(big.Int).Mod(dhPrime, big.NewInt(m)).Int64()
+	}
+
+	valid := false
+	switch g {
+	case 2:
+		valid = mod(8) == 7
+	case 3:
+		valid = mod(3) == 2
+	case 4:
+		valid = true
+	case 5:
+		r := mod(5)
+		valid = r == 1 || r == 4
+	case 6:
+		r := mod(24)
+		valid = r == 19 || r == 23
+	case 7:
+		r := mod(7)
+		valid = r == 3 || r == 5 || r == 6
+	default:
+		return fmt.Errorf("invalid generator g = %d", g)
+	}
+
+	if !valid {
+		return fmt.Errorf("generator g = %d doesn't produce a quadratic residue mod dh_prime", g)
+	}
+
+	return nil
+}
+
+// Check Diffie-Hellman parameters received from the server (handshake, secret chats and calls)
+func CheckDHParams(g int32, dhPrime *big.Int) error {
+	err := CheckSafePrime(dhPrime)
+	if err != nil {
+		return err
+	}
+
+	return CheckGenerator(g, dhPrime)
+}
+
+// Check that a Diffie-Hellman public value (g, g_a or g_b) is in the safe range
+// 1 < value < dh_prime - 1 and 2^{2048-64} < value < dh_prime - 2^{2048-64}
+func CheckDHValue(value, dhPrime *big.Int) error {
+	if value == nil || dhPrime == nil {
+		return errors.New("dh value is missing")
+	}
+
+	one := big.NewInt(1)
+	primeMinusOne := new(big.Int).Sub(dhPrime, one)
+	if value.Cmp(one) <= 0 || value.Cmp(primeMinusOne) >= 0 {
+		return errors.New("dh value isn't in range (1, dh_prime - 1)")
+	}
+
+	// 2^{2048-64}
+	safetyRange := new(big.Int).Lsh(one, dhPrimeBits-64)
+	upperBound := new(big.Int).Sub(dhPrime, safetyRange)
+	if value.Cmp(safetyRange) <= 0 || value.Cmp(upperBound) >= 0 {
+		return errors.New("dh value isn't in range (2^{2048-64}, dh_prime - 2^{2048-64})")
+	}
+
+	return nil
+}
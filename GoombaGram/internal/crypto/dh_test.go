@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package crypto
+
+import (
+	"math/big"
+	"testing"
+)
+
+func testDHPrime() *big.Int {
+	prime, _ := new(big.Int).SetString(telegramDHPrime, 16)
+	return prime
+}
+
+func TestCheckSafePrime(t *testing.T) {
+	prime := testDHPrime()
+
+	// Empty the cache, so that the known prime is checked again
+	safePrimesLock.Lock()
+	cache := safePrimes
+	safePrimes = map[string]bool{}
+	safePrimesLock.Unlock()
+	defer func() {
+		safePrimesLock.Lock()
+		safePrimes = cache
+		safePrimesLock.Unlock()
+	}()
+
+	if err := CheckSafePrime(prime); err != nil {
+		t.Fatal(err)
+	}
+	if !safePrimes[string(prime.Bytes())] {
+		t.Fatal("dh_prime hasn't been cached")
+	}
+	if err := CheckSafePrime(prime); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		prime *big.Int
+	}{
+		{"nil", nil},
+		{"zero", new(big.Int)},
+		{"negative", new(big.Int).Neg(prime)},
+		{"2047 bits", new(big.Int).Rsh(prime, 1)},
+		{"2049 bits", new(big.Int).Lsh(prime, 1)},
+		{"composite", new(big.Int).Add(prime, big.NewInt(2))},
+		// The next prime after dh_prime, (p-1)/2 is composite
+		{"not safe", new(big.Int).Add(prime, big.NewInt(570))},
+	}
+
+	for _, test := range tests {
+		if err := CheckSafePrime(test.prime); err == nil {
+			t.Fatalf("%s: accepted", test.name)
+		}
+	}
+	if len(safePrimes) != 1 {
+		t.Fatalf("%d primes cached", len(safePrimes))
+	}
+}
+
+func TestCheckGenerator(t *testing.T) {
+	tests := []struct {
+		g     int32
+		prime int64
+		valid bool
+	}{
+		{2, 7, true}, // p mod 8 = 7
+		{2, 23, true},
+		{2, 11, false},
+		{2, 13, false},
+		{3, 5, true}, // p mod 3 = 2
+		{3, 11, true},
+		{3, 7, false},
+		{4, 7, true},
+		{4, 13, true},
+		{5, 11, true}, // p mod 5 = 1 or 4
+		{5, 19, true},
+		{5, 7, false},
+		{5, 13, false},
+		{6, 19, true}, // p mod 24 = 19 or 23
+		{6, 23, true},
+		{6, 47, true},
+		{6, 7, false},
+		{6, 11, false},
+		{7, 17, true}, // p mod 7 = 3, 5 or 6
+		{7, 19, true},
+		{7, 13, true},
+		{7, 11, false},
+		{7, 29, false},
+		{1, 7, false},
+		{8, 7, false},
+		{-2, 7, false},
+	}
+
+	for _, test := range tests {
+		err := CheckGenerator(test.g, big.NewInt(test.prime))
+		if (err == nil) != test.valid {
+			t.Fatalf("g = %d, p = %d: %v", test.g, test.prime, err)
+		}
+	}
+
+	// Telegram's prime is 3 mod 8, 2 mod 3, 3 mod 5, 6 mod 7 and 11 mod 24
+	prime := testDHPrime()
+	for g, valid := range map[int32]bool{2: false, 3: true, 4: true, 5: false, 6: false, 7: true} {
+		if err := CheckGenerator(g, prime); (err == nil) != valid {
+			t.Fatalf("g = %d: %v", g, err)
+		}
+		if err := CheckDHParams(g, prime); (err == nil) != valid {
+			t.Fatalf("g = %d: %v", g, err)
+		}
+	}
+	if err := CheckDHParams(3, new(big.Int).Add(prime, big.NewInt(2))); err == nil {
+		t.Fatal("composite dh_prime accepted")
+	}
+}
+
+func TestCheckDHValue(t *testing.T) {
+	prime := testDHPrime()
+	one := big.NewInt(1)
+	safetyRange := new(big.Int).Lsh(one, dhPrimeBits-64)
+	upperBound := new(big.Int).Sub(prime, safetyRange)
+
+	tests := []struct {
+		name  string
+		value *big.Int
+		valid bool
+	}{
+		{"nil", nil, false},
+		{"zero", new(big.Int), false},
+		{"one", one, false},
+		{"two", big.NewInt(2), false},
+		{"2^{2048-64}", safetyRange, false},
+		{"2^{2048-64} + 1", new(big.Int).Add(safetyRange, one), true},
+		{"2^{2048-64} - 1", new(big.Int).Sub(safetyRange, one), false},
+		{"2^2000", new(big.Int).Lsh(one, 2000), true},
+		{"dh_prime - 2^{2048-64} - 1", new(big.Int).Sub(upperBound, one), true},
+		{"dh_prime - 2^{2048-64}", upperBound, false},
+		{"dh_prime - 2^{2048-64} + 1", new(big.Int).Add(upperBound, one), false},
+		{"dh_prime - 2", new(big.Int).Sub(prime, big.NewInt(2)), false},
+		{"dh_prime - 1", new(big.Int).Sub(prime, one), false},
+		{"dh_prime", prime, false},
+		{"dh_prime + 1", new(big.Int).Add(prime, one), false},
+		{"negative", new(big.Int).Neg(new(big.Int).Lsh(one, 2000)), false},
+	}
+
+	for _, test := range tests {
+		if err := CheckDHValue(test.value, prime); (err == nil) != test.valid {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+	}
+
+	if err := CheckDHValue(big.NewInt(3), nil); err == nil {
+		t.Fatal("missing dh_prime accepted")
+	}
+}
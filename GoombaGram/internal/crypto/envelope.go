@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// Encrypted envelope for data stored on disk (auth keys and sessions)
+//
+// +----+-+-+----------+----+------+-----...-----+
+// |GGSE|v|k|iterations|salt|nonce | ciphertext  |
+// +----+-+-+----------+----+------+-----...-----+
+//
+// v: envelope version
+// k: key derivation function (1 = PBKDF2-HMAC-SHA256)
+// iterations: KDF iterations (uint32, big endian)
+// ciphertext: AES-256-GCM, the header is authenticated as additional data
+
+var envelopeMagic = []byte("GGSE")
+
+const (
+	envelopeVersion   = 1
+	envelopeKDFPBKDF2 = 1
+
+	envelopeIterations    = 600000
+	envelopeMinIterations = 10000                   // older envelopes are accepted and sealed again (Outdated)
+	envelopeMaxIterations = 10 * envelopeIterations // a forged header mustn't stall the key derivation
+	envelopeSaltSize      = 16
+	envelopeNonceSize     = 12
+	envelopeHeaderSize    = 4 + 1 + 1 + 4 + envelopeSaltSize
+)
+
+// Key derived from a passphrase, it can be reused for many envelopes
+type EnvelopeKey struct {
+	salt       []byte
+	iterations uint32
+	aead       cipher.AEAD
+}
+
+func envelopeKey(passphrase, salt []byte, iterations uint32) (*EnvelopeKey, error) {
+	key := PBKDF2(passphrase, salt, int(iterations), 32, sha256.New)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EnvelopeKey{
+		salt:       salt,
+		iterations: iterations,
+		aead:       aead,
+	}, nil
+}
+
+// Derive a new key from a passphrase with a random salt
+func EnvelopeKeyNew(passphrase []byte) (*EnvelopeKey, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("envelope: passphrase is empty")
+	}
+
+	salt := make([]byte, envelopeSaltSize)
+	_, err := ReadRandom(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return envelopeKey(passphrase, salt, envelopeIterations)
+}
+
+func (key *EnvelopeKey) header() []byte {
+	header := make([]byte, 0, envelopeHeaderSize)
+	header = append(header, envelopeMagic...)
+	header = append(header, envelopeVersion, envelopeKDFPBKDF2)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[6:], key.iterations)
+	return append(header, key.salt...)
+}
+
+// Encrypt data in a new envelope
+func (key *EnvelopeKey) Seal(plaintext []byte) ([]byte, error) {
+	header := key.header()
+
+	nonce := make([]byte, envelopeNonceSize)
+	_, err := ReadRandom(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	result := append(header, nonce...)
+	return key.aead.Seal(result, nonce, plaintext, header), nil
+}
+
+// Parsed envelope header
+type envelopeHeader struct {
+	iterations uint32
+	salt       []byte
+}
+
+func parseEnvelope(envelope []byte) (*envelopeHeader, error) {
+	if len(envelope) < envelopeHeaderSize+envelopeNonceSize || !bytes.Equal(envelope[:4], envelopeMagic) {
+		return nil, errors.New("envelope: data isn't an encrypted envelope")
+	}
+
+	if envelope[4] != envelopeVersion {
+		return nil, errors.New("envelope: unknown version")
+	}
+	if envelope[5] != envelopeKDFPBKDF2 {
+		return nil, errors.New("envelope: unknown key derivation function")
+	}
+
+	iterations := binary.BigEndian.Uint32(envelope[6:10])
+	if iterations < envelopeMinIterations || iterations > envelopeMaxIterations {
+		return nil, errors.New("envelope: key derivation iterations out of range")
+	}
+
+	return &envelopeHeader{
+		iterations: iterations,
+		salt:       envelope[10:envelopeHeaderSize],
+	}, nil
+}
+
+// Decrypt an envelope sealed with this key
+func (key *EnvelopeKey) Open(envelope []byte) ([]byte, error) {
+	header, err := parseEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.iterations != key.iterations || !bytes.Equal(header.salt, key.salt) {
+		return nil, errors.New("envelope: sealed with another key")
+	}
+
+	nonce := envelope[envelopeHeaderSize : envelopeHeaderSize+envelopeNonceSize]
+	plaintext, err := key.aead.Open(nil, nonce, envelope[envelopeHeaderSize+envelopeNonceSize:], envelope[:envelopeHeaderSize])
+	if err != nil {
+		return nil, errors.New("envelope: wrong passphrase or corrupted data")
+	}
+
+	return plaintext, nil
+}
+
+// Check if an envelope was sealed with this key
+func (key *EnvelopeKey) Matches(envelope []byte) bool {
+	header, err := parseEnvelope(envelope)
+	return err == nil && header.iterations == key.iterations && bytes.Equal(header.salt, key.salt)
+}
+
+// Check if the key uses old parameters and the data should be sealed again with a new key
+func (key *EnvelopeKey) Outdated() bool {
+	return key.iterations < envelopeIterations
+}
+
+// Decrypt an envelope with a passphrase, the key is returned to seal new data without deriving it again
+func OpenEnvelope(passphrase, envelope []byte) ([]byte, *EnvelopeKey, error) {
+	header, err := parseEnvelope(envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := envelopeKey(passphrase, header.salt, header.iterations)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, err := key.Open(envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return plaintext, key, nil
+}
+
+// Check if data is an encrypted envelope
+func IsEnvelope(data []byte) bool {
+	return len(data) >= 4 && bytes.Equal(data[:4], envelopeMagic)
+}
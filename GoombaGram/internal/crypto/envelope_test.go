@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// Key with few iterations, to keep the tests fast
+func testEnvelopeKey(t *testing.T, passphrase string, iterations uint32) *EnvelopeKey {
+	t.Helper()
+
+	key, err := envelopeKey([]byte(passphrase), bytes.Repeat([]byte{7}, envelopeSaltSize), iterations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEnvelope(t *testing.T) {
+	key := testEnvelopeKey(t, "passphrase", envelopeMinIterations)
+	plaintext := []byte("auth key")
+
+	envelope, err := key.Seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEnvelope(envelope) || bytes.Contains(envelope, plaintext) {
+		t.Fatal("wrong envelope")
+	}
+
+	data, err := key.Open(envelope)
+	if err != nil || !bytes.Equal(data, plaintext) {
+		t.Fatal(data, err)
+	}
+
+	data, opened, err := OpenEnvelope([]byte("passphrase"), envelope)
+	if err != nil || !bytes.Equal(data, plaintext) || !opened.Matches(envelope) {
+		t.Fatal(data, err)
+	}
+	if !opened.Outdated() {
+		t.Fatal("key with the minimum iterations isn't outdated")
+	}
+
+	if _, _, err := OpenEnvelope([]byte("wrong"), envelope); err == nil {
+		t.Fatal("wrong passphrase accepted")
+	}
+
+	if other := testEnvelopeKey(t, "passphrase", envelopeMinIterations+1); other.Matches(envelope) {
+		t.Fatal("envelope matches another key")
+	}
+
+	// Header and ciphertext are authenticated
+	for _, i := range []int{envelopeHeaderSize - 1, len(envelope) - 1} {
+		tampered := append([]byte{}, envelope...)
+		tampered[i] ^= 1
+		if _, err := key.Open(tampered); err == nil {
+			t.Fatalf("byte %d tampered, envelope opened", i)
+		}
+	}
+}
+
+func TestEnvelopeIterations(t *testing.T) {
+	envelope, err := testEnvelopeKey(t, "passphrase", envelopeMinIterations).Seal([]byte("auth key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, iterations := range []uint32{0, 1, envelopeMinIterations - 1, envelopeMaxIterations + 1, 0xFFFFFFFF} {
+		forged := append([]byte{}, envelope...)
+		binary.BigEndian.PutUint32(forged[6:10], iterations)
+
+		// The key derivation mustn't even start
+		start := time.Now()
+		if _, _, err := OpenEnvelope([]byte("passphrase"), forged); err == nil {
+			t.Fatalf("%d iterations accepted", iterations)
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Fatalf("%d iterations rejected after %v", iterations, elapsed)
+		}
+	}
+}
+
+func TestEnvelopeKeyNew(t *testing.T) {
+	if _, err := EnvelopeKeyNew(nil); err == nil {
+		t.Fatal("empty passphrase accepted")
+	}
+
+	key, err := EnvelopeKeyNew([]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Outdated() {
+		t.Fatal("new key is outdated")
+	}
+
+	envelope, err := key.Seal([]byte("auth key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseEnvelope(envelope); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -15,3 +15,145 @@
  */
 
 package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+)
+
+// x values used by the KDF
+// x = 0 for messages from client to server and x = 8 for those from server to client
+const (
+	KDFClient = 0
+	KDFServer = 8
+)
+
+// MTProto 2.0 message key
+// msg_key = substr(SHA256(substr(auth_key, 88+x, 32) + plaintext + random_padding), 8, 16)
+func MessageKey(authKey, plaintext []byte, x int) []byte {
+	hash := sha256.New()
+	hash.Write(authKey[88+x : 88+x+32])
+	hash.Write(plaintext)
+
+	return hash.Sum(nil)[8:24]
+}
+
+// Quick ACK token of a message sent by the client (x = 0), the server sends it back when it receives the message
+// token = first 32 bits of SHA256(substr(auth_key, 88, 32) + plaintext + random_padding) (little endian), with the most significant bit set
+func QuickAckToken(authKey, plaintext []byte) uint32 {
+	hash := sha256.New()
+	hash.Write(authKey[88 : 88+32])
+	hash.Write(plaintext)
+
+	return binary.LittleEndian.Uint32(hash.Sum(nil)) | 0x80000000
+}
+
+// MTProto 2.0 KDF, get AES key and iv from auth key and message key
+// https://core.telegram.org/mtproto/description#defining-aes-key-and-initialization-vector
+func KDF(authKey, msgKey []byte, x int) (aesKey, aesIV []byte) {
+	// sha256_a = SHA256 (msg_key + substr (auth_key, x, 36))
+	hashA := sha256.New()
+	hashA.Write(msgKey)
+	hashA.Write(authKey[x : x+36])
+	a := hashA.Sum(nil)
+
+	// sha256_b = SHA256 (substr (auth_key, 40+x, 36) + msg_key)
+	hashB := sha256.New()
+	hashB.Write(authKey[40+x : 40+x+36])
+	hashB.Write(msgKey)
+	b := hashB.Sum(nil)
+
+	// aes_key = substr (sha256_a, 0, 8) + substr (sha256_b, 8, 16) + substr (sha256_a, 24, 8)
+	aesKey = make([]byte, 0, 32)
+	aesKey = append(aesKey, a[:8]...)
+	aesKey = append(aesKey, b[8:24]...)
+	aesKey = append(aesKey, a[24:32]...)
+
+	// aes_iv = substr (sha256_b, 0, 8) + substr (sha256_a, 8, 16) + substr (sha256_b, 24, 8)
+	aesIV = make([]byte, 0, 32)
+	aesIV = append(aesIV, b[:8]...)
+	aesIV = append(aesIV, a[8:24]...)
+	aesIV = append(aesIV, b[24:32]...)
+
+	return
+}
+
+// MTProto 1.0 message key (still used by bind_auth_key_inner)
+// msg_key = substr(SHA1(plaintext), 4, 16)
+func MessageKeyV1(plaintext []byte) []byte {
+	hash := sha1.Sum(plaintext)
+	return hash[4:20]
+}
+
+// MTProto 1.0 KDF, get AES key and iv from auth key and message key
+func KDFV1(authKey, msgKey []byte, x int) (aesKey, aesIV []byte) {
+	// sha1_a = SHA1 (msg_key + substr (auth_key, x, 32))
+	a := sha1.Sum(concat(msgKey, authKey[x:x+32]))
+	// sha1_b = SHA1 (substr (auth_key, 32+x, 16) + msg_key + substr (auth_key, 48+x, 16))
+	b := sha1.Sum(concat(authKey[32+x:48+x], msgKey, authKey[48+x:64+x]))
+	// sha1_c = SHA1 (substr (auth_key, 64+x, 32) + msg_key)
+	c := sha1.Sum(concat(authKey[64+x:96+x], msgKey))
+	// sha1_d = SHA1 (msg_key + substr (auth_key, 96+x, 32))
+	d := sha1.Sum(concat(msgKey, authKey[96+x:128+x]))
+
+	// aes_key = substr (sha1_a, 0, 8) + substr (sha1_b, 8, 12) + substr (sha1_c, 4, 12)
+	aesKey = concat(a[:8], b[8:20], c[4:16])
+	// aes_iv = substr (sha1_a, 8, 12) + substr (sha1_b, 0, 8) + substr (sha1_c, 16, 4) + substr (sha1_d, 0, 8)
+	aesIV = concat(a[8:20], b[:8], c[16:20], d[:8])
+
+	return
+}
+
+// Join byte slices in a new slice
+func concat(slices ...[]byte) []byte {
+	length := 0
+	for _, s := range slices {
+		length += len(s)
+	}
+
+	result := make([]byte, 0, length)
+	for _, s := range slices {
+		result = append(result, s...)
+	}
+
+	return result
+}
+
+// PBKDF2 key derivation (RFC 8018) with an HMAC based on h
+func PBKDF2(password, salt []byte, iterations, keyLength int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	hashLength := prf.Size()
+	blocks := (keyLength + hashLength - 1) / hashLength
+
+	result := make([]byte, 0, blocks*hashLength)
+	counter := make([]byte, 4)
+	u := make([]byte, hashLength)
+	t := make([]byte, hashLength)
+
+	for block := 1; block <= blocks; block++ {
+		// U1 = PRF(password, salt + INT(block))
+		binary.BigEndian.PutUint32(counter, uint32(block))
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter)
+		u = prf.Sum(u[:0])
+		copy(t, u)
+
+		// Uc = PRF(password, Uc-1), T = U1 ^ U2 ^ ... ^ Uc
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		result = append(result, t...)
+	}
+
+	return result[:keyLength]
+}
@@ -17,87 +17,194 @@
 package crypto
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"math/big"
-	"math/rand"
+	"math/bits"
 	"time"
 )
 
+// Maximum time spent to split PQ when no context is given
+const splitPQTimeout = 10 * time.Second
+
+// Number of steps between two gcd computations (Brent)
+const brentBatch = 128
+
 // Split Diffie-Hellman PQ
+// p1 is the smaller factor. It returns nil, nil if PQ can't be split.
 func SplitPQ(pq *big.Int) (p1, p2 *big.Int) {
-	value0 := big.NewInt(0)
-	value1 := big.NewInt(1)
-	value15 := big.NewInt(15)
-	value17 := big.NewInt(17)
-	rndMax := big.NewInt(0).SetBit(big.NewInt(0), 64, 1)
-
-	what := big.NewInt(0).Set(pq)
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-	g := big.NewInt(0)
-	i := 0
-	for !(g.Cmp(value1) == 1 && g.Cmp(what) == -1) {
-		q := big.NewInt(0).Rand(rnd, rndMax)
-		q = q.And(q, value15)
-		q = q.Add(q, value17)
-		q = q.Mod(q, what)
-
-		x := big.NewInt(0).Rand(rnd, rndMax)
-		whatnext := big.NewInt(0).Sub(what, value1)
-		x = x.Mod(x, whatnext)
-		x = x.Add(x, value1)
-
-		y := big.NewInt(0).Set(x)
-		lim := 1 << (uint(i) + 18)
-		j := 1
-		flag := true
-
-		for j < lim && flag {
-			a := big.NewInt(0).Set(x)
-			b := big.NewInt(0).Set(x)
-			c := big.NewInt(0).Set(q)
-
-			for b.Cmp(value0) == 1 {
-				b2 := big.NewInt(0)
-				if b2.And(b, value1).Cmp(value0) == 1 {
-					c.Add(c, a)
-					if c.Cmp(what) >= 0 {
-						c.Sub(c, what)
-					}
+	ctx, cancel := context.WithTimeout(context.Background(), splitPQTimeout)
+	defer cancel()
+
+	p1, p2, err := SplitPQContext(ctx, pq)
+	if err != nil {
+		return nil, nil
+	}
+
+	return
+}
+
+// Split Diffie-Hellman PQ, stopping when ctx is done
+func SplitPQContext(ctx context.Context, pq *big.Int) (p1, p2 *big.Int, err error) {
+	if pq == nil || pq.Sign() <= 0 || !pq.IsUint64() {
+		return nil, nil, errors.New("pq must be a positive 64 bit number")
+	}
+
+	p, q, err := SplitPQUint64(ctx, pq.Uint64())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return new(big.Int).SetUint64(p), new(big.Int).SetUint64(q), nil
+}
+
+// Split Diffie-Hellman PQ using Brent's variant of Pollard-rho on 64 bit integers
+// p is the smaller factor.
+func SplitPQUint64(ctx context.Context, pq uint64) (p, q uint64, err error) {
+	if pq < 4 {
+		return 0, 0, errors.New("pq is too small to be split")
+	}
+
+	// Pollard-rho would never end on a prime (the test is exact below 2^64)
+	if new(big.Int).SetUint64(pq).ProbablyPrime(20) {
+		return 0, 0, errors.New("pq is prime")
+	}
+
+	p, err = brent(ctx, pq)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	q = pq / p
+	if p > q {
+		p, q = q, p
+	}
+
+	return p, q, nil
+}
+
+// Find a non trivial factor of n
+func brent(ctx context.Context, n uint64) (uint64, error) {
+	if n%2 == 0 {
+		return 2, nil
+	}
+
+	for {
+		y, err := randomUint64(n)
+		if err != nil {
+			return 0, err
+		}
+		c, err := randomUint64(n)
+		if err != nil {
+			return 0, err
+		}
+
+		var x, ys uint64
+		g, r, q := uint64(1), uint64(1), uint64(1)
+
+		for g == 1 {
+			x = y
+			for i := uint64(0); i < r; i++ {
+				y = rhoStep(y, c, n)
+			}
+
+			for k := uint64(0); k < r && g == 1; k += brentBatch {
+				// Stop if time is over
+				if err = ctx.Err(); err != nil {
+					return 0, err
 				}
-				a.Add(a, a)
-				if a.Cmp(what) >= 0 {
-					a.Sub(a, what)
+
+				ys = y
+				steps := r - k
+				if steps > brentBatch {
+					steps = brentBatch
 				}
-				b.Rsh(b, 1)
-			}
-			x.Set(c)
-
-			z := big.NewInt(0)
-			if x.Cmp(y) == -1 {
-				z.Add(what, x)
-				z.Sub(z, y)
-			} else {
-				z.Sub(x, y)
-			}
-			g.GCD(nil, nil, z, what)
 
-			if (j & (j - 1)) == 0 {
-				y.Set(x)
+				for i := uint64(0); i < steps; i++ {
+					y = rhoStep(y, c, n)
+					q = mulMod(q, absDiff(x, y), n)
+				}
+				g = gcd(q, n)
 			}
-			j = j + 1
 
-			if g.Cmp(value1) != 0 {
-				flag = false
+			r <<= 1
+		}
+
+		// The batch has gone too far, backtrack one step at a time
+		if g == n {
+			for {
+				ys = rhoStep(ys, c, n)
+				g = gcd(absDiff(x, ys), n)
+				if g != 1 {
+					break
+				}
 			}
 		}
-		i = i + 1
+
+		// Retry with other random values if the cycle hasn't found a factor
+		if g != n {
+			return g, nil
+		}
+	}
+}
+
+// f(y) = (y^2 + c) mod n
+func rhoStep(y, c, n uint64) uint64 {
+	return addMod(mulMod(y, y, n), c, n)
+}
+
+// (a * b) mod n using a 128 bit product
+func mulMod(a, b, n uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return bits.Rem64(hi, lo, n)
+}
+
+// (a + b) mod n, with a, b < n
+func addMod(a, b, n uint64) uint64 {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 || sum >= n {
+		sum -= n
+	}
+	return sum
+}
+
+func absDiff(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// Greatest common divisor (binary algorithm)
+func gcd(a, b uint64) uint64 {
+	if a == 0 {
+		return b
+	}
+	if b == 0 {
+		return a
+	}
+
+	shift := bits.TrailingZeros64(a | b)
+	a >>= uint(bits.TrailingZeros64(a))
+	for b != 0 {
+		b >>= uint(bits.TrailingZeros64(b))
+		if a > b {
+			a, b = b, a
+		}
+		b -= a
 	}
 
-	p1 = big.NewInt(0).Set(g)
-	p2 = big.NewInt(0).Div(what, g)
+	return a << uint(shift)
+}
 
-	if p1.Cmp(p2) == 1 {
-		p1, p2 = p2, p1
+// Random number in [1, n-1] from the entropy source
+func randomUint64(n uint64) (uint64, error) {
+	buffer := make([]byte, 8)
+	_, err := ReadRandom(buffer)
+	if err != nil {
+		return 0, err
 	}
 
-	return
+	return binary.LittleEndian.Uint64(buffer)%(n-1) + 1, nil
 }
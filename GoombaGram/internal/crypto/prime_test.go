@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crypto
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestSplitPQ(t *testing.T) {
+	tests := []struct {
+		pq, p, q uint64
+	}{
+		{0x17ED48941A08F981, 0x494C553B, 0x53911073}, // example of the MTProto documentation
+		{4294967291 * 4294967279, 4294967279, 4294967291},
+		{1000000007 * 998244353, 998244353, 1000000007},
+		{2 * 2147483647, 2, 2147483647},
+		{4294967291 * 4294967291, 4294967291, 4294967291},
+		{6, 2, 3},
+		{15, 3, 5},
+	}
+
+	for _, test := range tests {
+		p, q := SplitPQ(new(big.Int).SetUint64(test.pq))
+		if p == nil || p.Uint64() != test.p || q.Uint64() != test.q {
+			t.Fatalf("pq %d split in %v * %v, expected %d * %d", test.pq, p, q, test.p, test.q)
+		}
+	}
+}
+
+func TestSplitPQErrors(t *testing.T) {
+	tests := []*big.Int{
+		nil,
+		big.NewInt(0),
+		big.NewInt(-15),
+		big.NewInt(3),
+		new(big.Int).Lsh(big.NewInt(1), 64),
+		new(big.Int).SetUint64(18446744073709551557), // biggest 64 bit prime
+		big.NewInt(2147483647),
+	}
+
+	for _, pq := range tests {
+		// Primes are rejected at once, not after the timeout
+		start := time.Now()
+		if _, _, err := SplitPQContext(context.Background(), pq); err == nil {
+			t.Fatalf("pq %v split", pq)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("pq %v rejected after %v", pq, elapsed)
+		}
+
+		if p, q := SplitPQ(pq); p != nil || q != nil {
+			t.Fatalf("pq %v split in %v * %v", pq, p, q)
+		}
+	}
+}
+
+func TestSplitPQContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, err := SplitPQUint64(ctx, 4294967291*4294967279); err != context.Canceled {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkSplitPQ(b *testing.B) {
+	pq := new(big.Int).SetUint64(0x17ED48941A08F981)
+	for i := 0; i < b.N; i++ {
+		SplitPQ(pq)
+	}
+}
+
+func BenchmarkSplitPQ64(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, _, _ = SplitPQUint64(context.Background(), 4294967291*4294967279)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Entropy source used by every nonce, padding and key generator (crypto/rand by default)
+var (
+	randomSource     io.Reader = rand.Reader
+	randomSourceLock sync.Mutex
+)
+
+// Replace the entropy source of the whole process (nil is crypto/rand), restore sets the previous one again.
+// Tests can use it with DeterministicSource and t.Cleanup(restore), they must not run in parallel.
+func SetRandomSource(source io.Reader) (restore func()) {
+	if source == nil {
+		source = rand.Reader
+	}
+
+	randomSourceLock.Lock()
+	defer randomSourceLock.Unlock()
+
+	previous := randomSource
+	randomSource = source
+
+	return func() {
+		randomSourceLock.Lock()
+		randomSource = previous
+		randomSourceLock.Unlock()
+	}
+}
+
+// Fill b with random bytes from the entropy source
+func ReadRandom(b []byte) (int, error) {
+	randomSourceLock.Lock()
+	defer randomSourceLock.Unlock()
+
+	return io.ReadFull(randomSource, b)
+}
+
+// Random number in [0, max)
+func RandomInt(max int) (int, error) {
+	if max <= 0 {
+		return 0, errors.New("random: max must be positive")
+	}
+
+	buffer := make([]byte, 8)
+	_, err := ReadRandom(buffer)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(binary.LittleEndian.Uint64(buffer) % uint64(max)), nil
+}
+
+// Deterministic source for reproducible test vectors: AES-256-CTR keystream keyed with SHA256(seed).
+// It must never be used outside tests.
+func DeterministicSource(seed []byte) io.Reader {
+	key := sha256.Sum256(seed)
+	block, _ := aes.NewCipher(key[:])
+
+	return &deterministicSource{
+		stream: cipher.NewCTR(block, make([]byte, aes.BlockSize)),
+	}
+}
+
+type deterministicSource struct {
+	stream cipher.Stream
+}
+
+func (source *deterministicSource) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+
+	source.stream.XORKeyStream(b, b)
+	return len(b), nil
+}
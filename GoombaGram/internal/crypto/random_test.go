@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDeterministicSource(t *testing.T) {
+	first, second := make([]byte, 100), make([]byte, 100)
+	_, _ = io.ReadFull(DeterministicSource([]byte("seed")), first)
+	_, _ = io.ReadFull(DeterministicSource([]byte("seed")), second)
+	if !bytes.Equal(first, second) {
+		t.Fatal("same seed, different bytes")
+	}
+
+	_, _ = io.ReadFull(DeterministicSource([]byte("other")), second)
+	if bytes.Equal(first, second) {
+		t.Fatal("different seeds, same bytes")
+	}
+
+	// The stream goes on between reads
+	source := DeterministicSource([]byte("seed"))
+	_, _ = io.ReadFull(source, second[:30])
+	_, _ = io.ReadFull(source, second[30:])
+	_, _ = io.ReadFull(DeterministicSource([]byte("seed")), first)
+	if !bytes.Equal(first, second) {
+		t.Fatal("stream not continued")
+	}
+}
+
+func TestSetRandomSource(t *testing.T) {
+	want := make([]byte, 64)
+	_, _ = io.ReadFull(DeterministicSource([]byte("seed")), want)
+	other := make([]byte, 32)
+	_, _ = io.ReadFull(DeterministicSource([]byte("other")), other)
+
+	read := func() []byte {
+		got := make([]byte, 32)
+		if _, err := ReadRandom(got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	restore := SetRandomSource(DeterministicSource([]byte("seed")))
+	if !bytes.Equal(read(), want[:32]) {
+		t.Fatal("source not used")
+	}
+
+	// Nested replacements are restored in reverse order
+	restoreOther := SetRandomSource(DeterministicSource([]byte("other")))
+	if !bytes.Equal(read(), other) {
+		t.Fatal("second source not used")
+	}
+	restoreOther()
+	if !bytes.Equal(read(), want[32:]) {
+		t.Fatal("first source not restored")
+	}
+
+	restore()
+	if got := read(); bytes.Equal(got, want[:32]) || bytes.Equal(got, want[32:]) {
+		t.Fatal("source not restored")
+	}
+
+	// nil is crypto/rand
+	restore = SetRandomSource(nil)
+	defer restore()
+	if first, second := read(), read(); bytes.Equal(first, second) {
+		t.Fatal("nil source isn't random")
+	}
+}
+
+func TestRandomInt(t *testing.T) {
+	t.Cleanup(SetRandomSource(DeterministicSource([]byte("seed"))))
+
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		value, err := RandomInt(16)
+		if err != nil || value < 0 || value >= 16 {
+			t.Fatal(value, err)
+		}
+		seen[value] = true
+	}
+	if len(seen) != 16 {
+		t.Fatalf("%d values out of 16", len(seen))
+	}
+
+	if _, err := RandomInt(0); err == nil {
+		t.Fatal("max 0 accepted")
+	}
+}
@@ -15,3 +15,79 @@
  */
 
 package crypto
+
+import (
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"math/big"
+)
+
+// Server RSA public key and its fingerprint
+type RSAPublicKey struct {
+	Key         *rsa.PublicKey
+	Fingerprint int64
+}
+
+// Parse a PEM RSA public key ("BEGIN RSA PUBLIC KEY" or "BEGIN PUBLIC KEY"),
+// like the ones returned by help.getCdnConfig
+func ParseRSAPublicKey(data []byte) (*RSAPublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("rsa: PEM block not found")
+	}
+
+	var key *rsa.PublicKey
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		parsed, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = parsed
+
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		rsaKey, ok := parsed.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("rsa: the key isn't an RSA key")
+		}
+		key = rsaKey
+
+	default:
+		return nil, errors.New("rsa: unknown PEM block " + block.Type)
+	}
+
+	return &RSAPublicKey{
+		Key:         key,
+		Fingerprint: RSAFingerprint(key),
+	}, nil
+}
+
+// Key fingerprint: lower 64 bits of SHA1(n:bytes e:bytes), serialized as TL bytes
+func RSAFingerprint(key *rsa.PublicKey) int64 {
+	data := tlBytes(key.N.Bytes())
+	data = append(data, tlBytes(big.NewInt(int64(key.E)).Bytes())...)
+
+	hash := sha1.Sum(data)
+	return int64(binary.LittleEndian.Uint64(hash[12:20]))
+}
+
+// Serialize bytes as TL (length, data and padding to 4 bytes)
+func tlBytes(data []byte) []byte {
+	var result []byte
+	if len(data) <= 253 {
+		result = append([]byte{byte(len(data))}, data...)
+	} else {
+		result = append([]byte{254, byte(len(data)), byte(len(data) >> 8), byte(len(data) >> 16)}, data...)
+	}
+
+	return append(result, make([]byte, (4-len(result)%4)%4)...)
+}
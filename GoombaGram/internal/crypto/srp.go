@@ -0,0 +1,237 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crypto
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"math/big"
+)
+
+// Two-step verification (SRP 2048)
+// https://core.telegram.org/api/srp
+
+// Iterations of PBKDF2 in passwordKdfAlgoSHA256SHA256PBKDF2HMACSHA512iter100000SHA256ModPow
+const srpIterations = 100000
+
+// SRP numbers length (bytes)
+const srpLength = 256
+
+// Parameters of passwordKdfAlgoSHA256SHA256PBKDF2HMACSHA512iter100000SHA256ModPow
+type PasswordKdfAlgo struct {
+	Salt1 []byte
+	Salt2 []byte
+	G     int32
+	P     []byte
+}
+
+// Parameters of inputCheckPasswordSRP (srp_id is the one received from account.getPassword)
+type SRPAnswer struct {
+	A  []byte
+	M1 []byte
+}
+
+// Parameters of account.passwordInputSettings
+// With RemovePassword new_algo is passwordKdfAlgoUnknown and new_password_hash is empty.
+// When NewAlgo is nil and RemovePassword is false the current password is kept.
+type PasswordSettings struct {
+	NewAlgo         *PasswordKdfAlgo
+	NewPasswordHash []byte
+	Hint            string
+	Email           string
+	RemovePassword  bool
+}
+
+// H(data) = SHA256(data)
+func srpHash(data ...[]byte) []byte {
+	hash := sha256.New()
+	for _, d := range data {
+		hash.Write(d)
+	}
+	return hash.Sum(nil)
+}
+
+// SH(data, salt) = H(salt | data | salt)
+func srpSaltedHash(data, salt []byte) []byte {
+	return srpHash(salt, data, salt)
+}
+
+// PH2(password, salt1, salt2) = SH(pbkdf2(sha512, PH1(password, salt1, salt2), salt1, 100000), salt2)
+// PH1(password, salt1, salt2) = SH(SH(password, salt1), salt2)
+func srpPasswordHash(password []byte, algo *PasswordKdfAlgo) []byte {
+	ph1 := srpSaltedHash(srpSaltedHash(password, algo.Salt1), algo.Salt2)
+	return srpSaltedHash(PBKDF2(ph1, algo.Salt1, srpIterations, sha512.Size, sha512.New), algo.Salt2)
+}
+
+// Big endian number padded to 256 bytes
+func srpPad(number *big.Int) []byte {
+	result := make([]byte, srpLength)
+	number.FillBytes(result)
+	return result
+}
+
+// Check g and p received from the server, and return them as big numbers
+func (algo *PasswordKdfAlgo) params() (g, p *big.Int, err error) {
+	if algo == nil {
+		return nil, nil, errors.New("unknown password algorithm")
+	}
+
+	p = new(big.Int).SetBytes(algo.P)
+	err = CheckDHParams(algo.G, p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return big.NewInt(int64(algo.G)), p, nil
+}
+
+// Compute inputCheckPasswordSRP parameters from the result of account.getPassword
+// (current_algo and srp_B) and the user password
+func SRPCheck(password []byte, algo *PasswordKdfAlgo, srpB []byte) (*SRPAnswer, error) {
+	g, p, err := algo.params()
+	if err != nil {
+		return nil, err
+	}
+
+	// g_b must be a valid Diffie-Hellman value
+	gB := new(big.Int).SetBytes(srpB)
+	err = CheckDHValue(gB, p)
+	if err != nil {
+		return nil, err
+	}
+
+	// x = PH2(password, salt1, salt2)
+	x := new(big.Int).SetBytes(srpPasswordHash(password, algo))
+
+	// v = pow(g, x) mod p
+	v := new(big.Int).Exp(g, x, p)
+
+	// k = H(p | g)
+	k := new(big.Int).SetBytes(srpHash(srpPad(p), srpPad(g)))
+
+	// Random 2048 bit a, g_a = pow(g, a) mod p
+	var a, gA *big.Int
+	for {
+		randomA := make([]byte, srpLength)
+		_, err = ReadRandom(randomA)
+		if err != nil {
+			return nil, err
+		}
+
+		a = new(big.Int).SetBytes(randomA)
+		gA = new(big.Int).Exp(g, a, p)
+		if CheckDHValue(gA, p) == nil {
+			break
+		}
+	}
+
+	// u = H(g_a | g_b)
+	u := new(big.Int).SetBytes(srpHash(srpPad(gA), srpPad(gB)))
+	if u.Sign() == 0 {
+		return nil, errors.New("srp: u is zero")
+	}
+
+	// k_v = (k * v) mod p, t = (g_b - k_v) mod p
+	kV := new(big.Int).Mul(k, v)
+	kV.Mod(kV, p)
+	t := new(big.Int).Sub(gB, kV)
+	t.Mod(t, p)
+
+	// s_a = pow(t, a + u * x) mod p
+	exponent := new(big.Int).Mul(u, x)
+	exponent.Add(exponent, a)
+	sA := new(big.Int).Exp(t, exponent, p)
+
+	// k_a = H(s_a)
+	kA := srpHash(srpPad(sA))
+
+	// M1 = H(H(p) xor H(g) | H(salt1) | H(salt2) | g_a | g_b | k_a)
+	hashP := srpHash(srpPad(p))
+	hashG := srpHash(srpPad(g))
+	for i := range hashP {
+		hashP[i] ^= hashG[i]
+	}
+	m1 := srpHash(hashP, srpHash(algo.Salt1), srpHash(algo.Salt2), srpPad(gA), srpPad(gB), kA)
+
+	return &SRPAnswer{
+		A:  srpPad(gA),
+		M1: m1,
+	}, nil
+}
+
+// Compute new_password_hash (v = pow(g, x) mod p) for a new password.
+// newAlgo is new_algo from account.getPassword, its salt1 is extended with 32 random bytes as required by the server.
+func SRPNewPasswordHash(password []byte, newAlgo *PasswordKdfAlgo) (*PasswordKdfAlgo, []byte, error) {
+	g, p, err := newAlgo.params()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	salt := make([]byte, len(newAlgo.Salt1)+32)
+	copy(salt, newAlgo.Salt1)
+	_, err = ReadRandom(salt[len(newAlgo.Salt1):])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	algo := &PasswordKdfAlgo{
+		Salt1: salt,
+		Salt2: newAlgo.Salt2,
+		G:     newAlgo.G,
+		P:     newAlgo.P,
+	}
+
+	x := new(big.Int).SetBytes(srpPasswordHash(password, algo))
+	v := new(big.Int).Exp(g, x, p)
+
+	return algo, srpPad(v), nil
+}
+
+// Settings to set or change the password (account.updatePasswordSettings).
+// An empty email keeps the current recovery email.
+func PasswordSettingsNew(newPassword []byte, newAlgo *PasswordKdfAlgo, hint, email string) (*PasswordSettings, error) {
+	if len(newPassword) == 0 {
+		return nil, errors.New("new password is empty")
+	}
+
+	algo, hash, err := SRPNewPasswordHash(newPassword, newAlgo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasswordSettings{
+		NewAlgo:         algo,
+		NewPasswordHash: hash,
+		Hint:            hint,
+		Email:           email,
+	}, nil
+}
+
+// Settings to remove the password and the recovery email (account.updatePasswordSettings)
+func PasswordRemoveSettings() *PasswordSettings {
+	return &PasswordSettings{
+		RemovePassword: true,
+	}
+}
+
+// Settings to change only the recovery email, keeping the current password
+func PasswordEmailSettings(email string) *PasswordSettings {
+	return &PasswordSettings{
+		Email: email,
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testPasswordAlgo(t *testing.T) *PasswordKdfAlgo {
+	p, _ := new(big.Int).SetString(telegramDHPrime, 16)
+	return &PasswordKdfAlgo{
+		Salt1: decodeHex(t, "4d11fb6bec38f9d2"),
+		Salt2: decodeHex(t, "6c9ab12f0c7e8e10"),
+		G:     3,
+		P:     p.Bytes(),
+	}
+}
+
+func TestPBKDF2SHA512(t *testing.T) {
+	for _, test := range []struct {
+		iterations int
+		expected   string
+	}{
+		{1, "867f70cf1ade02cff3752599a3a53dc4af34c7a669815ae5d513554e1c8cf252c02d470a285a0501bad999bfe943c08f050235d7d68b1da55e63f73b60a57fce"},
+		{2, "e1d9c16aa681708a45f5c7c4e215ceb66e011a2e9f0040713f18aefdb866d53cf76cab2868a39b9f7840edce4fef5a82be67335c77a6068e04112754f27ccf4e"},
+	} {
+		key := PBKDF2([]byte("password"), []byte("salt"), test.iterations, sha512.Size, sha512.New)
+		if hex.EncodeToString(key) != test.expected {
+			t.Fatalf("%d iterations: %x", test.iterations, key)
+		}
+	}
+}
+
+func TestSRPPasswordHash(t *testing.T) {
+	// PH2("password", salt1, salt2) with 100000 PBKDF2-HMAC-SHA512 iterations
+	expected := "65f25157aba3e756218a21156c851d3eaafa3431ffb92d1b525f60bebd6f6147"
+	if hash := srpPasswordHash([]byte("password"), testPasswordAlgo(t)); hex.EncodeToString(hash) != expected {
+		t.Fatalf("%x", hash)
+	}
+}
+
+// Server side of SRP: B = (k * v + pow(g, b)) mod p, it returns B and the expected M1 for A
+type srpServer struct {
+	algo *PasswordKdfAlgo
+	g, p *big.Int
+	v, b *big.Int
+}
+
+func (server *srpServer) srpB() []byte {
+	k := new(big.Int).SetBytes(srpHash(srpPad(server.p), srpPad(server.g)))
+	gB := new(big.Int).Exp(server.g, server.b, server.p)
+	gB.Add(gB, new(big.Int).Mul(k, server.v))
+	gB.Mod(gB, server.p)
+	return srpPad(gB)
+}
+
+func (server *srpServer) m1(srpA []byte) []byte {
+	gA := new(big.Int).SetBytes(srpA)
+	gB := server.srpB()
+
+	// S = pow(A * pow(v, u), b) mod p
+	u := new(big.Int).SetBytes(srpHash(srpPad(gA), gB))
+	s := new(big.Int).Exp(server.v, u, server.p)
+	s.Mul(s, gA)
+	s.Exp(s, server.b, server.p)
+
+	hashP := srpHash(srpPad(server.p))
+	hashG := srpHash(srpPad(server.g))
+	for i := range hashP {
+		hashP[i] ^= hashG[i]
+	}
+	return srpHash(hashP, srpHash(server.algo.Salt1), srpHash(server.algo.Salt2), srpPad(gA), gB, srpHash(srpPad(s)))
+}
+
+func TestSRPCheck(t *testing.T) {
+	algo := testPasswordAlgo(t)
+	g, p := big.NewInt(3), new(big.Int).SetBytes(algo.P)
+
+	// Verifier saved by the server: v = pow(g, PH2) mod p
+	x := new(big.Int).SetBytes(decodeHex(t, "65f25157aba3e756218a21156c851d3eaafa3431ffb92d1b525f60bebd6f6147"))
+	server := &srpServer{
+		algo: algo,
+		g:    g,
+		p:    p,
+		v:    new(big.Int).Exp(g, x, p),
+		b:    new(big.Int).SetBytes(bytes.Repeat([]byte{0x5A}, 256)),
+	}
+
+	t.Cleanup(SetRandomSource(DeterministicSource([]byte("srp"))))
+	answer, err := SRPCheck([]byte("password"), algo, server.srpB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.A) != 256 || !bytes.Equal(answer.M1, server.m1(answer.A)) {
+		t.Fatal("M1 rejected by the server")
+	}
+
+	wrong, err := SRPCheck([]byte("wrong password"), algo, server.srpB())
+	if err != nil || bytes.Equal(wrong.M1, server.m1(wrong.A)) {
+		t.Fatal("wrong password accepted", err)
+	}
+}
+
+func TestSRPCheckErrors(t *testing.T) {
+	algo := testPasswordAlgo(t)
+	p := new(big.Int).SetBytes(algo.P)
+	valid := srpPad(new(big.Int).Exp(big.NewInt(3), big.NewInt(1<<40), p))
+
+	for _, srpB := range [][]byte{{1}, srpPad(new(big.Int).Sub(p, big.NewInt(1))), algo.P, nil} {
+		if _, err := SRPCheck([]byte("password"), algo, srpB); err == nil {
+			t.Fatalf("srp_B %x accepted", srpB)
+		}
+	}
+
+	wrongG := testPasswordAlgo(t)
+	wrongG.G = 8
+	wrongP := testPasswordAlgo(t)
+	wrongP.P = wrongP.P[:128]
+	for _, wrongAlgo := range []*PasswordKdfAlgo{nil, wrongG, wrongP} {
+		if _, err := SRPCheck([]byte("password"), wrongAlgo, valid); err == nil {
+			t.Fatalf("algo %+v accepted", wrongAlgo)
+		}
+	}
+}
+
+func TestSRPNewPasswordHash(t *testing.T) {
+	base := testPasswordAlgo(t)
+
+	algo, hash, err := SRPNewPasswordHash([]byte("new password"), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(algo.Salt1) != len(base.Salt1)+32 || !bytes.Equal(algo.Salt1[:len(base.Salt1)], base.Salt1) || !bytes.Equal(algo.Salt2, base.Salt2) {
+		t.Fatalf("wrong new algo %+v", algo)
+	}
+
+	// new_password_hash is the verifier of the new salt
+	g, p := big.NewInt(3), new(big.Int).SetBytes(base.P)
+	x := new(big.Int).SetBytes(srpPasswordHash([]byte("new password"), algo))
+	if len(hash) != 256 || new(big.Int).SetBytes(hash).Cmp(new(big.Int).Exp(g, x, p)) != 0 {
+		t.Fatal("wrong verifier")
+	}
+
+	// The new password can be checked against it
+	server := &srpServer{algo: algo, g: g, p: p, v: new(big.Int).SetBytes(hash), b: new(big.Int).SetBytes(bytes.Repeat([]byte{0x33}, 256))}
+	answer, err := SRPCheck([]byte("new password"), algo, server.srpB())
+	if err != nil || !bytes.Equal(answer.M1, server.m1(answer.A)) {
+		t.Fatal("new password rejected", err)
+	}
+
+	if _, err := PasswordSettingsNew(nil, base, "", ""); err == nil {
+		t.Fatal("empty password accepted")
+	}
+	settings, err := PasswordSettingsNew([]byte("new password"), base, "hint", "")
+	if err != nil || settings.Hint != "hint" || len(settings.NewPasswordHash) != 256 || settings.RemovePassword {
+		t.Fatal(settings, err)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package keyvisual
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// First secret chat layer that uses the 36 bytes key hash (SHA1 + SHA256)
+const longHashLayer = 46
+
+// Identicon colors, used by the official clients
+var identiconColors = []color.RGBA{
+	{0xff, 0xff, 0xff, 0xff},
+	{0xd5, 0xe6, 0xf3, 0xff},
+	{0x2d, 0x57, 0x75, 0xff},
+	{0x2f, 0x99, 0xc9, 0xff},
+}
+
+// Characters used for the text identicon, by color index (darker color, denser character)
+var identiconText = []string{"  ", "░░", "██", "▓▓"}
+
+// Key hash of a secret chat
+// layer < 46: substr(SHA1(key), 0, 16)
+// layer >= 46: substr(SHA1(key), 0, 16) + substr(SHA256(key), 0, 20)
+func SecretChatKeyHash(key []byte, layer int32) []byte {
+	sha1Hash := sha1.Sum(key)
+	result := append([]byte{}, sha1Hash[:16]...)
+
+	if layer >= longHashLayer {
+		sha256Hash := sha256.Sum256(key)
+		result = append(result, sha256Hash[:20]...)
+	}
+
+	return result
+}
+
+// Key hash as hex, in groups of 4 bytes (the text shown under the identicon)
+func KeyHashHex(keyHash []byte) string {
+	groups := make([]string, 0, len(keyHash)/4+1)
+	for i := 0; i < len(keyHash); i += 4 {
+		end := i + 4
+		if end > len(keyHash) {
+			end = len(keyHash)
+		}
+		groups = append(groups, hex.EncodeToString(keyHash[i:end]))
+	}
+
+	return strings.Join(groups, " ")
+}
+
+// Identicon grid: every cell is a color index (0-3) made of 2 bits of the key hash.
+// A 16 bytes hash gives an 8x8 grid, a 36 bytes hash a 12x12 grid.
+func Identicon(keyHash []byte) ([][]int, error) {
+	var size int
+	switch len(keyHash) {
+	case 16:
+		size = 8
+	case 36:
+		size = 12
+	default:
+		return nil, errors.New("identicon: key hash must be 16 or 36 bytes long")
+	}
+
+	grid := make([][]int, size)
+	bitPointer := 0
+	for y := range grid {
+		grid[y] = make([]int, size)
+		for x := range grid[y] {
+			grid[y][x] = int(keyHash[bitPointer/8]>>(uint(bitPointer)%8)) & 0x3
+			bitPointer += 2
+		}
+	}
+
+	return grid, nil
+}
+
+// Identicon as image, every cell is cellSize x cellSize pixels
+func IdenticonImage(keyHash []byte, cellSize int) (image.Image, error) {
+	if cellSize <= 0 {
+		return nil, errors.New("identicon: cell size must be positive")
+	}
+
+	grid, err := Identicon(keyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	side := len(grid) * cellSize
+	img := image.NewRGBA(image.Rect(0, 0, side, side))
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			img.SetRGBA(x, y, identiconColors[grid[y/cellSize][x/cellSize]])
+		}
+	}
+
+	return img, nil
+}
+
+// Write the identicon as PNG
+func IdenticonPNG(w io.Writer, keyHash []byte, cellSize int) error {
+	img, err := IdenticonImage(keyHash, cellSize)
+	if err != nil {
+		return err
+	}
+
+	return png.Encode(w, img)
+}
+
+// Identicon as text, one line for every row of the grid
+func IdenticonText(keyHash []byte) (string, error) {
+	grid, err := Identicon(keyHash)
+	if err != nil {
+		return "", err
+	}
+
+	var builder strings.Builder
+	for _, row := range grid {
+		for _, cell := range row {
+			builder.WriteString(identiconText[cell])
+		}
+		builder.WriteByte('\n')
+	}
+
+	return builder.String(), nil
+}
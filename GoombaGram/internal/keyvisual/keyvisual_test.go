@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package keyvisual
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// Bytes 00..ff
+func testKey() []byte {
+	key := make([]byte, 256)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+func TestEmojiTable(t *testing.T) {
+	// SHA256 of the table joined by new lines, a changed, moved or missing entry changes it
+	const digest = "bfae463f768800e2f624948a756025ca1a3ff55c8a858b9f0e4ebec8c1d66815"
+
+	if len(emoji) != 333 || emoji[0] != "😉" || emoji[332] != "🔷" {
+		t.Fatalf("%d emoji, from %s to %s", len(emoji), emoji[0], emoji[len(emoji)-1])
+	}
+	sum := sha256.Sum256([]byte(strings.Join(emoji, "\n")))
+	if hex.EncodeToString(sum[:]) != digest {
+		t.Fatal("emoji table changed")
+	}
+
+	seen := make(map[string]bool)
+	for _, e := range emoji {
+		if seen[e] {
+			t.Fatalf("%s repeated", e)
+		}
+		seen[e] = true
+	}
+}
+
+func TestCallEmoji(t *testing.T) {
+	key := testKey()
+	gA := make([]byte, 256)
+	for i := range gA {
+		gA[i] = byte(255 - i)
+	}
+
+	// SHA256(key + g_a) = 1c7454fdb5783a77 693d566de1ea54b3 f3ba558f48aae8f7 82c199c84e355143,
+	// emoji 122, 225, 65 and 23 (the last two numbers lose the sign bit)
+	expected := []string{"🌵", "🍴", "👞", "🙀"}
+	if got := CallEmoji(key, gA); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Fatalf("%v, %v expected", got, expected)
+	}
+
+	// 0x7fffffffffffffff % 333 = 79
+	if got := EmojiFromHash(bytes.Repeat([]byte{0xFF}, 32)); strings.Join(got, "") != "💍💍💍💍" {
+		t.Fatal(got)
+	}
+	if got := EmojiFromHash(make([]byte, 32)); strings.Join(got, "") != "😉😉😉😉" {
+		t.Fatal(got)
+	}
+}
+
+func TestSecretChatKeyHash(t *testing.T) {
+	key := testKey()
+
+	if hash := hex.EncodeToString(SecretChatKeyHash(key, 45)); hash != "4916d6bdb7f78e6803698cab32d1586e" {
+		t.Fatal(hash)
+	}
+	if hash := hex.EncodeToString(SecretChatKeyHash(key, 46)); hash != "4916d6bdb7f78e6803698cab32d1586e40aff2e9d2d8922e47afd4648e6967497158785f" {
+		t.Fatal(hash)
+	}
+
+	if text := KeyHashHex(SecretChatKeyHash(key, 45)); text != "4916d6bd b7f78e68 03698cab 32d1586e" {
+		t.Fatal(text)
+	}
+	if text := KeyHashHex([]byte{1, 2, 3, 4, 5}); text != "01020304 05" {
+		t.Fatal(text)
+	}
+}
+
+// Grid rows as strings of color indexes
+func gridRows(grid [][]int) []string {
+	rows := make([]string, len(grid))
+	for y, row := range grid {
+		for _, cell := range row {
+			rows[y] += string(rune('0' + cell))
+		}
+	}
+	return rows
+}
+
+func TestIdenticon(t *testing.T) {
+	key := testKey()
+
+	for _, test := range []struct {
+		layer int32
+		rows  []string
+	}{
+		{45, []string{"12012110", "21131332", "31323133", "23020221", "30001221", "03023222", "20301013", "02112321"}},
+		{46, []string{"120121102113", "133231323133", "230202213000", "122103023222", "203010130211", "232100013322",
+			"203312232013", "021320122320", "310133220113", "012123021221", "312112011031", "021102313311"}},
+	} {
+		grid, err := Identicon(SecretChatKeyHash(key, test.layer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows := gridRows(grid); strings.Join(rows, " ") != strings.Join(test.rows, " ") {
+			t.Fatalf("layer %d: %v", test.layer, rows)
+		}
+	}
+
+	if _, err := Identicon(make([]byte, 20)); err == nil {
+		t.Fatal("20 bytes hash accepted")
+	}
+}
+
+func TestIdenticonText(t *testing.T) {
+	text, err := IdenticonText(SecretChatKeyHash(testKey(), 45))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if len(lines) != 8 || lines[0] != "░░██  ░░██░░░░  " {
+		t.Fatalf("%q", text)
+	}
+}
+
+func TestIdenticonPNG(t *testing.T) {
+	keyHash := SecretChatKeyHash(testKey(), 46)
+
+	var buffer bytes.Buffer
+	if err := IdenticonPNG(&buffer, keyHash, 3); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 36 || img.Bounds().Dy() != 36 {
+		t.Fatal(img.Bounds())
+	}
+
+	grid, _ := Identicon(keyHash)
+	for y := 0; y < 36; y++ {
+		for x := 0; x < 36; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			expected := identiconColors[grid[y/3][x/3]]
+			if uint8(r>>8) != expected.R || uint8(g>>8) != expected.G || uint8(b>>8) != expected.B {
+				t.Fatalf("pixel %d,%d", x, y)
+			}
+		}
+	}
+
+	if err := IdenticonPNG(&buffer, keyHash, 0); err == nil {
+		t.Fatal("cell size 0 accepted")
+	}
+}
@@ -16,17 +16,46 @@
 
 package network
 
+import (
+	"context"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/network/transport/http"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/network/transport/tcp"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/network/transport/websocket"
+)
+
 // TCP (obfuscated mode available)
 // 0: Abridged
 // 1: Intermediate
 // 2: PaddedIntermediate
+// 3: Full (seqno and CRC32, no obfuscation)
+//
+// WebSocket (obfuscated Intermediate or PaddedIntermediate inside binary messages)
+// HTTP (POST requests to /api with long polling)
 //
-// Full transport is useless because its features are already implemented in TCP protocol
+// ReadFrame and WriteFrame are safe for concurrent use, a reader doesn't block a writer
+// Abridged, Intermediate, PaddedIntermediate and WebSocket can request quick ACKs (WriteFrameQuickAck),
+// the tokens received are passed to their QuickAck callback (crypto.QuickAckToken gives the expected one)
+// Transport errors of the server (-404, -429, -444) are returned by ReadFrame as *tcp.TransportError
+// The Context methods stop when ctx is done (or at the dial, handshake and idle timeouts)
 type netInterface interface {
 	Connect(address string, obfuscation bool) error
-	Send(data []byte) error
-	Receive(data []byte) error
+	ConnectContext(ctx context.Context, address string, obfuscation bool) error
+	WriteFrame(data []byte) error
+	WriteFrameContext(ctx context.Context, data []byte) error
+	ReadFrame() ([]byte, error)
+	ReadFrameContext(ctx context.Context) ([]byte, error)
 	Close() error
 }
 
-var modes = []string {"abridged", "intermediate", "intermediatePadded"}
\ No newline at end of file
+// Every transport implements netInterface
+var (
+	_ netInterface = (*tcp.Abridged)(nil)
+	_ netInterface = (*tcp.Intermediate)(nil)
+	_ netInterface = (*tcp.PaddedIntermediate)(nil)
+	_ netInterface = (*tcp.Full)(nil)
+	_ netInterface = (*websocket.WebSocket)(nil)
+	_ netInterface = (*http.HTTP)(nil)
+)
+
+// Transport modes of a connection Method
+var modes = []string {"abridged", "intermediate", "intermediatePadded", "full", "websocket", "websocketPadded", "http"}
\ No newline at end of file
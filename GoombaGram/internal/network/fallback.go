@@ -0,0 +1,341 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/network/transport/http"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/network/transport/tcp"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/network/transport/websocket"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default delay before the next method is started by a race (RFC 8305 recommends 250ms)
+const defaultRaceDelay = 250 * time.Millisecond
+
+// Telegram Web hosts of the DCs (<name>.web.telegram.org), used by the WebSocket methods:
+// TLS certificates are issued for these names, not for the IP addresses of the DCs
+var webSocketHosts = map[int]string{1: "pluto", 2: "venus", 3: "aurora", 4: "vesta", 5: "flora"}
+
+// Addresses of a DC (IP without port), empty if the DC isn't reachable with that IP version
+type DCAddress struct {
+	IPv4 string // e.g. 149.154.167.51
+	IPv6 string // e.g. 2001:67c:4e8:f002::a
+}
+
+// Connection method of a Fallback
+type Method struct {
+	Mode        string       // one of modes (abridged, intermediate, intermediatePadded, full, websocket, websocketPadded, http)
+	Address     string       // host:port used instead of the DC address (test servers, other WebSocket hosts...)
+	Port        int          // port of the DC address (443 if zero)
+	IPv6        bool         // connect to the IPv6 address of the DC (not for WebSocket, it uses the DC host name)
+	Obfuscation bool         // obfuscated TCP (WebSocket requires it, Full and HTTP don't support it)
+	Dialer      tcp.Dialer   // dialer of the connection, e.g. a proxy.Config (nil for a direct connection)
+	Timeouts    tcp.Timeouts // dial, handshake and idle timeouts
+}
+
+func (method Method) String() string {
+	var obfuscated, ip, proxy string
+	if method.Obfuscation {
+		obfuscated = " obfuscated"
+	}
+	if method.IPv6 {
+		ip = " ipv6"
+	}
+	if method.Dialer != nil {
+		proxy = " (dialer)"
+	}
+
+	port := method.Port
+	if port == 0 {
+		port = 443
+	}
+
+	if method.Address != "" {
+		return method.Mode + obfuscated + " " + method.Address + proxy
+	}
+	return method.Mode + obfuscated + ip + " port " + strconv.Itoa(port) + proxy
+}
+
+// Address to connect to
+func (method Method) address(dcID int, dc DCAddress) (string, error) {
+	if method.Address != "" {
+		return method.Address, nil
+	}
+
+	port := method.Port
+	if port == 0 {
+		port = 443
+	}
+
+	if method.Mode == "websocket" || method.Mode == "websocketPadded" {
+		host, ok := webSocketHosts[dcID]
+		if !ok {
+			return "", fmt.Errorf("%v: no WebSocket host for DC %d", method, dcID)
+		}
+		return net.JoinHostPort(host+".web.telegram.org", strconv.Itoa(port)), nil
+	}
+
+	ip := dc.IPv4
+	if method.IPv6 {
+		ip = dc.IPv6
+	}
+	if ip == "" {
+		return "", fmt.Errorf("%v: the DC has no address", method)
+	}
+
+	// IPv6 addresses are enclosed in brackets
+	return net.JoinHostPort(ip, strconv.Itoa(port)), nil
+}
+
+// New transport of the method
+func (method Method) transport() (netInterface, error) {
+	switch method.Mode {
+	case "abridged":
+		return &tcp.Abridged{Dialer: method.Dialer, Timeouts: method.Timeouts}, nil
+	case "intermediate":
+		return &tcp.Intermediate{Dialer: method.Dialer, Timeouts: method.Timeouts}, nil
+	case "intermediatePadded":
+		return &tcp.PaddedIntermediate{Dialer: method.Dialer, Timeouts: method.Timeouts}, nil
+	case "full":
+		return &tcp.Full{Dialer: method.Dialer, Timeouts: method.Timeouts}, nil
+	case "websocket":
+		return &websocket.WebSocket{Dialer: method.Dialer, Timeouts: method.Timeouts}, nil
+	case "websocketPadded":
+		return &websocket.WebSocket{Padded: true, Dialer: method.Dialer, Timeouts: method.Timeouts}, nil
+	case "http":
+		return &http.HTTP{Dialer: method.Dialer, Timeouts: method.Timeouts}, nil
+	}
+
+	return nil, fmt.Errorf("unknown transport mode %q, available modes: %v", method.Mode, modes)
+}
+
+// Connect a new transport with the method, confirm checks it (optional)
+func (method Method) connect(ctx context.Context, dcID int, dc DCAddress, confirm func(ctx context.Context, transport Transport) error) (Transport, error) {
+	address, err := method.address(dcID, dc)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := method.transport()
+	if err != nil {
+		return nil, err
+	}
+
+	err = transport.ConnectContext(ctx, address, method.Obfuscation)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", method, err)
+	}
+
+	if confirm != nil {
+		err = confirm(ctx, transport)
+		if err != nil {
+			_ = transport.Close()
+			return nil, fmt.Errorf("%v: %w", method, err)
+		}
+	}
+
+	return transport, nil
+}
+
+// Fallback
+//
+// Ordered list of connection methods, e.g. obfuscated PaddedIntermediate on port 443, then Abridged on port 80,
+// then through a SOCKS5 proxy. The methods are tried in turn or raced (happy eyeballs: the next method starts
+// if the previous one hasn't connected within RaceDelay), the method that worked for a DC is tried first
+// the next time. A transport that connects may still not reach the DC (middleboxes, captive portals), so
+// Confirm can check it with an exchange with the DC before the method wins.
+type Fallback struct {
+	Methods   []Method      // methods in order of preference
+	Race      bool          // race the methods instead of trying them in turn
+	RaceDelay time.Duration // head start of every method in a race (250ms if zero)
+
+	// Check that the DC answers on a new transport, e.g. req_pq_multi and resPQ (optional)
+	Confirm func(ctx context.Context, transport Transport) error
+
+	lock      sync.Mutex
+	preferred map[int]int // DC id -> index of the method that worked
+}
+
+// Method that worked for the DC
+func (fallback *Fallback) Preferred(dcID int) (Method, bool) {
+	fallback.lock.Lock()
+	defer fallback.lock.Unlock()
+
+	index, ok := fallback.preferred[dcID]
+	if !ok {
+		return Method{}, false
+	}
+
+	return fallback.Methods[index], true
+}
+
+// Forget the method that worked for the DC (e.g. after a network change)
+func (fallback *Fallback) Forget(dcID int) {
+	fallback.lock.Lock()
+	delete(fallback.preferred, dcID)
+	fallback.lock.Unlock()
+}
+
+// Indexes of the methods, the preferred one first
+func (fallback *Fallback) order(dcID int) []int {
+	fallback.lock.Lock()
+	preferred, ok := fallback.preferred[dcID]
+	fallback.lock.Unlock()
+
+	order := make([]int, 0, len(fallback.Methods))
+	if ok && preferred < len(fallback.Methods) {
+		order = append(order, preferred)
+	}
+
+	for i := range fallback.Methods {
+		if !ok || i != preferred {
+			order = append(order, i)
+		}
+	}
+
+	return order
+}
+
+// Connect to the DC with the first method that works
+func (fallback *Fallback) DialContext(ctx context.Context, dcID int, dc DCAddress) (Transport, error) {
+	if len(fallback.Methods) == 0 {
+		return nil, errors.New("fallback: no connection methods")
+	}
+
+	var transport Transport
+	var index int
+	var err error
+	if fallback.Race {
+		transport, index, err = fallback.race(ctx, dcID, fallback.order(dcID), dc)
+	} else {
+		transport, index, err = fallback.sequence(ctx, dcID, fallback.order(dcID), dc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fallback.lock.Lock()
+	if fallback.preferred == nil {
+		fallback.preferred = map[int]int{}
+	}
+	fallback.preferred[dcID] = index
+	fallback.lock.Unlock()
+
+	return transport, nil
+}
+
+// Dial function of the DC for Reconnecting, every reconnection goes through the methods again
+func (fallback *Fallback) Dial(dcID int, dc DCAddress) func(ctx context.Context) (Transport, error) {
+	return func(ctx context.Context) (Transport, error) {
+		return fallback.DialContext(ctx, dcID, dc)
+	}
+}
+
+// Try the methods in turn
+func (fallback *Fallback) sequence(ctx context.Context, dcID int, order []int, dc DCAddress) (Transport, int, error) {
+	var errs []error
+	for _, index := range order {
+		transport, err := fallback.Methods[index].connect(ctx, dcID, dc, fallback.Confirm)
+		if err == nil {
+			return transport, index, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, 0, errors.Join(errs...)
+}
+
+// Start the methods one after another, a method starts when the previous one fails or after RaceDelay.
+// The first transport connected (and confirmed) wins, the other attempts are cancelled.
+func (fallback *Fallback) race(ctx context.Context, dcID int, order []int, dc DCAddress) (Transport, int, error) {
+	delay := fallback.RaceDelay
+	if delay <= 0 {
+		delay = defaultRaceDelay
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		transport Transport
+		index     int
+		err       error
+	}
+	results := make(chan result, len(order))
+
+	next, running := 0, 0
+	start := func() {
+		index := order[next]
+		next++
+		running++
+
+		go func() {
+			transport, err := fallback.Methods[index].connect(ctx, dcID, dc, fallback.Confirm)
+			results <- result{transport, index, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var errs []error
+	for running > 0 {
+		select {
+		case res := <-results:
+			running--
+			if res.err == nil {
+				// Close the transports connected by the methods still running
+				go func(running int) {
+					for ; running > 0; running-- {
+						if late := <-results; late.err == nil {
+							_ = late.transport.Close()
+						}
+					}
+				}(running)
+				return res.transport, res.index, nil
+			}
+
+			errs = append(errs, res.err)
+			if next < len(order) {
+				start()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(order) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, 0, ctx.Err()
+	}
+
+	return nil, 0, errors.Join(errs...)
+}
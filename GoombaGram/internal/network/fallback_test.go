@@ -0,0 +1,370 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/network/transport/tcp"
+)
+
+// Transport server that echoes every frame, it returns its port
+func echoServer(t *testing.T) int {
+	t.Helper()
+
+	ln, err := tcp.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			server, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer server.Close()
+				for {
+					data, err := server.ReadFrame()
+					if err != nil {
+						return
+					}
+					if err := server.WriteFrame(data); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	number, _ := strconv.Atoi(port)
+	return number
+}
+
+// Port that refuses connections
+func closedPort(t *testing.T) int {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	_ = ln.Close()
+
+	number, _ := strconv.Atoi(port)
+	return number
+}
+
+// Dialer that records the dialed addresses, it waits delay before dialing
+type recordDialer struct {
+	delay time.Duration
+	lock  sync.Mutex
+	dials []string
+}
+
+func (dialer *recordDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer.lock.Lock()
+	dialer.dials = append(dialer.dials, address)
+	dialer.lock.Unlock()
+
+	select {
+	case <-time.After(dialer.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return new(net.Dialer).DialContext(ctx, network, address)
+}
+
+func (dialer *recordDialer) count() int {
+	dialer.lock.Lock()
+	defer dialer.lock.Unlock()
+	return len(dialer.dials)
+}
+
+var localDC = DCAddress{IPv4: "127.0.0.1"}
+
+// Check that transport is connected to the echo server
+func checkEcho(t *testing.T, transport Transport) {
+	t.Helper()
+
+	want := "abcdabcdabcdabcdabcdabcd"
+	ctx := context.Background()
+	if err := transport.WriteFrameContext(ctx, []byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := transport.ReadFrameContext(ctx)
+	if err != nil || !strings.HasPrefix(string(data), want) {
+		t.Fatal(data, err)
+	}
+}
+
+func checkPreferred(t *testing.T, fallback *Fallback, dcID int, want Method) {
+	t.Helper()
+
+	method, ok := fallback.Preferred(dcID)
+	if !ok || method.String() != want.String() {
+		t.Fatalf("preferred method %v (%v), expected %v", method, ok, want)
+	}
+}
+
+func TestMethodAddress(t *testing.T) {
+	dc := DCAddress{IPv4: "149.154.167.51", IPv6: "2001:67c:4e8:f002::a"}
+
+	tests := []struct {
+		method Method
+		dcID   int
+		dc     DCAddress
+		want   string
+	}{
+		{Method{Mode: "abridged"}, 2, dc, "149.154.167.51:443"},
+		{Method{Mode: "abridged", Port: 80}, 2, dc, "149.154.167.51:80"},
+		{Method{Mode: "intermediatePadded", IPv6: true}, 2, dc, "[2001:67c:4e8:f002::a]:443"},
+		{Method{Mode: "abridged", IPv6: true}, 2, DCAddress{IPv4: "149.154.167.51"}, ""},
+		{Method{Mode: "abridged"}, 2, DCAddress{IPv6: "2001:67c:4e8:f002::a"}, ""},
+		{Method{Mode: "abridged", Address: "example.com:8443"}, 2, dc, "example.com:8443"},
+		{Method{Mode: "websocket"}, 2, dc, "venus.web.telegram.org:443"},
+		{Method{Mode: "websocketPadded", IPv6: true}, 4, dc, "vesta.web.telegram.org:443"},
+		{Method{Mode: "websocket"}, 1, dc, "pluto.web.telegram.org:443"},
+		{Method{Mode: "websocket"}, 9, dc, ""},
+	}
+
+	for _, test := range tests {
+		address, err := test.method.address(test.dcID, test.dc)
+		if test.want == "" {
+			if err == nil {
+				t.Fatalf("%v: address %s, expected an error", test.method, address)
+			}
+			continue
+		}
+		if err != nil || address != test.want {
+			t.Fatalf("%v: %s %v, expected %s", test.method, address, err, test.want)
+		}
+	}
+
+	if _, err := (Method{Mode: "bogus"}).transport(); err == nil {
+		t.Fatal("unknown mode accepted")
+	}
+}
+
+func TestFallbackSequence(t *testing.T) {
+	port, closed := echoServer(t), closedPort(t)
+
+	refused := &recordDialer{}
+	methods := []Method{
+		{Mode: "intermediatePadded", Obfuscation: true, Port: closed, Dialer: refused},
+		{Mode: "abridged", IPv6: true, Port: port},
+		{Mode: "bogus", Port: port},
+		{Mode: "abridged", Port: port},
+		{Mode: "full", Port: port},
+	}
+	fallback := &Fallback{Methods: methods}
+
+	if _, ok := fallback.Preferred(2); ok {
+		t.Fatal("preferred method before a connection")
+	}
+
+	transport, err := fallback.DialContext(context.Background(), 2, localDC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, transport)
+	_ = transport.Close()
+	checkPreferred(t, fallback, 2, methods[3])
+
+	// The preferred method is tried first
+	transport, err = fallback.DialContext(context.Background(), 2, localDC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = transport.Close()
+	if refused.count() != 1 {
+		t.Fatalf("failed method dialed %d times", refused.count())
+	}
+
+	// Memory is per DC
+	if _, ok := fallback.Preferred(4); ok {
+		t.Fatal("preferred method of another DC")
+	}
+
+	fallback.Forget(2)
+	if _, ok := fallback.Preferred(2); ok {
+		t.Fatal("preferred method after Forget")
+	}
+	transport, err = fallback.DialContext(context.Background(), 2, localDC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = transport.Close()
+	if refused.count() != 2 {
+		t.Fatalf("failed method dialed %d times after Forget", refused.count())
+	}
+}
+
+func TestFallbackAllFail(t *testing.T) {
+	closed := closedPort(t)
+	fallback := &Fallback{Methods: []Method{
+		{Mode: "abridged", Port: closed},
+		{Mode: "http", Port: closed},
+		{Mode: "bogus"},
+	}}
+
+	_, err := fallback.DialContext(context.Background(), 2, localDC)
+	if err == nil {
+		t.Fatal("no error")
+	}
+	for _, part := range []string{"abridged", "http", "bogus"} {
+		if !strings.Contains(err.Error(), part) {
+			t.Fatalf("error of %s missing: %v", part, err)
+		}
+	}
+	if _, ok := fallback.Preferred(2); ok {
+		t.Fatal("preferred method after a failure")
+	}
+
+	if _, err := new(Fallback).DialContext(context.Background(), 2, localDC); err == nil {
+		t.Fatal("no methods")
+	}
+}
+
+func TestFallbackRace(t *testing.T) {
+	port, closed := echoServer(t), closedPort(t)
+
+	tests := []struct {
+		name      string
+		delay     time.Duration
+		methods   []Method
+		winner    int
+		maxTime   time.Duration
+		startedBy int // methods started when the winner connects
+	}{
+		{
+			name:    "first method has a head start",
+			delay:   time.Second,
+			methods: []Method{{Mode: "abridged", Port: port}, {Mode: "intermediate", Port: port}},
+			winner:  0,
+			maxTime: 500 * time.Millisecond,
+		},
+		{
+			name:    "slow method loses after the race delay",
+			delay:   20 * time.Millisecond,
+			methods: []Method{{Mode: "abridged", Port: port, Dialer: &recordDialer{delay: 2 * time.Second}}, {Mode: "intermediate", Obfuscation: true, Port: port}},
+			winner:  1,
+			maxTime: time.Second,
+		},
+		{
+			name:    "failed method starts the next one at once",
+			delay:   5 * time.Second,
+			methods: []Method{{Mode: "abridged", Port: closed}, {Mode: "intermediatePadded", Port: port}},
+			winner:  1,
+			maxTime: time.Second,
+		},
+		{
+			name:    "unreachable http doesn't win",
+			delay:   time.Millisecond,
+			methods: []Method{{Mode: "http", Port: closed}, {Mode: "abridged", Port: port, Dialer: &recordDialer{delay: 50 * time.Millisecond}}},
+			winner:  1,
+			maxTime: time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fallback := &Fallback{Race: true, RaceDelay: test.delay, Methods: test.methods}
+
+			start := time.Now()
+			transport, err := fallback.DialContext(context.Background(), 2, localDC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer transport.Close()
+
+			if elapsed := time.Since(start); elapsed > test.maxTime {
+				t.Fatalf("connected after %v", elapsed)
+			}
+			checkEcho(t, transport)
+			checkPreferred(t, fallback, 2, test.methods[test.winner])
+		})
+	}
+}
+
+func TestFallbackRaceCancel(t *testing.T) {
+	port := echoServer(t)
+	fallback := &Fallback{Race: true, Methods: []Method{{Mode: "abridged", Port: port, Dialer: &recordDialer{delay: time.Second}}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := fallback.DialContext(ctx, 2, localDC); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
+
+func TestFallbackConfirm(t *testing.T) {
+	port := echoServer(t)
+	methods := []Method{{Mode: "abridged", Port: port}, {Mode: "intermediate", Port: port}}
+
+	for _, race := range []bool{false, true} {
+		// The DC doesn't answer on the first method
+		var lock sync.Mutex
+		confirmed := 0
+		fallback := &Fallback{Race: race, Methods: methods, Confirm: func(ctx context.Context, transport Transport) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if _, ok := transport.(*tcp.Abridged); ok {
+				return errors.New("no answer")
+			}
+			confirmed++
+			return nil
+		}}
+
+		transport, err := fallback.DialContext(context.Background(), 2, localDC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkEcho(t, transport)
+		_ = transport.Close()
+
+		checkPreferred(t, fallback, 2, methods[1])
+		if confirmed != 1 {
+			t.Fatalf("%d transports confirmed", confirmed)
+		}
+	}
+}
+
+func TestFallbackReconnecting(t *testing.T) {
+	port := echoServer(t)
+	fallback := &Fallback{Methods: []Method{{Mode: "abridged", Port: closedPort(t)}, {Mode: "intermediate", Obfuscation: true, Port: port}}}
+
+	conn := &Reconnecting{Dial: fallback.Dial(2, localDC)}
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	checkEcho(t, conn)
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// https://tools.ietf.org/html/rfc1928
+// https://tools.ietf.org/html/rfc1929
+
+const (
+	socksVersion = 0x05
+
+	socksNoAuth       = 0x00
+	socksPasswordAuth = 0x02
+	socksNoAcceptable = 0xFF
+
+	socksConnect = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+)
+
+var socksReplies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// SOCKS5 handshake, host names are sent to the proxy (remote DNS)
+func (config *Config) socks5Connect(conn io.ReadWriter, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil || port <= 0 || port > 65535 {
+		return errors.New("socks5: wrong port")
+	}
+
+	// Authentication methods
+	methods := []byte{socksNoAuth}
+	if config.Username != "" {
+		methods = []byte{socksNoAuth, socksPasswordAuth}
+	}
+
+	_, err = conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+
+	answer := make([]byte, 2)
+	_, err = io.ReadFull(conn, answer)
+	if err != nil {
+		return err
+	}
+
+	if answer[0] != socksVersion {
+		return errors.New("socks5: wrong server version")
+	}
+
+	switch answer[1] {
+	case socksNoAuth:
+	case socksPasswordAuth:
+		err = config.socks5Authenticate(conn)
+		if err != nil {
+			return err
+		}
+	case socksNoAcceptable:
+		return errors.New("socks5: no acceptable authentication method")
+	default:
+		return errors.New("socks5: unsupported authentication method")
+	}
+
+	// CONNECT request
+	request := []byte{socksVersion, socksConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(append(request, socksIPv4), ip4...)
+		} else {
+			request = append(append(request, socksIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("socks5: host name is too long")
+		}
+		request = append(append(request, socksDomain, byte(len(host))), host...)
+	}
+
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	request = append(request, portBytes...)
+
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	// Reply: version, reply, reserved, address type, bound address, bound port
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+
+	if reply[0] != socksVersion {
+		return errors.New("socks5: wrong server version")
+	}
+
+	if reply[1] != 0x00 {
+		if int(reply[1]) < len(socksReplies) {
+			return errors.New("socks5: " + socksReplies[reply[1]])
+		}
+		return errors.New("socks5: unknown error")
+	}
+
+	var boundLength int
+	switch reply[3] {
+	case socksIPv4:
+		boundLength = net.IPv4len
+	case socksIPv6:
+		boundLength = net.IPv6len
+	case socksDomain:
+		domainLength := make([]byte, 1)
+		_, err = io.ReadFull(conn, domainLength)
+		if err != nil {
+			return err
+		}
+		boundLength = int(domainLength[0])
+	default:
+		return errors.New("socks5: unknown bound address type")
+	}
+
+	// Bound address and port aren't used
+	_, err = io.ReadFull(conn, make([]byte, boundLength+2))
+	return err
+}
+
+// Username/password authentication
+func (config *Config) socks5Authenticate(conn io.ReadWriter) error {
+	if config.Username == "" || len(config.Username) > 255 || len(config.Password) > 255 {
+		return errors.New("socks5: wrong username or password length")
+	}
+
+	request := []byte{0x01, byte(len(config.Username))}
+	request = append(request, config.Username...)
+	request = append(request, byte(len(config.Password)))
+	request = append(request, config.Password...)
+
+	_, err := conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	answer := make([]byte, 2)
+	_, err = io.ReadFull(conn, answer)
+	if err != nil {
+		return err
+	}
+
+	if answer[1] != 0x00 {
+		return errors.New("socks5: authentication failed")
+	}
+
+	return nil
+}
@@ -0,0 +1,430 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package network
+
+import (
+	"context"
+	"errors"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/network/transport/tcp"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transport with context support (tcp, websocket and http transports)
+type Transport interface {
+	WriteFrameContext(ctx context.Context, data []byte) error
+	ReadFrameContext(ctx context.Context) ([]byte, error)
+	Close() error
+}
+
+// Transport connected to an address (Abridged, Intermediate, PaddedIntermediate, Full, WebSocket, HTTP)
+type ConnectTransport interface {
+	Transport
+	ConnectContext(ctx context.Context, address string, obfuscation bool) error
+}
+
+// Dial function that connects a new transport to address every time,
+// so the obfuscation handshake is done again with new keys
+func DialTransport(newTransport func() ConnectTransport, address string, obfuscation bool) func(ctx context.Context) (Transport, error) {
+	return func(ctx context.Context) (Transport, error) {
+		transport := newTransport()
+
+		err := transport.ConnectContext(ctx, address, obfuscation)
+		if err != nil {
+			return nil, err
+		}
+
+		return transport, nil
+	}
+}
+
+// Connection state
+type State int
+
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateConnected
+	StateBackingOff
+)
+
+func (state State) String() string {
+	switch state {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateBackingOff:
+		return "backing off"
+	}
+
+	return "unknown"
+}
+
+// State change of a Reconnecting connection
+type StateEvent struct {
+	State   State
+	Attempt int           // connection attempt, from 1 (Connecting and BackingOff)
+	Delay   time.Duration // wait before the next attempt (BackingOff)
+	Err     error         // error that caused the disconnection or the failed attempt
+}
+
+// Exponential backoff with jitter, zero values use the defaults
+type Backoff struct {
+	Initial     time.Duration // first delay (500ms)
+	Max         time.Duration // maximum delay (30s)
+	Multiplier  float64       // delay multiplier after every failed attempt (2)
+	Jitter      float64       // random part of the delay, from 0 to 1 (0.2, so the delay is ±20%)
+	MaxAttempts int           // attempts of a connection before giving up (0 for no limit)
+}
+
+// Delay after the failed attempt number attempt (from 1)
+func (backoff Backoff) delay(attempt int) time.Duration {
+	initial, max, multiplier, jitter := backoff.Initial, backoff.Max, backoff.Multiplier, backoff.Jitter
+	if initial <= 0 {
+		initial = 500 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	if jitter <= 0 || jitter > 1 {
+		jitter = 0.2
+	}
+
+	delay := math.Min(float64(initial)*math.Pow(multiplier, float64(attempt-1)), float64(max))
+
+	// Random factor between 1 - jitter and 1 + jitter, also after the cap so that clients don't retry together
+	random, err := crypto.RandomInt(1 << 20)
+	if err == nil {
+		delay *= 1 - jitter + 2*jitter*float64(random)/(1<<20)
+	}
+
+	return time.Duration(math.Min(delay, float64(max)))
+}
+
+// Reconnecting
+//
+// Connection that replaces its transport when a read or a write fails, with exponential backoff between
+// the attempts. The auth key and the session are above the transport, so they're kept: only the transport
+// (and its obfuscation keys) is new, the frames whose write failed are written again and Resend gives
+// the pending messages of the session to send after every reconnection.
+type Reconnecting struct {
+	Dial    func(ctx context.Context) (Transport, error) // connect a new transport (DialTransport)
+	Backoff Backoff                                      // delays between the attempts
+	Resend  func() [][]byte                              // frames to send after a reconnection (optional)
+	OnState func(event StateEvent)                       // called on every state change, it mustn't block (optional)
+
+	lock         sync.Mutex
+	transport    Transport     // nil while reconnecting
+	generation   int           // incremented when the transport is replaced
+	ready        chan struct{} // closed when reconnecting ends
+	reconnecting bool
+	state        State
+	err          error           // the connection is over (Close or too many attempts)
+	ctx          context.Context // cancelled by Close
+	cancel       context.CancelFunc
+}
+
+// Connect the first transport, with the same backoff of the reconnections
+func (conn *Reconnecting) Connect() error {
+	return conn.ConnectContext(context.Background())
+}
+
+// Connect within ctx
+func (conn *Reconnecting) ConnectContext(ctx context.Context) error {
+	if conn.Dial == nil {
+		return errors.New("reconnecting: Dial is missing")
+	}
+
+	conn.lock.Lock()
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	conn.transport, conn.err, conn.reconnecting = nil, nil, false
+	conn.lock.Unlock()
+
+	dialCtx, stop := mergeContext(ctx, conn.ctx)
+	defer stop()
+
+	transport, err := conn.dial(dialCtx, false)
+	if err != nil {
+		conn.lock.Lock()
+		if conn.err == nil {
+			conn.err = err
+		}
+		conn.lock.Unlock()
+
+		conn.cancel()
+		return err
+	}
+
+	conn.lock.Lock()
+	err = conn.err
+	if err == nil {
+		conn.transport = transport
+	}
+	conn.lock.Unlock()
+
+	// Closed while connecting
+	if err != nil {
+		_ = transport.Close()
+		return err
+	}
+
+	conn.setState(StateEvent{State: StateConnected})
+	return nil
+}
+
+// ctx cancelled by parent or by other
+func mergeContext(parent, other context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(other, cancel)
+
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// Connect a transport with backoff, on a reconnection the Resend frames are written before it's returned
+func (conn *Reconnecting) dial(ctx context.Context, reconnection bool) (Transport, error) {
+	for attempt := 1; ; attempt++ {
+		conn.setState(StateEvent{State: StateConnecting, Attempt: attempt})
+
+		transport, err := conn.Dial(ctx)
+		if err == nil && reconnection && conn.Resend != nil {
+			for _, frame := range conn.Resend() {
+				err = transport.WriteFrameContext(ctx, frame)
+				if err != nil {
+					_ = transport.Close()
+					break
+				}
+			}
+		}
+
+		if err == nil {
+			return transport, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if conn.Backoff.MaxAttempts > 0 && attempt >= conn.Backoff.MaxAttempts {
+			conn.setState(StateEvent{State: StateDisconnected, Attempt: attempt, Err: err})
+			return nil, err
+		}
+
+		delay := conn.Backoff.delay(attempt)
+		conn.setState(StateEvent{State: StateBackingOff, Attempt: attempt, Delay: delay, Err: err})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Replace the transport of generation after err, unless it has already been replaced
+func (conn *Reconnecting) reconnect(generation int, err error) {
+	conn.lock.Lock()
+	if generation != conn.generation || conn.transport == nil || conn.err != nil {
+		conn.lock.Unlock()
+		return
+	}
+
+	old := conn.transport
+	conn.transport = nil
+	conn.generation++
+	conn.ready = make(chan struct{})
+	conn.reconnecting = true
+	ctx := conn.ctx
+	conn.lock.Unlock()
+
+	_ = old.Close()
+	conn.setState(StateEvent{State: StateDisconnected, Err: err})
+
+	go func() {
+		transport, err := conn.dial(ctx, true)
+
+		conn.lock.Lock()
+		if err != nil {
+			if conn.err == nil {
+				conn.err = err
+			}
+		} else if conn.err != nil {
+			// Closed while connecting
+			_ = transport.Close()
+		} else {
+			conn.transport = transport
+		}
+
+		connected := conn.transport != nil
+		if conn.reconnecting {
+			conn.reconnecting = false
+			close(conn.ready)
+		}
+		conn.lock.Unlock()
+
+		if connected {
+			conn.setState(StateEvent{State: StateConnected})
+		}
+	}()
+}
+
+// Current transport and its generation, it waits for a reconnection
+func (conn *Reconnecting) current(ctx context.Context) (Transport, int, error) {
+	for {
+		conn.lock.Lock()
+		transport, generation, ready, err := conn.transport, conn.generation, conn.ready, conn.err
+		if conn.ctx == nil {
+			err = tcp.ErrNotConnected
+		}
+		conn.lock.Unlock()
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if transport != nil {
+			return transport, generation, nil
+		}
+
+		// Not connected and not reconnecting
+		if ready == nil {
+			return nil, 0, tcp.ErrNotConnected
+		}
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+}
+
+// The connection must be replaced after err (ctx and server errors don't break it).
+// A frame too large to be written isn't sent at all, a frame too large to be read is left in the stream.
+func brokenBy(ctx context.Context, err error, read bool) bool {
+	var transportErr *tcp.TransportError
+	if ctx.Err() != nil || errors.As(err, &transportErr) {
+		return false
+	}
+
+	return read || !errors.Is(err, tcp.ErrFrameTooLarge)
+}
+
+// Set the state and send the event
+func (conn *Reconnecting) setState(event StateEvent) {
+	conn.lock.Lock()
+	conn.state = event.State
+	conn.lock.Unlock()
+
+	if conn.OnState != nil {
+		conn.OnState(event)
+	}
+}
+
+// Current state
+func (conn *Reconnecting) State() State {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	return conn.state
+}
+
+// Write a frame, if the write fails it's written again after the reconnection
+func (conn *Reconnecting) WriteFrame(data []byte) error {
+	return conn.WriteFrameContext(context.Background(), data)
+}
+
+// Write a frame within ctx
+func (conn *Reconnecting) WriteFrameContext(ctx context.Context, data []byte) error {
+	for {
+		transport, generation, err := conn.current(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = transport.WriteFrameContext(ctx, data)
+		if err == nil || !brokenBy(ctx, err, false) {
+			return err
+		}
+
+		conn.reconnect(generation, err)
+	}
+}
+
+// Read a frame, a failed read waits for the reconnection
+func (conn *Reconnecting) ReadFrame() ([]byte, error) {
+	return conn.ReadFrameContext(context.Background())
+}
+
+// Read a frame within ctx
+func (conn *Reconnecting) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	for {
+		transport, generation, err := conn.current(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := transport.ReadFrameContext(ctx)
+		if err == nil || !brokenBy(ctx, err, true) {
+			return data, err
+		}
+
+		conn.reconnect(generation, err)
+	}
+}
+
+// Close the connection, reconnections are stopped
+func (conn *Reconnecting) Close() error {
+	conn.lock.Lock()
+	if conn.ctx == nil {
+		conn.lock.Unlock()
+		return tcp.ErrNotConnected
+	}
+
+	if conn.err == nil {
+		conn.err = net.ErrClosed
+	}
+	conn.cancel()
+
+	transport := conn.transport
+	conn.transport = nil
+	if conn.reconnecting {
+		conn.reconnecting = false
+		close(conn.ready)
+	}
+	conn.lock.Unlock()
+
+	conn.setState(StateEvent{State: StateDisconnected})
+
+	if transport != nil {
+		return transport.Close()
+	}
+	return nil
+}
@@ -0,0 +1,393 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/network/transport/tcp"
+)
+
+// In-memory transport, reads fail with the errors sent to fail
+type fakeTransport struct {
+	frames  chan []byte
+	fail    chan error
+	written chan []byte
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func fakeTransportNew() *fakeTransport {
+	return &fakeTransport{
+		frames:  make(chan []byte, 16),
+		fail:    make(chan error, 1),
+		written: make(chan []byte, 16),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (fake *fakeTransport) WriteFrameContext(ctx context.Context, data []byte) error {
+	if len(data) > tcp.MaxFrameSize {
+		return tcp.ErrFrameTooLarge
+	}
+
+	select {
+	case <-fake.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	fake.written <- data
+	return nil
+}
+
+func (fake *fakeTransport) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	select {
+	case data := <-fake.frames:
+		return data, nil
+	case err := <-fake.fail:
+		return nil, err
+	case <-fake.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (fake *fakeTransport) Close() error {
+	fake.once.Do(func() { close(fake.closed) })
+	return nil
+}
+
+// Dial function that fails the first failures attempts, then returns the transports in order
+type fakeDialer struct {
+	lock       sync.Mutex
+	failures   int
+	attempts   int
+	transports chan *fakeTransport
+}
+
+func (dialer *fakeDialer) dial(ctx context.Context) (Transport, error) {
+	dialer.lock.Lock()
+	dialer.attempts++
+	fail := dialer.attempts <= dialer.failures
+	dialer.lock.Unlock()
+
+	if fail {
+		return nil, errors.New("connection refused")
+	}
+
+	select {
+	case transport := <-dialer.transports:
+		return transport, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Events received by OnState
+type eventLog struct {
+	lock   sync.Mutex
+	events []StateEvent
+}
+
+func (log *eventLog) add(event StateEvent) {
+	log.lock.Lock()
+	log.events = append(log.events, event)
+	log.lock.Unlock()
+}
+
+func (log *eventLog) states() []State {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	states := make([]State, len(log.events))
+	for i, event := range log.events {
+		states[i] = event.State
+	}
+	return states
+}
+
+func equalStates(a, b []State) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2, Jitter: 0.2}
+
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 80 * time.Millisecond, 120 * time.Millisecond},
+		{2, 160 * time.Millisecond, 240 * time.Millisecond},
+		{3, 320 * time.Millisecond, 480 * time.Millisecond},
+		{4, 640 * time.Millisecond, 960 * time.Millisecond},
+		{5, 800 * time.Millisecond, time.Second},
+		{20, 800 * time.Millisecond, time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 50; i++ {
+			delay := backoff.delay(test.attempt)
+			if delay < test.min || delay > test.max {
+				t.Fatalf("attempt %d: delay %v not in [%v, %v]", test.attempt, delay, test.min, test.max)
+			}
+		}
+	}
+
+	// Capped delays are still jittered
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 50; i++ {
+		seen[backoff.delay(30)] = true
+	}
+	if len(seen) < 10 {
+		t.Fatalf("capped delays aren't jittered: %d different values", len(seen))
+	}
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	delay := Backoff{}.delay(1)
+	if delay < 400*time.Millisecond || delay > 600*time.Millisecond {
+		t.Fatalf("default first delay %v", delay)
+	}
+
+	delay = Backoff{}.delay(100)
+	if delay < 24*time.Second || delay > 30*time.Second {
+		t.Fatalf("default maximum delay %v", delay)
+	}
+}
+
+func TestReconnectingFailedConnect(t *testing.T) {
+	dialer := &fakeDialer{failures: 3}
+	conn := &Reconnecting{Dial: dialer.dial, Backoff: Backoff{Initial: time.Millisecond, MaxAttempts: 3}}
+
+	err := conn.Connect()
+	if err == nil {
+		t.Fatal("connect should fail")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.ReadFrame()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("read after a failed connect should fail")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("read after a failed connect blocks")
+	}
+
+	if err := conn.WriteFrame([]byte{1}); err == nil {
+		t.Fatal("write after a failed connect should fail")
+	}
+}
+
+func TestReconnectingNotConnected(t *testing.T) {
+	conn := new(Reconnecting)
+	if _, err := conn.ReadFrame(); err != tcp.ErrNotConnected {
+		t.Fatal(err)
+	}
+	if err := conn.WriteFrame([]byte{1}); err != tcp.ErrNotConnected {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnectingStates(t *testing.T) {
+	first, second := fakeTransportNew(), fakeTransportNew()
+	dialer := &fakeDialer{failures: 2, transports: make(chan *fakeTransport, 2)}
+	dialer.transports <- first
+	dialer.transports <- second
+
+	var log eventLog
+	conn := &Reconnecting{
+		Dial:    dialer.dial,
+		Backoff: Backoff{Initial: time.Millisecond},
+		Resend:  func() [][]byte { return [][]byte{[]byte("pending")} },
+		OnState: log.add,
+	}
+
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []State{StateConnecting, StateBackingOff, StateConnecting, StateBackingOff, StateConnecting, StateConnected}
+	if got := log.states(); !equalStates(got, want) {
+		t.Fatalf("states %v, expected %v", got, want)
+	}
+	if conn.State() != StateConnected {
+		t.Fatal(conn.State())
+	}
+
+	// The connection drops, the frames come from the new transport
+	first.fail <- errors.New("connection reset")
+	second.frames <- []byte("after reconnection")
+
+	data, err := conn.ReadFrame()
+	if err != nil || string(data) != "after reconnection" {
+		t.Fatal(data, err)
+	}
+
+	if pending := <-second.written; string(pending) != "pending" {
+		t.Fatalf("resent %q", pending)
+	}
+
+	want = append(want, StateDisconnected, StateConnecting, StateConnected)
+	if got := log.states(); !equalStates(got, want) {
+		t.Fatalf("states %v, expected %v", got, want)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ReadFrame(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnectingErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		read      bool
+		err       error
+		reconnect bool
+	}{
+		{"read failure", true, errors.New("connection reset"), true},
+		{"read frame too large", true, tcp.ErrFrameTooLarge, true},
+		{"crc error", true, &tcp.CRCError{Expected: 1, Received: 2}, true},
+		{"auth key not found", true, tcp.ErrAuthKeyNotFound, false},
+		{"flood", true, tcp.ErrTransportFlood, false},
+		{"write frame too large", false, tcp.ErrFrameTooLarge, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first, second := fakeTransportNew(), fakeTransportNew()
+			dialer := &fakeDialer{transports: make(chan *fakeTransport, 2)}
+			dialer.transports <- first
+			dialer.transports <- second
+
+			conn := &Reconnecting{Dial: dialer.dial, Backoff: Backoff{Initial: time.Millisecond}}
+			if err := conn.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			var err error
+			if test.read {
+				first.fail <- test.err
+				second.frames <- []byte("second")
+				var data []byte
+				data, err = conn.ReadFrame()
+				if test.reconnect && (err != nil || string(data) != "second") {
+					t.Fatal(data, err)
+				}
+			} else {
+				err = conn.WriteFrame(make([]byte, tcp.MaxFrameSize+1))
+			}
+
+			if !test.reconnect && !errors.Is(err, test.err) {
+				t.Fatalf("error %v, expected %v", err, test.err)
+			}
+
+			dialer.lock.Lock()
+			attempts := dialer.attempts
+			dialer.lock.Unlock()
+			if reconnected := attempts == 2; reconnected != test.reconnect {
+				t.Fatalf("reconnected: %v, expected %v", reconnected, test.reconnect)
+			}
+		})
+	}
+}
+
+func TestReconnectingWriteRetried(t *testing.T) {
+	first, second := fakeTransportNew(), fakeTransportNew()
+	dialer := &fakeDialer{transports: make(chan *fakeTransport, 2)}
+	dialer.transports <- first
+	dialer.transports <- second
+
+	conn := &Reconnecting{Dial: dialer.dial, Backoff: Backoff{Initial: time.Millisecond}}
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	first.Close()
+	if err := conn.WriteFrame([]byte("message")); err != nil {
+		t.Fatal(err)
+	}
+
+	if data := <-second.written; string(data) != "message" {
+		t.Fatalf("written %q", data)
+	}
+}
+
+func TestReconnectingGiveUp(t *testing.T) {
+	first := fakeTransportNew()
+	dialer := &fakeDialer{transports: make(chan *fakeTransport, 1)}
+	dialer.transports <- first
+
+	var log eventLog
+	conn := &Reconnecting{Dial: dialer.dial, Backoff: Backoff{Initial: time.Millisecond, MaxAttempts: 2}, OnState: log.add}
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every reconnection attempt fails
+	dialer.lock.Lock()
+	dialer.failures = 100
+	dialer.lock.Unlock()
+
+	first.fail <- errors.New("connection reset")
+	if _, err := conn.ReadFrame(); err == nil || err.Error() != "connection refused" {
+		t.Fatal(err)
+	}
+
+	states := log.states()
+	if states[len(states)-1] != StateDisconnected {
+		t.Fatalf("last state %v", states[len(states)-1])
+	}
+}
+
+func TestReconnectingConnectCancelled(t *testing.T) {
+	dialer := &fakeDialer{failures: 100}
+	conn := &Reconnecting{Dial: dialer.dial, Backoff: Backoff{Initial: time.Second}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := conn.ConnectContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
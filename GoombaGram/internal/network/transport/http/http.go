@@ -0,0 +1,473 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// https://core.telegram.org/mtproto#http-transport
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/network/transport/tcp"
+	"io"
+	"net"
+	nethttp "net/http"
+	"sync"
+	"time"
+)
+
+// Attempts of a POST before the error is returned by ReadFrame
+const maxAttempts = 4
+
+// Delay before the first retry, doubled at every attempt
+const retryDelay = 250 * time.Millisecond
+
+// HTTP
+//
+// MTProto over HTTP POST requests to /api, the last resort when only HTTP (proxies) can be used.
+// Every POST carries one MTProto packet and its response body, if not empty, is a packet from the server.
+// The server can push messages only as the answer to a pending request: an http_wait message keeps a
+// request open (long polling). Both message containers and http_wait belong to the MTProto session,
+// so they're created by the Batch and LongPoll callbacks.
+type HTTP struct {
+	URL      string          // POST URL (empty for http://<address>/api)
+	Header   nethttp.Header  // extra request headers
+	Client   *nethttp.Client // HTTP client (nil for a client that uses Dialer and the environment proxy)
+	Dialer   tcp.Dialer      // dialer of the default client (nil for a direct connection)
+	Timeouts tcp.Timeouts    // dial timeout, Connect timeout and idle timeout of a request (long polling excluded)
+
+	// Merge the frames queued by WriteFrame in the body of a POST (msg_container).
+	// If nil, every frame is sent with its own POST.
+	Batch func(frames [][]byte) ([]byte, error)
+
+	// Packet with http_wait sent when no other request is pending, its answer contains the updates.
+	// If nil, the server can answer only to WriteFrame requests.
+	LongPoll func() ([]byte, error)
+
+	url      string
+	client   *nethttp.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	lock     sync.Mutex
+	queue    [][]byte      // frames waiting for a POST
+	wake     chan struct{} // new frames, or a request has finished
+	received chan []byte   // response bodies
+	failed   chan error    // error that stopped the transport
+	polling  bool          // a long polling request is pending
+	pending  int           // pending requests
+	group    sync.WaitGroup
+}
+
+// HTTP transport, obfuscation isn't available
+func (h *HTTP) Connect(address string, obfuscation bool) error {
+	return h.ConnectContext(context.Background(), address, obfuscation)
+}
+
+// Check that the server answers and start sending requests (ctx is only used by Connect)
+func (h *HTTP) ConnectContext(ctx context.Context, address string, obfuscation bool) error {
+	if obfuscation {
+		return errors.New("http: obfuscation isn't available")
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	h.url = h.URL
+	if h.url == "" {
+		if address == "" {
+			return errors.New("http: address is missing")
+		}
+		h.url = "http://" + address + "/api"
+	}
+
+	h.client = h.Client
+	if h.client == nil {
+		h.client = h.defaultClient()
+	}
+
+	err := h.probe(ctx)
+	if err != nil {
+		h.client.CloseIdleConnections()
+		return err
+	}
+
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	h.queue = nil
+	h.wake = make(chan struct{}, 1)
+	h.received = make(chan []byte, 64)
+	h.failed = make(chan error, 1)
+	h.polling = false
+	h.pending = 0
+
+	h.group.Add(1)
+	go h.loop()
+
+	return nil
+}
+
+// Client with Dialer, dial timeout and the proxy from the environment (HTTP_PROXY)
+func (h *HTTP) defaultClient() *nethttp.Client {
+	var dialer tcp.Dialer = new(net.Dialer)
+	if h.Dialer != nil {
+		dialer = h.Dialer
+	}
+
+	dialTimeout := h.Timeouts.Dial
+	return &nethttp.Client{
+		Transport: &nethttp.Transport{
+			Proxy: nethttp.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				if dialTimeout > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, dialTimeout)
+					defer cancel()
+				}
+				return dialer.DialContext(ctx, network, address)
+			},
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// HEAD request to the URL within ctx and the handshake timeout, the connection is kept for the next requests
+func (h *HTTP) probe(ctx context.Context) error {
+	if h.Timeouts.Handshake > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeouts.Handshake)
+		defer cancel()
+	}
+
+	request, err := h.request(ctx, nethttp.MethodHead, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := h.client.Do(request)
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+
+	// Any answer of the server is fine (it doesn't need to support HEAD), but not the gateway errors of a proxy
+	switch response.StatusCode {
+	case nethttp.StatusBadGateway, nethttp.StatusServiceUnavailable, nethttp.StatusGatewayTimeout:
+		return errors.New("http: " + response.Status)
+	}
+
+	return nil
+}
+
+// Request to the URL with the extra headers
+func (h *HTTP) request(ctx context.Context, method string, body []byte) (*nethttp.Request, error) {
+	request, err := nethttp.NewRequestWithContext(ctx, method, h.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range h.Header {
+		for _, value := range values {
+			request.Header.Add(name, value)
+		}
+	}
+
+	return request, nil
+}
+
+// Wake the loop
+func (h *HTTP) signal() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Send queued frames and keep a long polling request open
+func (h *HTTP) loop() {
+	defer h.group.Done()
+
+	for {
+		h.lock.Lock()
+		frames := h.queue
+		h.queue = nil
+		startPoll := h.LongPoll != nil && !h.polling && h.pending == 0 && len(frames) == 0
+		if startPoll {
+			h.polling = true
+		}
+		h.lock.Unlock()
+
+		if len(frames) > 0 {
+			err := h.sendFrames(frames)
+			if err != nil {
+				h.fail(err)
+				return
+			}
+		}
+
+		if startPoll {
+			body, err := h.LongPoll()
+			if err != nil {
+				h.fail(err)
+				return
+			}
+			h.post(body, true)
+		}
+
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-h.wake:
+		}
+	}
+}
+
+// POST the frames, merged by Batch if available
+func (h *HTTP) sendFrames(frames [][]byte) error {
+	if h.Batch == nil {
+		for _, frame := range frames {
+			h.post(frame, false)
+		}
+		return nil
+	}
+
+	body, err := h.Batch(frames)
+	if err != nil {
+		return err
+	}
+
+	h.post(body, false)
+	return nil
+}
+
+// Send a request in the background
+func (h *HTTP) post(body []byte, poll bool) {
+	h.lock.Lock()
+	h.pending++
+	h.lock.Unlock()
+
+	h.group.Add(1)
+	go func() {
+		defer h.group.Done()
+
+		response, err := h.postRetry(body, poll)
+
+		h.lock.Lock()
+		h.pending--
+		if poll {
+			h.polling = false
+		}
+		h.lock.Unlock()
+
+		if err != nil {
+			// Requests cancelled by Close aren't errors
+			if h.ctx.Err() == nil {
+				h.fail(err)
+			}
+			return
+		}
+
+		if len(response) > 0 {
+			select {
+			case h.received <- response:
+			case <-h.ctx.Done():
+				return
+			}
+		}
+
+		h.signal()
+	}()
+}
+
+// POST with retries, connections are opened again after a network error
+func (h *HTTP) postRetry(body []byte, poll bool) ([]byte, error) {
+	var err error
+	delay := retryDelay
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(delay):
+			case <-h.ctx.Done():
+				return nil, h.ctx.Err()
+			}
+			delay *= 2
+		}
+
+		var response []byte
+		var retry bool
+		response, retry, err = h.postOnce(body, poll)
+		if err == nil || !retry || h.ctx.Err() != nil {
+			return response, err
+		}
+
+		h.client.CloseIdleConnections()
+	}
+
+	return nil, err
+}
+
+// Send a POST request, it returns the response body and if the error is temporary
+func (h *HTTP) postOnce(body []byte, poll bool) ([]byte, bool, error) {
+	ctx := h.ctx
+	if !poll && h.Timeouts.Idle > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeouts.Idle)
+		defer cancel()
+	}
+
+	request, err := h.request(ctx, nethttp.MethodPost, body)
+	if err != nil {
+		return nil, false, err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+
+	response, err := h.client.Do(request)
+	if err != nil {
+		return nil, true, err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, tcp.MaxFrameSize+1))
+	if err != nil {
+		return nil, true, err
+	}
+
+	// Transport error in the body (-404, -429...), or only in the status code
+	transportErr := tcp.ParseTransportError(data)
+
+	switch {
+	case response.StatusCode == nethttp.StatusNotFound && transportErr == nil:
+		transportErr = tcp.ErrAuthKeyNotFound
+	case response.StatusCode == nethttp.StatusTooManyRequests && transportErr == nil:
+		transportErr = tcp.ErrTransportFlood
+	}
+
+	if response.StatusCode != nethttp.StatusOK {
+		// Server errors and flood limits are temporary
+		retry := response.StatusCode >= 500 || response.StatusCode == nethttp.StatusTooManyRequests
+		if transportErr != nil {
+			return nil, retry, transportErr
+		}
+		return nil, retry, errors.New("http: " + response.Status)
+	}
+
+	if transportErr != nil {
+		return nil, false, transportErr
+	}
+
+	if len(data) > tcp.MaxFrameSize {
+		return nil, false, tcp.ErrFrameTooLarge
+	}
+
+	return data, false, nil
+}
+
+// Stop the transport, the error is returned by ReadFrame
+func (h *HTTP) fail(err error) {
+	select {
+	case h.failed <- err:
+	default:
+	}
+	h.cancel()
+}
+
+// Queue a frame, it's sent by a POST as soon as possible
+func (h *HTTP) WriteFrame(data []byte) error {
+	return h.WriteFrameContext(context.Background(), data)
+}
+
+// Queue a frame (sending is asynchronous, ctx is only checked)
+func (h *HTTP) WriteFrameContext(ctx context.Context, data []byte) error {
+	if h.ctx == nil {
+		return tcp.ErrNotConnected
+	}
+
+	if len(data) > tcp.MaxFrameSize {
+		return tcp.ErrFrameTooLarge
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if h.ctx.Err() != nil {
+		return h.closedError()
+	}
+
+	frame := make([]byte, len(data))
+	copy(frame, data)
+
+	h.lock.Lock()
+	h.queue = append(h.queue, frame)
+	h.lock.Unlock()
+
+	h.signal()
+	return nil
+}
+
+// Read the body of a response
+func (h *HTTP) ReadFrame() ([]byte, error) {
+	return h.ReadFrameContext(context.Background())
+}
+
+// Read the body of a response within ctx
+func (h *HTTP) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	if h.ctx == nil {
+		return nil, tcp.ErrNotConnected
+	}
+
+	// Bodies already received come first
+	select {
+	case data := <-h.received:
+		return data, nil
+	default:
+	}
+
+	select {
+	case data := <-h.received:
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-h.ctx.Done():
+		return nil, h.closedError()
+	}
+}
+
+// Error that stopped the transport
+func (h *HTTP) closedError() error {
+	select {
+	case err := <-h.failed:
+		// Keep it for the next calls
+		h.failed <- err
+		return err
+	default:
+		return net.ErrClosed
+	}
+}
+
+// Stop the requests
+func (h *HTTP) Close() error {
+	if h.ctx == nil {
+		return tcp.ErrNotConnected
+	}
+
+	h.cancel()
+	h.group.Wait()
+	h.client.CloseIdleConnections()
+
+	return nil
+}
@@ -0,0 +1,357 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/network/transport/tcp"
+)
+
+// Server that answers every POST with "echo:" and the body
+func echoHandler(w nethttp.ResponseWriter, r *nethttp.Request) {
+	if r.Method != nethttp.MethodPost {
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	_, _ = w.Write(append([]byte("echo:"), body...))
+}
+
+// Connect to the httptest server
+func connect(t *testing.T, h *HTTP, server *httptest.Server) {
+	t.Helper()
+
+	err := h.Connect(server.Listener.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+}
+
+func readString(t *testing.T, h *HTTP) string {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, err := h.ReadFrameContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestConnect(t *testing.T) {
+	var heads int32
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.Method == nethttp.MethodHead {
+			atomic.AddInt32(&heads, 1)
+		}
+		// Telegram servers don't support HEAD
+		w.WriteHeader(nethttp.StatusNotFound)
+	}))
+	defer server.Close()
+
+	h := new(HTTP)
+	connect(t, h, server)
+	if atomic.LoadInt32(&heads) != 1 {
+		t.Fatalf("%d HEAD requests", heads)
+	}
+
+	// Nobody listening
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := ln.Addr().String()
+	_ = ln.Close()
+	if err := new(HTTP).Connect(address, false); err == nil {
+		t.Fatal("connected to a closed port")
+	}
+
+	// Gateway error of a proxy
+	gateway := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.WriteHeader(nethttp.StatusBadGateway)
+	}))
+	defer gateway.Close()
+	if err := (&HTTP{URL: gateway.URL + "/api"}).Connect("", false); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatal(err)
+	}
+
+	if err := new(HTTP).Connect(server.Listener.Addr().String(), true); err == nil {
+		t.Fatal("obfuscation accepted")
+	}
+	if err := new(HTTP).Connect("", false); err == nil {
+		t.Fatal("address is missing")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := new(HTTP).ConnectContext(ctx, server.Listener.Addr().String(), false); !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// Server that never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+
+	start := time.Now()
+	h := &HTTP{Timeouts: tcp.Timeouts{Handshake: 50 * time.Millisecond}}
+	if err := h.Connect(ln.Addr().String(), false); err == nil || time.Since(start) > time.Second {
+		t.Fatal(err, time.Since(start))
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var headers int32
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.URL.Path != "/api" {
+			w.WriteHeader(nethttp.StatusTeapot)
+			return
+		}
+		if r.Header.Get("X-Test") == "yes" && r.Method == nethttp.MethodPost {
+			atomic.AddInt32(&headers, 1)
+		}
+		echoHandler(w, r)
+	}))
+	defer server.Close()
+
+	h := &HTTP{Header: nethttp.Header{"X-Test": {"yes"}}}
+	connect(t, h, server)
+
+	for _, frame := range []string{"first", "second"} {
+		if err := h.WriteFrame([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		if got := readString(t, h); got != "echo:"+frame {
+			t.Fatal(got)
+		}
+	}
+
+	if atomic.LoadInt32(&headers) != 2 {
+		t.Fatalf("header sent %d times", headers)
+	}
+
+	if err := h.WriteFrame(make([]byte, tcp.MaxFrameSize+1)); err != tcp.ErrFrameTooLarge {
+		t.Fatal(err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		body, _ := io.ReadAll(r.Body)
+		// The first request waits, so the next frames are queued together
+		if string(body) == "a" {
+			<-release
+		}
+		_, _ = w.Write(append([]byte("echo:"), body...))
+	}))
+	defer server.Close()
+
+	h := &HTTP{Batch: func(frames [][]byte) ([]byte, error) { return bytes.Join(frames, []byte("|")), nil }}
+	connect(t, h, server)
+
+	_ = h.WriteFrame([]byte("a"))
+	time.Sleep(50 * time.Millisecond)
+	_ = h.WriteFrame([]byte("b"))
+	_ = h.WriteFrame([]byte("c"))
+
+	// b and c are merged in one POST
+	if got := readString(t, h); got != "echo:b|c" {
+		t.Fatal(got)
+	}
+	close(release)
+	if got := readString(t, h); got != "echo:a" {
+		t.Fatal(got)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	updates := make(chan string, 1)
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "http_wait" {
+			_, _ = w.Write(append([]byte("echo:"), body...))
+			return
+		}
+
+		select {
+		case update := <-updates:
+			_, _ = w.Write([]byte(update))
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	h := &HTTP{LongPoll: func() ([]byte, error) { return []byte("http_wait"), nil }}
+	connect(t, h, server)
+
+	// The server pushes an update without a request of the client
+	updates <- "update"
+	if got := readString(t, h); got != "update" {
+		t.Fatal(got)
+	}
+
+	_ = h.WriteFrame([]byte("request"))
+	if got := readString(t, h); got != "echo:request" {
+		t.Fatal(got)
+	}
+
+	// Empty long polling answers start a new long polling request
+	time.Sleep(250 * time.Millisecond)
+	updates <- "later"
+	if got := readString(t, h); got != "later" {
+		t.Fatal(got)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var failures int32 = 2
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.Method == nethttp.MethodPost && atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(nethttp.StatusInternalServerError)
+			return
+		}
+		echoHandler(w, r)
+	}))
+	defer server.Close()
+
+	h := new(HTTP)
+	connect(t, h, server)
+
+	// Temporary errors are retried
+	_ = h.WriteFrame([]byte("retried"))
+	if got := readString(t, h); got != "echo:retried" {
+		t.Fatal(got)
+	}
+}
+
+func TestRetryGiveUp(t *testing.T) {
+	var posts int32
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.Method == nethttp.MethodPost {
+			atomic.AddInt32(&posts, 1)
+			w.WriteHeader(nethttp.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	h := new(HTTP)
+	connect(t, h, server)
+
+	_ = h.WriteFrame([]byte("lost"))
+	_, err := h.ReadFrame()
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&posts) != maxAttempts {
+		t.Fatalf("%d attempts", posts)
+	}
+
+	// The error is kept
+	if err := h.WriteFrame([]byte("after")); err == nil {
+		t.Fatal("write after a fatal error")
+	}
+}
+
+func TestTransportErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   []byte
+		want   error
+	}{
+		{"404 status", nethttp.StatusNotFound, nil, tcp.ErrAuthKeyNotFound},
+		{"-404 body", nethttp.StatusNotFound, []byte{0x6C, 0xFE, 0xFF, 0xFF}, tcp.ErrAuthKeyNotFound},
+		{"-429 body", nethttp.StatusOK, []byte{0x53, 0xFE, 0xFF, 0xFF}, tcp.ErrTransportFlood},
+		{"-444 body", nethttp.StatusNotFound, []byte{0x44, 0xFE, 0xFF, 0xFF}, tcp.ErrInvalidDC},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				if r.Method == nethttp.MethodPost {
+					w.WriteHeader(test.status)
+					_, _ = w.Write(test.body)
+				}
+			}))
+			defer server.Close()
+
+			h := new(HTTP)
+			connect(t, h, server)
+
+			_ = h.WriteFrame([]byte("message"))
+			if _, err := h.ReadFrame(); !errors.Is(err, test.want) {
+				t.Fatalf("%v, expected %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	server := httptest.NewServer(nethttp.HandlerFunc(echoHandler))
+	defer server.Close()
+
+	h := new(HTTP)
+	if _, err := h.ReadFrame(); err != tcp.ErrNotConnected {
+		t.Fatal(err)
+	}
+
+	if err := h.Connect(server.Listener.Addr().String(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.ReadFrame()
+		done <- err
+	}()
+
+	_ = h.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadFrame blocked after Close")
+	}
+}
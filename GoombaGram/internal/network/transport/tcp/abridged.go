@@ -17,7 +17,9 @@
 package tcp
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto/aes"
 )
 
@@ -29,46 +31,71 @@ import (
 // Minimum envelope length: 1 byte
 // Maximum envelope length: 4 bytes
 type Abridged struct{
-	*tcpConnection                  // TCP connection (even with a proxy)
+	*tcpConnection                  // connection (TCP, proxy or any net.Conn)
 	encrypt, decrypt *aes.AES256CTR // AES-256 CTR encrypt/decrypt (only with obfuscation true)
+	Dialer           Dialer         // dialer of the connection (nil for a direct TCP connection)
+	Timeouts         Timeouts       // dial, handshake and idle timeouts (zero for none)
+	QuickAck         func(uint32)   // called with the quick ACK tokens received from the server (optional)
 }
 
 // Abridged TCP transport (or obfuscated)
 func (abr *Abridged) Connect(address string, obfuscation bool) error {
-	abr.tcpConnection = tcpNew()
+	return abr.ConnectContext(context.Background(), address, obfuscation)
+}
+
+// Connect within ctx and the dial and handshake timeouts
+func (abr *Abridged) ConnectContext(ctx context.Context, address string, obfuscation bool) error {
+	abr.tcpConnection = tcpNew(abr.Dialer, abr.Timeouts)
 
-	err := abr.tcpConnection.connect(address)
+	err := abr.tcpConnection.connect(ctx, address)
 	if err != nil {
 		return err
 	}
 
-	if obfuscation {
-		nonce, reversedNonce := obfuscationCTRGenerator(0xEF)
-
-		abr.encrypt = aes.AES256CTRNew(nonce[8:40], nonce[40:56])
-		abr.decrypt = aes.AES256CTRNew(reversedNonce[8:40], reversedNonce[40:56])
-
-		// Add aes encrypted to nonce
-		aesNonce := make([]byte, 64); copy(aesNonce, nonce)
-		abr.encrypt.EncryptDecrypt(aesNonce)
+	return abr.tcpConnection.handshake(ctx, func() error {
+		if obfuscation {
+			var err error
+			abr.encrypt, abr.decrypt, err = abr.tcpConnection.obfuscate(0xEF, nil, 0)
+			return err
+		}
 
-		// Send encrypted nonce to server (when connect)
-		err = abr.tcpConnection.sendAll(append(nonce[:56], aesNonce[56:64]...))
-	} else {
 		// Telegram docs:
 		// Before sending anything into the underlying socket (see transports), the client must first send 0xef as the first byte (the server will not send 0xef as the first byte in the first reply).
-		err = abr.tcpConnection.sendAll([]byte{0xEF})
+		return abr.tcpConnection.sendAll([]byte{0xEF})
+	})
+}
+
+// Abridged TCP transport through an MTProxy (only plain secrets)
+// dcID is the destination DC (negative for media DCs)
+func (abr *Abridged) ConnectProxy(proxy *MTProxy, dcID int16) error {
+	return abr.ConnectProxyContext(context.Background(), proxy, dcID)
+}
+
+// Connect through an MTProxy within ctx and the dial and handshake timeouts
+func (abr *Abridged) ConnectProxyContext(ctx context.Context, proxy *MTProxy, dcID int16) error {
+	if proxy.ForcePadding() {
+		return errors.New("this proxy secret requires the PaddedIntermediate transport")
 	}
 
-	// Check for errors
+	abr.tcpConnection = tcpNew(abr.Dialer, abr.Timeouts)
+
+	err := abr.tcpConnection.connect(ctx, proxy.Address())
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return abr.tcpConnection.handshake(ctx, func() error {
+		err := abr.tcpConnection.proxyHandshake(proxy)
+		if err != nil {
+			return err
+		}
+
+		abr.encrypt, abr.decrypt, err = abr.tcpConnection.obfuscate(0xEF, proxy.Secret, dcID)
+		return err
+	})
 }
 
-// Send data to Telegram server using Abridged TCP
+// Write a frame using Abridged TCP
 //
 // +-+----...----+
 // |l|  payload  |
@@ -77,7 +104,35 @@ func (abr *Abridged) Connect(address string, obfuscation bool) error {
 // +-+---+----...----+
 // |h|len|  payload  +
 // +-+---+----...----+
-func (abr *Abridged) Send(data []byte) error {
+func (abr *Abridged) WriteFrame(data []byte) error {
+	return abr.WriteFrameContext(context.Background(), data)
+}
+
+// Write a frame within ctx and the idle timeout
+func (abr *Abridged) WriteFrameContext(ctx context.Context, data []byte) error {
+	if abr.tcpConnection == nil {
+		return ErrNotConnected
+	}
+
+	return abr.tcpConnection.writeFrameContext(ctx, data, func() error {
+		return abr.writeFrame(data, false)
+	})
+}
+
+// Write a frame and request a quick ACK, the server token is passed to QuickAck
+func (abr *Abridged) WriteFrameQuickAck(ctx context.Context, data []byte) error {
+	if abr.tcpConnection == nil {
+		return ErrNotConnected
+	}
+
+	return abr.tcpConnection.writeFrameContext(ctx, data, func() error {
+		return abr.writeFrame(data, true)
+	})
+}
+
+// Encode, encrypt and send a frame
+// quickAck sets the most significant bit of the first byte
+func (abr *Abridged) writeFrame(data []byte, quickAck bool) error {
 	length := uint32(len(data)/4)
 	if length >= 127 {
 		// Parse length to 3 bytes slice
@@ -96,6 +151,10 @@ func (abr *Abridged) Send(data []byte) error {
 		data = append([]byte{byte(length)}, data...)
 	}
 
+	if quickAck {
+		data[0] |= 0x80
+	}
+
 	// If is obfuscated, encrypt the data
 	if abr.encrypt != nil {
 		abr.encrypt.EncryptDecrypt(data)
@@ -110,7 +169,7 @@ func (abr *Abridged) Send(data []byte) error {
 	return nil
 }
 
-// Receive n data to Telegram server using Abridged TCP
+// Read a frame using Abridged TCP
 //
 // +-+----...----+
 // |l|  payload  |
@@ -119,20 +178,72 @@ func (abr *Abridged) Send(data []byte) error {
 // +-+---+----...----+
 // |h|len|  payload  +
 // +-+---+----...----+
-func (abr *Abridged) Receive(data []byte) error {
+func (abr *Abridged) ReadFrame() ([]byte, error) {
+	return abr.ReadFrameContext(context.Background())
+}
+
+// Read a frame within ctx and the idle timeout
+func (abr *Abridged) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	if abr.tcpConnection == nil {
+		return nil, ErrNotConnected
+	}
+
+	data, _, err := abr.tcpConnection.readFrameContext(ctx, abr.readFrame, abr.QuickAck)
+	return data, err
+}
+
+// Read a frame received by the server, quickAck is true if the client has requested a quick ACK
+func (abr *Abridged) readFrameQuickAck(ctx context.Context) ([]byte, bool, error) {
+	return abr.tcpConnection.readFrameContext(ctx, abr.readFrame, nil)
+}
+
+// Send a quick ACK token to the client (4 bytes, big endian)
+func (abr *Abridged) writeQuickAck(ctx context.Context, token uint32) error {
+	return abr.tcpConnection.writeFrameContext(ctx, nil, func() error {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, token|0x80000000)
+
+		if abr.encrypt != nil {
+			abr.encrypt.EncryptDecrypt(data)
+		}
+
+		return abr.tcpConnection.sendAll(data)
+	})
+}
+
+// Receive, decrypt and decode a frame
+// The most significant bit of the first byte is a quick ACK request (server) or a quick ACK token (client)
+func (abr *Abridged) readFrame() ([]byte, bool, error) {
 	length, err := abr.tcpConnection.receiveAll(1)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
 	if abr.decrypt != nil {
 		abr.decrypt.EncryptDecrypt(length)
 	}
 
+	quickAck := length[0] & 0x80 != 0
+	length[0] &= 0x7F
+
+	// Quick ACK token: 4 bytes, big endian
+	if quickAck && !abr.tcpConnection.server {
+		token, err := abr.tcpConnection.receiveAll(3)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if abr.decrypt != nil {
+			abr.decrypt.EncryptDecrypt(token)
+		}
+
+		return append([]byte{length[0] | 0x80}, token...), true, nil
+	}
+
 	if length[0] == 0x7F {
 		length, err = abr.tcpConnection.receiveAll(3)
 		if err != nil {
-			return err
+			return nil, false, err
 		}
 
 		if abr.decrypt != nil {
@@ -140,19 +251,22 @@ func (abr *Abridged) Receive(data []byte) error {
 		}
 	}
 
-	// Set slice length to 4
+	// Set slice length to 4 (little endian, zeros are the high bytes)
 	if len(length) < 4 {
-		l := make([]byte, 4 - len(length))
-		length = append(l, length...)
+		length = append(length, make([]byte, 4 - len(length))...)
 	}
 
 	// Get length of data as int
 	lenInt := int(binary.LittleEndian.Uint32(length) * 4)
 
+	if lenInt > MaxFrameSize {
+		return nil, false, ErrFrameTooLarge
+	}
+
 	// Get n bytes
-	data, err = abr.tcpConnection.receiveAll(lenInt)
+	data, err := abr.tcpConnection.receiveAll(lenInt)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
 	// Decrypt data if obfuscation is enabled
@@ -160,5 +274,5 @@ func (abr *Abridged) Receive(data []byte) error {
 		abr.decrypt.EncryptDecrypt(data)
 	}
 
-	return nil
+	return data, quickAck, nil
 }
\ No newline at end of file
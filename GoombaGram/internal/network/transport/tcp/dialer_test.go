@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// Dialer that records the dialed address and returns a net.Pipe
+type recordDialer struct {
+	pipeDialer
+	network, address chan string
+}
+
+func (dialer recordDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer.network <- network
+	dialer.address <- address
+	return dialer.pipeDialer.DialContext(ctx, network, address)
+}
+
+// Dialer that connects to a Unix socket whatever the address is
+type unixDialer struct {
+	path string
+}
+
+func (dialer unixDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	return new(net.Dialer).DialContext(ctx, "unix", dialer.path)
+}
+
+type failDialer struct {
+	err error
+}
+
+func (dialer failDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	return nil, dialer.err
+}
+
+// Round trip between a client and the connection accepted by ln
+func listenerRoundTrip(t *testing.T, ln *Listener, client testTransport, address, framing string, obfuscation bool) {
+	t.Helper()
+
+	want := bytes.Repeat([]byte{1, 2, 3, 4}, 300)
+	done := make(chan error, 1)
+	go func() {
+		err := client.ConnectContext(context.Background(), address, obfuscation)
+		if err == nil {
+			err = client.WriteFrame(want)
+		}
+		done <- err
+	}()
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer client.Close()
+
+	if err := <-done; err != nil {
+		t.Fatalf("%s obfuscated=%v: %v", framing, obfuscation, err)
+	}
+
+	protocols := map[string]byte{"abridged": 0xEF, "intermediate": 0xEE, "paddedIntermediate": 0xDD, "full": 0x00}
+	if server.Protocol() != protocols[framing] || server.Obfuscated() != obfuscation {
+		t.Fatalf("%s obfuscated=%v: protocol %#x obfuscated=%v detected", framing, obfuscation, server.Protocol(), server.Obfuscated())
+	}
+
+	got, err := server.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFrame(t, framing, got, want)
+
+	if err := server.WriteFrame(want[:8]); err != nil {
+		t.Fatal(err)
+	}
+	got, err = client.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFrame(t, framing, got, want[:8])
+}
+
+func TestDefaultDialer(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for _, framing := range testFramings {
+		for _, obfuscation := range []bool{false, true} {
+			if framing == "full" && obfuscation {
+				continue
+			}
+			listenerRoundTrip(t, ln, testTransportNew(framing, nil), ln.Addr().String(), framing, obfuscation)
+		}
+	}
+}
+
+func TestUnixDialer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transport.sock")
+	unixListener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	ln := ListenerNew(unixListener, nil)
+	defer ln.Close()
+
+	for _, framing := range testFramings {
+		listenerRoundTrip(t, ln, testTransportNew(framing, unixDialer{path}), "149.154.167.50:443", framing, framing != "full")
+	}
+}
+
+func TestDialerAddress(t *testing.T) {
+	dialer := recordDialer{pipeDialerNew(), make(chan string, 1), make(chan string, 1)}
+	client := &Abridged{Dialer: dialer}
+
+	go func() {
+		server, err := ServerConnectionNew(<-dialer.servers, nil)
+		if err == nil {
+			_ = server.Close()
+		}
+	}()
+
+	if err := client.Connect("149.154.167.50:443", true); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if network, address := <-dialer.network, <-dialer.address; network != "tcp" || address != "149.154.167.50:443" {
+		t.Fatalf("dialed %s %s", network, address)
+	}
+}
+
+func TestDialerError(t *testing.T) {
+	dialErr := errors.New("network is unreachable")
+
+	for _, framing := range testFramings {
+		client := testTransportNew(framing, failDialer{dialErr})
+		if err := client.ConnectContext(context.Background(), "149.154.167.50:443", false); !errors.Is(err, dialErr) {
+			t.Fatalf("%s: %v", framing, err)
+		}
+	}
+}
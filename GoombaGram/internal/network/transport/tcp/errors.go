@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Shortest MTProto message (auth_key_id, message_id and length of an unencrypted message),
+// shorter frames that start with a negative int32 are transport errors
+const minMessageSize = 20
+
+// Transport error, sent by the server instead of a frame payload (negative int32, little endian)
+// https://core.telegram.org/mtproto/mtproto-transports#transport-errors
+type TransportError struct {
+	Code int32
+}
+
+var (
+	ErrAuthKeyNotFound = &TransportError{-404} // auth key not found (or not yet synchronized between DCs)
+	ErrTransportFlood  = &TransportError{-429} // too many connections from the same IP or too many requests
+	ErrInvalidDC       = &TransportError{-444} // invalid DC (wrong DC id in the obfuscation init)
+)
+
+func (err *TransportError) Error() string {
+	switch err.Code {
+	case -404:
+		return "transport error -404: auth key not found"
+	case -429:
+		return "transport error -429: flood"
+	case -444:
+		return "transport error -444: invalid DC"
+	}
+
+	return fmt.Sprintf("transport error %d", err.Code)
+}
+
+// Transport errors with the same code are equal (errors.Is)
+func (err *TransportError) Is(target error) bool {
+	transportErr, ok := target.(*TransportError)
+	return ok && transportErr.Code == err.Code
+}
+
+// Return the transport error sent in frame, or nil if it's a payload
+func ParseTransportError(frame []byte) error {
+	if len(frame) < 4 || len(frame) >= minMessageSize {
+		return nil
+	}
+
+	code := int32(binary.LittleEndian.Uint32(frame))
+	if code >= 0 {
+		return nil
+	}
+
+	switch code {
+	case ErrAuthKeyNotFound.Code:
+		return ErrAuthKeyNotFound
+	case ErrTransportFlood.Code:
+		return ErrTransportFlood
+	case ErrInvalidDC.Code:
+		return ErrInvalidDC
+	}
+
+	return &TransportError{code}
+}
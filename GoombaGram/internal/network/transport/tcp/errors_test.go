@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tcp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseTransportError(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"-404", []byte{0x6C, 0xFE, 0xFF, 0xFF}, ErrAuthKeyNotFound},
+		{"-429", []byte{0x53, 0xFE, 0xFF, 0xFF}, ErrTransportFlood},
+		{"-444", []byte{0x44, 0xFE, 0xFF, 0xFF}, ErrInvalidDC},
+		{"unknown code", []byte{0xFE, 0xFF, 0xFF, 0xFF}, &TransportError{-2}},
+		{"padded -404", []byte{0x6C, 0xFE, 0xFF, 0xFF, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, ErrAuthKeyNotFound},
+		{"positive int", []byte{4, 0, 0, 0}, nil},
+		{"too short", []byte{0xFF, 0xFF, 0xFF}, nil},
+		{"empty", nil, nil},
+		{"message", append([]byte{0x6C, 0xFE, 0xFF, 0xFF}, make([]byte, 20)...), nil},
+	}
+
+	for _, test := range tests {
+		err := ParseTransportError(test.frame)
+		if test.want == nil {
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			continue
+		}
+
+		if !errors.Is(err, test.want) {
+			t.Fatalf("%s: %v, expected %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestTransportErrorIs(t *testing.T) {
+	if !errors.Is(&TransportError{-404}, ErrAuthKeyNotFound) {
+		t.Fatal("same code isn't matched")
+	}
+	if errors.Is(ErrTransportFlood, ErrAuthKeyNotFound) {
+		t.Fatal("different codes are matched")
+	}
+
+	var transportErr *TransportError
+	if !errors.As(error(ErrInvalidDC), &transportErr) || transportErr.Code != -444 {
+		t.Fatal(transportErr)
+	}
+
+	if ErrAuthKeyNotFound.Error() != "transport error -404: auth key not found" {
+		t.Fatal(ErrAuthKeyNotFound.Error())
+	}
+	if (&TransportError{-1}).Error() != "transport error -1" {
+		t.Fatal((&TransportError{-1}).Error())
+	}
+}
+
+func TestTransportErrorFrames(t *testing.T) {
+	codes := []struct {
+		frame []byte
+		want  error
+	}{
+		{[]byte{0x6C, 0xFE, 0xFF, 0xFF}, ErrAuthKeyNotFound},
+		{[]byte{0x53, 0xFE, 0xFF, 0xFF}, ErrTransportFlood},
+		{[]byte{0x44, 0xFE, 0xFF, 0xFF}, ErrInvalidDC},
+		{[]byte{0xFE, 0xFF, 0xFF, 0xFF}, &TransportError{-2}},
+	}
+
+	for _, framing := range testFramings {
+		for _, obfuscation := range []bool{false, true} {
+			if framing == "full" && obfuscation {
+				continue
+			}
+
+			client, server := connectPipe(t, framing, obfuscation)
+
+			// Full is detected when the first frame arrives
+			done := writeAsync(client.WriteFrame, make([]byte, 32))
+			if _, err := server().ReadFrame(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			for _, code := range codes {
+				done := writeAsync(server().WriteFrame, code.frame)
+				_, err := client.ReadFrame()
+				if !errors.Is(err, code.want) {
+					t.Fatalf("%s obfuscated=%v: %v, expected %v", framing, obfuscation, err, code.want)
+				}
+				if err := <-done; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The server doesn't parse transport errors
+			done = writeAsync(client.WriteFrame, codes[0].frame)
+			data, err := server().ReadFrame()
+			if err != nil {
+				t.Fatalf("%s obfuscated=%v: %v", framing, obfuscation, err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			checkFrame(t, framing, data, codes[0].frame)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tcp
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto"
+	"io"
+	"time"
+)
+
+// Fake TLS used by MTProxy "ee" secrets
+//
+// The client sends a TLS 1.3 ClientHello whose random field is HMAC-SHA256(secret, ClientHello)
+// with the last 4 bytes xored with the current timestamp. The proxy answers with ServerHello,
+// ChangeCipherSpec and an application data record, its random field is
+// HMAC-SHA256(secret, client random + answer with zero random).
+// After the handshake, data travels inside TLS application data records.
+
+// ClientHello total length
+const fakeTLSHelloLength = 517
+
+// Maximum payload of a TLS record
+const fakeTLSMaxRecord = 16384
+
+const (
+	tlsRecordHandshake        = 0x16
+	tlsRecordChangeCipherSpec = 0x14
+	tlsRecordApplicationData  = 0x17
+)
+
+// ChangeCipherSpec record, sent before the first application data
+var tlsChangeCipherSpec = []byte{tlsRecordChangeCipherSpec, 0x03, 0x03, 0x00, 0x01, 0x01}
+
+type fakeTLSConn struct {
+	conn      io.ReadWriter
+	buffer    []byte // application data received and not read yet
+	sentFirst bool
+}
+
+// Random reader for crypto/ecdh that uses the entropy source
+type randomReader struct{}
+
+func (randomReader) Read(b []byte) (int, error) {
+	return crypto.ReadRandom(b)
+}
+
+// Random GREASE value (RFC 8701): 0x?A?A
+func grease() (uint16, error) {
+	value, err := crypto.RandomInt(16)
+	if err != nil {
+		return 0, err
+	}
+
+	b := byte(value<<4 | 0x0A)
+	return uint16(b)<<8 | uint16(b), nil
+}
+
+// TLS extension (type, length, data)
+func tlsExtension(extensionType uint16, data []byte) []byte {
+	result := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint16(result, extensionType)
+	binary.BigEndian.PutUint16(result[2:], uint16(len(data)))
+	return append(result, data...)
+}
+
+// Prefix data with its 2 bytes length
+func tlsVector(data []byte) []byte {
+	result := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(result, uint16(len(data)))
+	return append(result, data...)
+}
+
+func uint16Bytes(values ...uint16) []byte {
+	result := make([]byte, 2*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint16(result[2*i:], value)
+	}
+	return result
+}
+
+// Create a browser-like ClientHello with zero random field (bytes 11-43)
+func fakeTLSClientHello(domain string) ([]byte, error) {
+	if len(domain) == 0 || len(domain) > 253 {
+		return nil, errors.New("mtproxy: wrong fake TLS domain")
+	}
+
+	greases := make([]uint16, 4)
+	for i := range greases {
+		value, err := grease()
+		if err != nil {
+			return nil, err
+		}
+		greases[i] = value
+	}
+	// The two GREASE extensions must be different
+	if greases[2] == greases[3] {
+		greases[3] ^= 0x1010
+	}
+
+	sessionID := make([]byte, 32)
+	_, err := crypto.ReadRandom(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Real x25519 public key for key_share
+	privateKey, err := ecdh.X25519().GenerateKey(randomReader{})
+	if err != nil {
+		return nil, err
+	}
+
+	cipherSuites := uint16Bytes(greases[0], 0x1301, 0x1302, 0x1303, 0xC02B, 0xC02F, 0xC02C, 0xC030,
+		0xCCA9, 0xCCA8, 0xC013, 0xC014, 0x009C, 0x009D, 0x002F, 0x0035)
+
+	serverName := append([]byte{0x00}, tlsVector([]byte(domain))...)
+	keyShare := append(uint16Bytes(greases[1], 0x0001), 0x00)
+	keyShare = append(keyShare, uint16Bytes(0x001D)...)
+	keyShare = append(keyShare, tlsVector(privateKey.PublicKey().Bytes())...)
+
+	extensions := make([]byte, 0, 512)
+	extensions = append(extensions, tlsExtension(greases[2], nil)...)
+	extensions = append(extensions, tlsExtension(0x0000, tlsVector(serverName))...)                                                                  // server_name
+	extensions = append(extensions, tlsExtension(0x0017, nil)...)                                                                                    // extended_master_secret
+	extensions = append(extensions, tlsExtension(0xFF01, []byte{0x00})...)                                                                           // renegotiation_info
+	extensions = append(extensions, tlsExtension(0x000A, tlsVector(uint16Bytes(greases[1], 0x001D, 0x0017, 0x0018)))...)                             // supported_groups
+	extensions = append(extensions, tlsExtension(0x000B, []byte{0x01, 0x00})...)                                                                     // ec_point_formats
+	extensions = append(extensions, tlsExtension(0x0023, nil)...)                                                                                    // session_ticket
+	extensions = append(extensions, tlsExtension(0x0010, tlsVector([]byte("\x02h2\x08http/1.1")))...)                                                // ALPN
+	extensions = append(extensions, tlsExtension(0x0005, []byte{0x01, 0x00, 0x00, 0x00, 0x00})...)                                                   // status_request
+	extensions = append(extensions, tlsExtension(0x000D, tlsVector(uint16Bytes(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)))...) // signature_algorithms
+	extensions = append(extensions, tlsExtension(0x0012, nil)...)                                                                                    // signed_certificate_timestamp
+	extensions = append(extensions, tlsExtension(0x0033, tlsVector(keyShare))...)                                                                    // key_share
+	extensions = append(extensions, tlsExtension(0x002D, []byte{0x01, 0x01})...)                                                                     // psk_key_exchange_modes
+	extensions = append(extensions, tlsExtension(0x002B, append([]byte{0x06}, uint16Bytes(greases[0], 0x0304, 0x0303)...))...)                       // supported_versions
+	extensions = append(extensions, tlsExtension(0x001B, []byte{0x02, 0x00, 0x02})...)                                                               // compress_certificate
+	extensions = append(extensions, tlsExtension(greases[3], []byte{0x00})...)
+
+	body := make([]byte, 0, fakeTLSHelloLength)
+	body = append(body, 0x03, 0x03)          // legacy version
+	body = append(body, make([]byte, 32)...) // random (filled later)
+	body = append(body, 32)                  // session id
+	body = append(body, sessionID...)
+	body = append(body, tlsVector(cipherSuites)...)
+	body = append(body, 0x01, 0x00) // compression methods
+
+	// Padding extension up to 517 bytes (record header 5, handshake header 4, extensions length 2, padding header 4)
+	paddingLength := fakeTLSHelloLength - 5 - 4 - len(body) - 2 - len(extensions) - 4
+	if paddingLength < 0 {
+		return nil, errors.New("mtproxy: fake TLS domain is too long")
+	}
+	extensions = append(extensions, tlsExtension(0x0015, make([]byte, paddingLength))...)
+	body = append(body, tlsVector(extensions)...)
+
+	hello := make([]byte, 0, fakeTLSHelloLength)
+	hello = append(hello, tlsRecordHandshake, 0x03, 0x01)
+	hello = append(hello, uint16Bytes(uint16(4+len(body)))...)
+	hello = append(hello, 0x01, 0x00) // ClientHello, length (3 bytes)
+	hello = append(hello, uint16Bytes(uint16(len(body)))...)
+	hello = append(hello, body...)
+
+	return hello, nil
+}
+
+// Read a TLS record, it returns header and payload
+func readTLSRecord(conn io.Reader) ([]byte, []byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if header[1] != 0x03 || header[2] != 0x03 {
+		return nil, nil, errors.New("mtproxy: wrong TLS record version")
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	_, err = io.ReadFull(conn, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return header, payload, nil
+}
+
+// Fake TLS handshake with the proxy
+func fakeTLSHandshake(conn io.ReadWriter, secret []byte, domain string) (*fakeTLSConn, error) {
+	hello, err := fakeTLSClientHello(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	// random = HMAC-SHA256(secret, hello), last 4 bytes xored with the timestamp (little endian)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(hello)
+	random := mac.Sum(nil)
+	timestamp := binary.LittleEndian.Uint32(random[28:]) ^ uint32(time.Now().Unix())
+	binary.LittleEndian.PutUint32(random[28:], timestamp)
+	copy(hello[11:43], random)
+
+	_, err = conn.Write(hello)
+	if err != nil {
+		return nil, err
+	}
+
+	// ServerHello, ChangeCipherSpec, application data
+	answer := make([]byte, 0, 4096)
+	for _, expected := range []byte{tlsRecordHandshake, tlsRecordChangeCipherSpec, tlsRecordApplicationData} {
+		header, payload, err := readTLSRecord(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if header[0] != expected {
+			return nil, errors.New("mtproxy: unexpected fake TLS answer")
+		}
+
+		answer = append(answer, header...)
+		answer = append(answer, payload...)
+	}
+
+	if len(answer) < 43 {
+		return nil, errors.New("mtproxy: fake TLS answer is too short")
+	}
+
+	// Check server random
+	serverRandom := make([]byte, 32)
+	copy(serverRandom, answer[11:43])
+	for i := 11; i < 43; i++ {
+		answer[i] = 0
+	}
+
+	mac = hmac.New(sha256.New, secret)
+	mac.Write(random)
+	mac.Write(answer)
+	if !hmac.Equal(mac.Sum(nil), serverRandom) {
+		return nil, errors.New("mtproxy: fake TLS server verification failed")
+	}
+
+	return &fakeTLSConn{conn: conn}, nil
+}
+
+// Send data inside application data records
+func (tls *fakeTLSConn) write(data []byte) error {
+	var buffer bytes.Buffer
+
+	if !tls.sentFirst {
+		buffer.Write(tlsChangeCipherSpec)
+		tls.sentFirst = true
+	}
+
+	for len(data) > 0 {
+		length := len(data)
+		if length > fakeTLSMaxRecord {
+			length = fakeTLSMaxRecord
+		}
+
+		buffer.Write([]byte{tlsRecordApplicationData, 0x03, 0x03})
+		buffer.Write(uint16Bytes(uint16(length)))
+		buffer.Write(data[:length])
+		data = data[length:]
+	}
+
+	_, err := tls.conn.Write(buffer.Bytes())
+	return err
+}
+
+// Read length bytes of application data
+func (tls *fakeTLSConn) read(length int) ([]byte, error) {
+	for len(tls.buffer) < length {
+		header, payload, err := readTLSRecord(tls.conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if header[0] != tlsRecordApplicationData {
+			return nil, errors.New("mtproxy: unexpected TLS record")
+		}
+
+		tls.buffer = append(tls.buffer, payload...)
+	}
+
+	data := make([]byte, length)
+	copy(data, tls.buffer)
+	tls.buffer = tls.buffer[length:]
+
+	return data, nil
+}
@@ -0,0 +1,313 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Client transport used by the tests
+type testTransport interface {
+	ConnectContext(ctx context.Context, address string, obfuscation bool) error
+	WriteFrame(data []byte) error
+	ReadFrame() ([]byte, error)
+	Close() error
+}
+
+// Framings of the client transports
+var testFramings = []string{"abridged", "intermediate", "paddedIntermediate", "full"}
+
+func testTransportNew(framing string, dialer Dialer) testTransport {
+	switch framing {
+	case "abridged":
+		return &Abridged{Dialer: dialer}
+	case "intermediate":
+		return &Intermediate{Dialer: dialer}
+	case "paddedIntermediate":
+		return &PaddedIntermediate{Dialer: dialer}
+	default:
+		return &Full{Dialer: dialer}
+	}
+}
+
+// Dialer that connects to the server side of a net.Pipe
+type pipeDialer struct {
+	servers chan net.Conn
+}
+
+func pipeDialerNew() pipeDialer {
+	return pipeDialer{servers: make(chan net.Conn, 1)}
+}
+
+func (dialer pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	dialer.servers <- server
+	return client, nil
+}
+
+// Connect a client over net.Pipe, server waits for its ServerConnection
+// (the Full transport is detected only when the first frame arrives)
+func connectPipe(t *testing.T, framing string, obfuscation bool) (client testTransport, server func() *ServerConnection) {
+	t.Helper()
+
+	dialer := pipeDialerNew()
+	client = testTransportNew(framing, dialer)
+
+	type result struct {
+		server *ServerConnection
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		server, err := ServerConnectionNew(<-dialer.servers, nil)
+		results <- result{server, err}
+	}()
+
+	err := client.ConnectContext(context.Background(), "pipe", obfuscation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var once sync.Once
+	var serverConn *ServerConnection
+	server = func() *ServerConnection {
+		once.Do(func() {
+			res := <-results
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			serverConn = res.server
+		})
+		return serverConn
+	}
+
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	return client, server
+}
+
+// Check a frame, PaddedIntermediate frames are followed by 0-15 bytes of padding
+func checkFrame(t *testing.T, framing string, got, want []byte) {
+	t.Helper()
+
+	if framing == "paddedIntermediate" && len(got) >= len(want) && len(got) <= len(want)+15 {
+		got = got[:len(want)]
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s: frame of %d bytes received, %d bytes expected", framing, len(got), len(want))
+	}
+}
+
+// Write in a goroutine (net.Pipe writes wait for the reader)
+func writeAsync(write func([]byte) error, data []byte) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- write(data)
+	}()
+	return done
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	sizes := []int{4, 16, 124 * 4, 127 * 4, 128 * 4, 64 * 1024}
+
+	for _, framing := range testFramings {
+		for _, obfuscation := range []bool{false, true} {
+			if framing == "full" && obfuscation {
+				continue
+			}
+
+			client, server := connectPipe(t, framing, obfuscation)
+			for _, size := range sizes {
+				want := bytes.Repeat([]byte{byte(size), 1, 2, 3}, size/4)
+
+				done := writeAsync(client.WriteFrame, want)
+				got, err := server().ReadFrame()
+				if err != nil {
+					t.Fatalf("%s obfuscated=%v size %d: %v", framing, obfuscation, size, err)
+				}
+				if err := <-done; err != nil {
+					t.Fatal(err)
+				}
+				checkFrame(t, framing, got, want)
+
+				done = writeAsync(server().WriteFrame, want)
+				got, err = client.ReadFrame()
+				if err != nil {
+					t.Fatalf("%s obfuscated=%v size %d: %v", framing, obfuscation, size, err)
+				}
+				if err := <-done; err != nil {
+					t.Fatal(err)
+				}
+				checkFrame(t, framing, got, want)
+			}
+
+			if server().Obfuscated() != obfuscation {
+				t.Fatalf("%s: obfuscation %v detected", framing, server().Obfuscated())
+			}
+		}
+	}
+}
+
+func TestFramePartialReads(t *testing.T) {
+	dialer := pipeDialerNew()
+	client := &Intermediate{Dialer: dialer}
+
+	want := bytes.Repeat([]byte{5}, 16)
+	go func() {
+		server := <-dialer.servers
+		init := make([]byte, 4)
+		_, _ = server.Read(init)
+
+		// The frame arrives one byte at a time
+		frame := append([]byte{16, 0, 0, 0}, want...)
+		for _, b := range frame {
+			_, _ = server.Write([]byte{b})
+		}
+	}()
+
+	if err := client.Connect("pipe", false); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	got, err := client.ReadFrame()
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatal(got, err)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	for _, framing := range testFramings {
+		client, _ := connectPipe(t, framing, false)
+		if err := client.WriteFrame(make([]byte, MaxFrameSize+4)); err != ErrFrameTooLarge {
+			t.Fatalf("%s: %v", framing, err)
+		}
+	}
+
+	// Length of a received frame bigger than MaxFrameSize
+	dialer := pipeDialerNew()
+	client := &Intermediate{Dialer: dialer}
+	go func() {
+		server := <-dialer.servers
+		init := make([]byte, 4)
+		_, _ = server.Read(init)
+
+		length := make([]byte, 4)
+		binary.LittleEndian.PutUint32(length, MaxFrameSize+4)
+		_, _ = server.Write(length)
+	}()
+
+	if err := client.Connect("pipe", false); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.ReadFrame(); err != ErrFrameTooLarge {
+		t.Fatal(err)
+	}
+}
+
+func TestFrameNotConnected(t *testing.T) {
+	for _, framing := range testFramings {
+		client := testTransportNew(framing, nil)
+		if err := client.WriteFrame([]byte{1, 2, 3, 4}); err != ErrNotConnected {
+			t.Fatalf("%s: %v", framing, err)
+		}
+		if _, err := client.ReadFrame(); err != ErrNotConnected {
+			t.Fatalf("%s: %v", framing, err)
+		}
+	}
+}
+
+func TestFrameConcurrent(t *testing.T) {
+	const writers, frames = 4, 50
+
+	for _, framing := range testFramings {
+		obfuscation := framing != "full"
+		client, server := connectPipe(t, framing, obfuscation)
+
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < frames; j++ {
+					if err := client.WriteFrame(bytes.Repeat([]byte{byte(i)}, 64)); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(i)
+		}
+
+		// The client reads while it writes
+		read := make(chan error, 1)
+		go func() {
+			for j := 0; j < frames; j++ {
+				data, err := client.ReadFrame()
+				if err != nil {
+					read <- err
+					return
+				}
+				if data[0] != 0xAA {
+					read <- errors.New("wrong frame received")
+					return
+				}
+			}
+			read <- nil
+		}()
+
+		// Full is detected only after the first frame
+		srv := server()
+		go func() {
+			for j := 0; j < frames; j++ {
+				_ = srv.WriteFrame(bytes.Repeat([]byte{0xAA}, 32))
+			}
+		}()
+
+		for j := 0; j < writers*frames; j++ {
+			data, err := srv.ReadFrame()
+			if err != nil {
+				t.Fatalf("%s: %v", framing, err)
+			}
+			// Frames aren't interleaved
+			if !bytes.Equal(data[:64], bytes.Repeat(data[:1], 64)) {
+				t.Fatalf("%s: interleaved frame", framing)
+			}
+		}
+
+		wg.Wait()
+		select {
+		case err := <-read:
+			if err != nil {
+				t.Fatalf("%s: %v", framing, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: reader blocked", framing)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tcp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Full
+//
+// The basic MTProto transport, with a sequence number and a CRC32 in every frame.
+// It can't be obfuscated (and it can't be used with MTProxy).
+//
+// Overhead: medium
+// Minimum envelope length: 12 bytes
+// Maximum envelope length: 12 bytes
+type Full struct {
+	*tcpConnection          // connection (TCP, proxy or any net.Conn)
+	Dialer         Dialer   // dialer of the connection (nil for a direct TCP connection)
+	Timeouts       Timeouts // dial, handshake and idle timeouts (zero for none)
+	sendSeqNo      int32    // seqno of the next frame sent
+	receiveSeqNo   int32    // seqno expected in the next frame received
+}
+
+// Received seqno isn't the expected one (lost, repeated or replayed frame)
+type SeqNoError struct {
+	Expected, Received int32
+}
+
+func (err *SeqNoError) Error() string {
+	return fmt.Sprintf("full transport: seqno %d received, %d expected", err.Received, err.Expected)
+}
+
+// Received CRC32 doesn't match the frame (corrupted frame)
+type CRCError struct {
+	Expected, Received uint32
+}
+
+func (err *CRCError) Error() string {
+	return fmt.Sprintf("full transport: crc32 %08x received, %08x expected", err.Received, err.Expected)
+}
+
+// Full TCP transport (no init is sent)
+func (full *Full) Connect(address string, obfuscation bool) error {
+	return full.ConnectContext(context.Background(), address, obfuscation)
+}
+
+// Connect within ctx and the dial timeout
+func (full *Full) ConnectContext(ctx context.Context, address string, obfuscation bool) error {
+	if obfuscation {
+		return errors.New("full transport can't be obfuscated")
+	}
+
+	full.tcpConnection = tcpNew(full.Dialer, full.Timeouts)
+	full.sendSeqNo, full.receiveSeqNo = 0, 0
+
+	return full.tcpConnection.connect(ctx, address)
+}
+
+// Write a frame using Full TCP
+//
+// +----+----+----...----+----+
+// +len.+seq.+  payload  +crc.+
+// +----+----+----...----+----+
+//
+// Length: total length (length, seqno, payload and crc) encoded as 4 length bytes (little endian)
+// Seqno: frame number in this direction, from 0 (little endian)
+// Payload: the MTProto payload
+// Crc: CRC32 of length, seqno and payload (little endian)
+func (full *Full) WriteFrame(data []byte) error {
+	return full.WriteFrameContext(context.Background(), data)
+}
+
+// Write a frame within ctx and the idle timeout
+func (full *Full) WriteFrameContext(ctx context.Context, data []byte) error {
+	if full.tcpConnection == nil {
+		return ErrNotConnected
+	}
+
+	return full.tcpConnection.writeFrameContext(ctx, data, func() error {
+		return full.writeFrame(data)
+	})
+}
+
+// Encode and send a frame
+func (full *Full) writeFrame(data []byte) error {
+	frame := make([]byte, 8, len(data)+12)
+	binary.LittleEndian.PutUint32(frame, uint32(len(data)+12))
+	binary.LittleEndian.PutUint32(frame[4:], uint32(full.sendSeqNo))
+	frame = append(frame, data...)
+
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(frame))
+	frame = append(frame, crc...)
+
+	err := full.tcpConnection.sendAll(frame)
+	if err != nil {
+		return err
+	}
+
+	full.sendSeqNo++
+	return nil
+}
+
+// Read a frame using Full TCP, seqno and crc are checked
+//
+// +----+----+----...----+----+
+// +len.+seq.+  payload  +crc.+
+// +----+----+----...----+----+
+func (full *Full) ReadFrame() ([]byte, error) {
+	return full.ReadFrameContext(context.Background())
+}
+
+// Read a frame within ctx and the idle timeout
+func (full *Full) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	if full.tcpConnection == nil {
+		return nil, ErrNotConnected
+	}
+
+	data, _, err := full.readFrameQuickAck(ctx)
+	return data, err
+}
+
+// Read a frame received by the server (Full has no quick ACK, so it's never requested)
+func (full *Full) readFrameQuickAck(ctx context.Context) ([]byte, bool, error) {
+	return full.tcpConnection.readFrameContext(ctx, func() ([]byte, bool, error) {
+		data, err := full.readFrame()
+		return data, false, err
+	}, nil)
+}
+
+// Full has no quick ACK
+func (full *Full) writeQuickAck(ctx context.Context, token uint32) error {
+	return errors.New("full transport doesn't support quick ACK")
+}
+
+// Receive and decode a frame
+func (full *Full) readFrame() ([]byte, error) {
+	header, err := full.tcpConnection.receiveAll(8)
+	if err != nil {
+		return nil, err
+	}
+
+	length := int(binary.LittleEndian.Uint32(header))
+	if length < 12 {
+		return nil, errors.New("full transport: wrong frame length")
+	}
+
+	if length-12 > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	rest, err := full.tcpConnection.receiveAll(length - 8)
+	if err != nil {
+		return nil, err
+	}
+	frame := append(header, rest...)
+
+	// Check crc before seqno, a corrupted seqno is a crc error
+	expectedCRC := crc32.ChecksumIEEE(frame[:length-4])
+	receivedCRC := binary.LittleEndian.Uint32(frame[length-4:])
+	if expectedCRC != receivedCRC {
+		return nil, &CRCError{Expected: expectedCRC, Received: receivedCRC}
+	}
+
+	seqNo := int32(binary.LittleEndian.Uint32(frame[4:8]))
+	if seqNo != full.receiveSeqNo {
+		return nil, &SeqNoError{Expected: full.receiveSeqNo, Received: seqNo}
+	}
+	full.receiveSeqNo++
+
+	return frame[8 : length-4], nil
+}
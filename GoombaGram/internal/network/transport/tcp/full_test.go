@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"testing"
+)
+
+// Encode a Full frame with seqno
+func fullFrame(seqNo int32, payload []byte) []byte {
+	frame := make([]byte, 8, len(payload)+12)
+	binary.LittleEndian.PutUint32(frame, uint32(len(payload)+12))
+	binary.LittleEndian.PutUint32(frame[4:], uint32(seqNo))
+	frame = append(frame, payload...)
+
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(frame))
+	return append(frame, crc...)
+}
+
+// Connect a Full client, server sends the raw frames
+func connectFull(t *testing.T, frames ...[]byte) *Full {
+	t.Helper()
+
+	dialer := pipeDialerNew()
+	client := &Full{Dialer: dialer}
+	if err := client.Connect("pipe", false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	server := <-dialer.servers
+	t.Cleanup(func() { _ = server.Close() })
+	go func(server net.Conn) {
+		for _, frame := range frames {
+			if _, err := server.Write(frame); err != nil {
+				return
+			}
+		}
+	}(server)
+
+	return client
+}
+
+func TestFullCRCError(t *testing.T) {
+	payload := bytes.Repeat([]byte{1, 2, 3, 4}, 8)
+
+	corruptedCRC := fullFrame(0, payload)
+	corruptedCRC[len(corruptedCRC)-1] ^= 0xFF
+
+	corruptedPayload := fullFrame(0, payload)
+	corruptedPayload[10] ^= 1
+
+	// A corrupted seqno is a crc error too
+	corruptedSeqNo := fullFrame(0, payload)
+	corruptedSeqNo[4] = 1
+
+	for name, frame := range map[string][]byte{"crc": corruptedCRC, "payload": corruptedPayload, "seqno": corruptedSeqNo} {
+		client := connectFull(t, frame)
+
+		_, err := client.ReadFrame()
+		var crcErr *CRCError
+		if !errors.As(err, &crcErr) {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		expected := crc32.ChecksumIEEE(frame[:len(frame)-4])
+		received := binary.LittleEndian.Uint32(frame[len(frame)-4:])
+		if crcErr.Expected != expected || crcErr.Received != received {
+			t.Fatalf("%s: %+v", name, crcErr)
+		}
+	}
+}
+
+func TestFullSeqNoError(t *testing.T) {
+	payload := bytes.Repeat([]byte{5}, 16)
+
+	for _, test := range []struct {
+		name  string
+		seqNo int32 // seqno of the second frame
+	}{
+		{"skipped", 2},
+		{"replayed", 0},
+		{"negative", -1},
+	} {
+		client := connectFull(t, fullFrame(0, payload), fullFrame(test.seqNo, payload))
+
+		if data, err := client.ReadFrame(); err != nil || !bytes.Equal(data, payload) {
+			t.Fatalf("%s: first frame %x %v", test.name, data, err)
+		}
+
+		_, err := client.ReadFrame()
+		var seqNoErr *SeqNoError
+		if !errors.As(err, &seqNoErr) || seqNoErr.Expected != 1 || seqNoErr.Received != test.seqNo {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestFullSeqNo(t *testing.T) {
+	dialer := pipeDialerNew()
+	client := &Full{Dialer: dialer}
+	if err := client.Connect("pipe", false); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	server := <-dialer.servers
+	defer server.Close()
+
+	// Frames sent by the client are numbered from 0
+	for seqNo := int32(0); seqNo < 3; seqNo++ {
+		payload := bytes.Repeat([]byte{byte(seqNo)}, 8)
+		done := writeAsync(client.WriteFrame, payload)
+
+		frame := make([]byte, 20)
+		if _, err := io.ReadFull(server, frame); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame, fullFrame(seqNo, payload)) {
+			t.Fatalf("frame %x", frame)
+		}
+	}
+}
@@ -17,7 +17,9 @@
 package tcp
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto/aes"
 )
 
@@ -29,44 +31,70 @@ import (
 // Minimum envelope length: 4 bytes
 // Maximum envelope length: 4 bytes
 type Intermediate struct{
-	*tcpConnection                  // TCP connection
+	*tcpConnection                  // connection (TCP, proxy or any net.Conn)
 	encrypt, decrypt *aes.AES256CTR // AES-256 CTR encrypt/decrypt (only with obfuscation true)
+	Dialer           Dialer         // dialer of the connection (nil for a direct TCP connection)
+	Timeouts         Timeouts       // dial, handshake and idle timeouts (zero for none)
+	QuickAck         func(uint32)   // called with the quick ACK tokens received from the server (optional)
 }
 
 func (inter *Intermediate) Connect(address string, obfuscation bool) error {
-	inter.tcpConnection = tcpNew()
+	return inter.ConnectContext(context.Background(), address, obfuscation)
+}
+
+// Connect within ctx and the dial and handshake timeouts
+func (inter *Intermediate) ConnectContext(ctx context.Context, address string, obfuscation bool) error {
+	inter.tcpConnection = tcpNew(inter.Dialer, inter.Timeouts)
 
-	err := inter.tcpConnection.connect(address)
+	err := inter.tcpConnection.connect(ctx, address)
 	if err != nil {
 		return err
 	}
 
-	if obfuscation {
-		nonce, reversedNonce := obfuscationCTRGenerator(0xEE)
+	return inter.tcpConnection.handshake(ctx, func() error {
+		if obfuscation {
+			var err error
+			inter.encrypt, inter.decrypt, err = inter.tcpConnection.obfuscate(0xEE, nil, 0)
+			return err
+		}
 
-		inter.encrypt = aes.AES256CTRNew(nonce[8:40], nonce[40:56])
-		inter.decrypt = aes.AES256CTRNew(reversedNonce[8:40], reversedNonce[40:56])
+		// Telegram docs:
+		// Before sending anything into the underlying socket (see transports), the client must first send 0xeeeeeeee as the first int (four bytes, the server will not send 0xeeeeeeee as the first int in the first reply).
+		return inter.tcpConnection.sendAll([]byte{0xEE, 0xEE, 0xEE, 0xEE})
+	})
+}
 
-		// Add aes encrypted to nonce
-		aesNonce := make([]byte, 64); copy(aesNonce, nonce)
-		inter.encrypt.EncryptDecrypt(aesNonce)
+// Intermediate TCP transport through an MTProxy (only plain secrets)
+// dcID is the destination DC (negative for media DCs)
+func (inter *Intermediate) ConnectProxy(proxy *MTProxy, dcID int16) error {
+	return inter.ConnectProxyContext(context.Background(), proxy, dcID)
+}
 
-		// Send encrypted nonce to server (when connect)
-		err = inter.tcpConnection.sendAll(append(nonce[:56], aesNonce[56:64]...))
-	} else {
-		// Telegram docs:
-		// Before sending anything into the underlying socket (see transports), the client must first send 0xeeeeeeee as the first int (four bytes, the server will not send 0xeeeeeeee as the first int in the first reply).	err = inter.tcpConnection.sendAll([]byte{0xEF})
-		err = inter.tcpConnection.sendAll([]byte{0xEE, 0xEE, 0xEE, 0xEE})
+// Connect through an MTProxy within ctx and the dial and handshake timeouts
+func (inter *Intermediate) ConnectProxyContext(ctx context.Context, proxy *MTProxy, dcID int16) error {
+	if proxy.ForcePadding() {
+		return errors.New("this proxy secret requires the PaddedIntermediate transport")
 	}
 
+	inter.tcpConnection = tcpNew(inter.Dialer, inter.Timeouts)
+
+	err := inter.tcpConnection.connect(ctx, proxy.Address())
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return inter.tcpConnection.handshake(ctx, func() error {
+		err := inter.tcpConnection.proxyHandshake(proxy)
+		if err != nil {
+			return err
+		}
+
+		inter.encrypt, inter.decrypt, err = inter.tcpConnection.obfuscate(0xEE, proxy.Secret, dcID)
+		return err
+	})
 }
 
-// Send data to Telegram server using Intermediate TCP
+// Write a frame using Intermediate TCP
 //
 // +----+----...----+
 // +len.+  payload  +
@@ -74,10 +102,41 @@ func (inter *Intermediate) Connect(address string, obfuscation bool) error {
 //
 // Length: payload length encoded as 4 length bytes (little endian)
 // Payload: the MTProto payload
-func (inter *Intermediate) Send(data []byte) error {
+func (inter *Intermediate) WriteFrame(data []byte) error {
+	return inter.WriteFrameContext(context.Background(), data)
+}
+
+// Write a frame within ctx and the idle timeout
+func (inter *Intermediate) WriteFrameContext(ctx context.Context, data []byte) error {
+	if inter.tcpConnection == nil {
+		return ErrNotConnected
+	}
+
+	return inter.tcpConnection.writeFrameContext(ctx, data, func() error {
+		return inter.writeFrame(data, false)
+	})
+}
+
+// Write a frame and request a quick ACK, the server token is passed to QuickAck
+func (inter *Intermediate) WriteFrameQuickAck(ctx context.Context, data []byte) error {
+	if inter.tcpConnection == nil {
+		return ErrNotConnected
+	}
+
+	return inter.tcpConnection.writeFrameContext(ctx, data, func() error {
+		return inter.writeFrame(data, true)
+	})
+}
+
+// Encode, encrypt and send a frame
+// quickAck sets the most significant bit of the length
+func (inter *Intermediate) writeFrame(data []byte, quickAck bool) error {
 	// Parse length to 4 bytes slice
 	length := make([]byte, 4)
 	binary.LittleEndian.PutUint32(length, uint32(len(data)))
+	if quickAck {
+		length[3] |= 0x80
+	}
 	data = append(length, data...)
 
 	if inter.encrypt != nil {
@@ -92,15 +151,50 @@ func (inter *Intermediate) Send(data []byte) error {
 	return nil
 }
 
-// Receive n data to Telegram server using Intermediate TCP
+// Read a frame using Intermediate TCP
 //
 // +----+----...----+
 // +len.+  payload  +
 // +----+----...----+
-func (inter *Intermediate) Receive(data []byte) error {
+func (inter *Intermediate) ReadFrame() ([]byte, error) {
+	return inter.ReadFrameContext(context.Background())
+}
+
+// Read a frame within ctx and the idle timeout
+func (inter *Intermediate) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	if inter.tcpConnection == nil {
+		return nil, ErrNotConnected
+	}
+
+	data, _, err := inter.tcpConnection.readFrameContext(ctx, inter.readFrame, inter.QuickAck)
+	return data, err
+}
+
+// Read a frame received by the server, quickAck is true if the client has requested a quick ACK
+func (inter *Intermediate) readFrameQuickAck(ctx context.Context) ([]byte, bool, error) {
+	return inter.tcpConnection.readFrameContext(ctx, inter.readFrame, nil)
+}
+
+// Send a quick ACK token to the client (4 bytes, little endian)
+func (inter *Intermediate) writeQuickAck(ctx context.Context, token uint32) error {
+	return inter.tcpConnection.writeFrameContext(ctx, nil, func() error {
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, token|0x80000000)
+
+		if inter.encrypt != nil {
+			inter.encrypt.EncryptDecrypt(data)
+		}
+
+		return inter.tcpConnection.sendAll(data)
+	})
+}
+
+// Receive, decrypt and decode a frame
+// The most significant bit of the length is a quick ACK request (server) or a quick ACK token (client)
+func (inter *Intermediate) readFrame() ([]byte, bool, error) {
 	length, err := inter.tcpConnection.receiveAll(4)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
 	// Decrypt length
@@ -108,13 +202,28 @@ func (inter *Intermediate) Receive(data []byte) error {
 		inter.decrypt.EncryptDecrypt(length)
 	}
 
+	quickAck := length[3] & 0x80 != 0
+
+	// Quick ACK token: the length itself
+	if quickAck && !inter.tcpConnection.server {
+		token := make([]byte, 4)
+		binary.BigEndian.PutUint32(token, binary.LittleEndian.Uint32(length))
+		return token, true, nil
+	}
+
+	length[3] &= 0x7F
+
 	// Get length of data as int
 	lenInt := int(binary.LittleEndian.Uint32(length))
 
+	if lenInt > MaxFrameSize {
+		return nil, false, ErrFrameTooLarge
+	}
+
 	// Get n bytes
-	data, err = inter.tcpConnection.receiveAll(lenInt)
+	data, err := inter.tcpConnection.receiveAll(lenInt)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
 	// Decrypt received data
@@ -122,5 +231,5 @@ func (inter *Intermediate) Receive(data []byte) error {
 		inter.decrypt.EncryptDecrypt(data)
 	}
 
-	return nil
+	return data, quickAck, nil
 }
\ No newline at end of file
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tcp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// https://core.telegram.org/mtproto/mtproto-transports#transport-obfuscation
+
+// MTProxy secret type
+type ProxyMode int
+
+const (
+	ProxyPlain   ProxyMode = iota // 16 bytes secret, any obfuscated transport
+	ProxyPadded                   // "dd" + secret, only PaddedIntermediate
+	ProxyFakeTLS                  // "ee" + secret + domain, fake TLS and PaddedIntermediate
+)
+
+// MTProxy server
+type MTProxy struct {
+	Server string
+	Port   int
+	Secret []byte // 16 bytes key (without dd/ee prefix and domain)
+	Mode   ProxyMode
+	Domain string // domain of the fake TLS ClientHello (only ee secrets)
+}
+
+// Parse a proxy link: tg://proxy?server=&port=&secret= or https://t.me/proxy?server=&port=&secret=
+func ParseProxyLink(link string) (*MTProxy, error) {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+
+	isTg := parsed.Scheme == "tg" && parsed.Host == "proxy"
+	isWeb := (parsed.Scheme == "https" || parsed.Scheme == "http") && (parsed.Host == "t.me" || parsed.Host == "telegram.me") && parsed.Path == "/proxy"
+	if !isTg && !isWeb {
+		return nil, errors.New("mtproxy: not a proxy link")
+	}
+
+	query := parsed.Query()
+
+	port, err := strconv.Atoi(query.Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, errors.New("mtproxy: wrong port")
+	}
+
+	server := query.Get("server")
+	if server == "" {
+		return nil, errors.New("mtproxy: server is missing")
+	}
+
+	proxy, err := ParseProxySecret(query.Get("secret"))
+	if err != nil {
+		return nil, err
+	}
+
+	proxy.Server = server
+	proxy.Port = port
+	return proxy, nil
+}
+
+// Parse an MTProxy secret (hex or base64)
+func ParseProxySecret(secret string) (*MTProxy, error) {
+	raw, err := hex.DecodeString(secret)
+	if err != nil {
+		raw, err = decodeBase64(secret)
+		if err != nil {
+			return nil, errors.New("mtproxy: secret isn't hex or base64")
+		}
+	}
+
+	switch {
+	case len(raw) == 16:
+		return &MTProxy{Secret: raw, Mode: ProxyPlain}, nil
+
+	case len(raw) == 17 && raw[0] == 0xDD:
+		return &MTProxy{Secret: raw[1:], Mode: ProxyPadded}, nil
+
+	case len(raw) > 17 && raw[0] == 0xEE:
+		return &MTProxy{Secret: raw[1:17], Mode: ProxyFakeTLS, Domain: string(raw[17:])}, nil
+
+	default:
+		return nil, errors.New("mtproxy: unknown secret format")
+	}
+}
+
+// Secrets in links can use standard or URL base64, with or without padding
+func decodeBase64(secret string) ([]byte, error) {
+	secret = strings.TrimRight(secret, "=")
+	secret = strings.NewReplacer("+", "-", "/", "_").Replace(secret)
+	return base64.RawURLEncoding.DecodeString(secret)
+}
+
+// Address to connect to
+func (proxy *MTProxy) Address() string {
+	return net.JoinHostPort(proxy.Server, strconv.Itoa(proxy.Port))
+}
+
+// dd and ee secrets require the PaddedIntermediate transport
+func (proxy *MTProxy) ForcePadding() bool {
+	return proxy.Mode != ProxyPlain
+}
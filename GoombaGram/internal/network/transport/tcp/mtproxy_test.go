@@ -0,0 +1,318 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto/aes"
+)
+
+var testProxySecret = []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+func TestParseProxyLink(t *testing.T) {
+	for _, test := range []struct {
+		link    string
+		address string
+		mode    ProxyMode
+		domain  string
+	}{
+		{"tg://proxy?server=1.2.3.4&port=443&secret=00112233445566778899aabbccddeeff", "1.2.3.4:443", ProxyPlain, ""},
+		{"tg://proxy?server=1.2.3.4&port=443&secret=dd00112233445566778899aabbccddeeff", "1.2.3.4:443", ProxyPadded, ""},
+		{"https://t.me/proxy?server=proxy.example.com&port=8443&secret=dd00112233445566778899AABBCCDDEEFF", "proxy.example.com:8443", ProxyPadded, ""},
+		{"http://telegram.me/proxy?server=::1&port=1&secret=00112233445566778899aabbccddeeff", "[::1]:1", ProxyPlain, ""},
+		{"https://t.me/proxy?server=h&port=65535&secret=ee00112233445566778899aabbccddeeff676f6f676c652e636f6d", "h:65535", ProxyFakeTLS, "google.com"},
+		// base64 secrets: standard with padding, URL without padding
+		{"tg://proxy?server=h&port=1&secret=7gARIjNEVWZ3iJmqu8zd7v9nb29nbGUuY29t", "h:1", ProxyFakeTLS, "google.com"},
+		{"tg://proxy?server=h&port=1&secret=3QARIjNEVWZ3iJmqu8zd7v8%3D", "h:1", ProxyPadded, ""},
+		{"tg://proxy?server=h&port=1&secret=3QARIjNEVWZ3iJmqu8zd7v8", "h:1", ProxyPadded, ""},
+		{"tg://proxy?server=h&port=1&secret=7gARIjNEVWZ3iJmqu8zd7v9leGFtcGxlLm9yZw", "h:1", ProxyFakeTLS, "example.org"},
+	} {
+		proxy, err := ParseProxyLink(test.link)
+		if err != nil {
+			t.Fatalf("%s: %v", test.link, err)
+		}
+		if proxy.Address() != test.address || proxy.Mode != test.mode || proxy.Domain != test.domain || !bytes.Equal(proxy.Secret, testProxySecret) {
+			t.Fatalf("%s: %+v", test.link, proxy)
+		}
+		if proxy.ForcePadding() != (test.mode != ProxyPlain) {
+			t.Fatalf("%s: wrong padding", test.link)
+		}
+	}
+}
+
+func TestParseProxyLinkErrors(t *testing.T) {
+	const secret = "00112233445566778899aabbccddeeff"
+
+	for _, link := range []string{
+		"tg://socks?server=h&port=1&secret=" + secret,
+		"https://example.com/proxy?server=h&port=1&secret=" + secret,
+		"https://t.me/socks?server=h&port=1&secret=" + secret,
+		"ftp://t.me/proxy?server=h&port=1&secret=" + secret,
+		"tg://proxy?server=h&secret=" + secret,
+		"tg://proxy?server=h&port=0&secret=" + secret,
+		"tg://proxy?server=h&port=65536&secret=" + secret,
+		"tg://proxy?server=h&port=port&secret=" + secret,
+		"tg://proxy?port=1&secret=" + secret,
+		"tg://proxy?server=h&port=1",
+		"%gh",
+	} {
+		if _, err := ParseProxyLink(link); err == nil {
+			t.Fatalf("%s accepted", link)
+		}
+	}
+}
+
+func TestParseProxySecretErrors(t *testing.T) {
+	for _, secret := range []string{
+		"",
+		"00112233445566778899aabbccddee",       // 15 bytes
+		"dd00112233445566778899aabbccddeeff00", // dd with 17 bytes
+		"ee00112233445566778899aabbccddeeff",   // ee without domain
+		"aa00112233445566778899aabbccddeeff",   // unknown prefix
+		"not a secret!",
+	} {
+		if proxy, err := ParseProxySecret(secret); err == nil {
+			t.Fatalf("%q accepted: %+v", secret, proxy)
+		}
+	}
+}
+
+// Server name of a ClientHello, parsed by crypto/tls
+func helloServerName(t *testing.T, hello []byte) string {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _ = client.Write(hello)
+		_, _ = io.Copy(io.Discard, client)
+	}()
+
+	errStop := errors.New("stop")
+	var serverName string
+	err := tls.Server(server, &tls.Config{GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverName = info.ServerName
+		return nil, errStop
+	}}).Handshake()
+	if !errors.Is(err, errStop) {
+		t.Fatal("ClientHello not parsed:", err)
+	}
+	return serverName
+}
+
+// Fake TLS proxy: check the ClientHello, answer with a ServerHello signed with secret.
+// It returns the ClientHello (it can run in another goroutine, so it doesn't stop the test).
+func fakeTLSProxy(t *testing.T, conn net.Conn, secret []byte, tamper func(answer []byte)) []byte {
+	t.Helper()
+
+	hello := make([]byte, fakeTLSHelloLength)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		t.Error(err)
+		return hello
+	}
+
+	// random = HMAC-SHA256(secret, hello with zero random), last 4 bytes xored with the timestamp
+	random := append([]byte{}, hello[11:43]...)
+	zeroed := append([]byte{}, hello...)
+	copy(zeroed[11:43], make([]byte, 32))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(zeroed)
+	expected := mac.Sum(nil)
+	if !bytes.Equal(expected[:28], random[:28]) {
+		t.Error("wrong ClientHello HMAC")
+	}
+	timestamp := int64(binary.LittleEndian.Uint32(expected[28:]) ^ binary.LittleEndian.Uint32(random[28:]))
+	if now := time.Now().Unix(); timestamp < now-5 || timestamp > now+5 {
+		t.Errorf("wrong timestamp %d", timestamp)
+	}
+
+	// ServerHello, ChangeCipherSpec and application data, random = HMAC-SHA256(secret, client random + answer)
+	answer := append([]byte{tlsRecordHandshake, 0x03, 0x03, 0x00, 0x40}, bytes.Repeat([]byte{1}, 0x40)...)
+	answer = append(answer, tlsChangeCipherSpec...)
+	answer = append(answer, tlsRecordApplicationData, 0x03, 0x03, 0x00, 0x20)
+	answer = append(answer, bytes.Repeat([]byte{2}, 0x20)...)
+	copy(answer[11:43], make([]byte, 32))
+
+	mac = hmac.New(sha256.New, secret)
+	mac.Write(random)
+	mac.Write(answer)
+	copy(answer[11:43], mac.Sum(nil))
+
+	if tamper != nil {
+		tamper(answer)
+	}
+	// The client may close the connection before the end of a wrong answer
+	_, _ = conn.Write(answer)
+
+	return hello
+}
+
+func TestFakeTLSHandshake(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		tamper func(answer []byte)
+		err    string
+	}{
+		{"valid", nil, ""},
+		{"server random", func(answer []byte) { answer[20] ^= 1 }, "verification failed"},
+		{"ServerHello", func(answer []byte) { answer[60] ^= 1 }, "verification failed"},
+		{"application data", func(answer []byte) { answer[len(answer)-1] ^= 1 }, "verification failed"},
+		{"record type", func(answer []byte) { answer[0] = tlsRecordApplicationData }, "unexpected"},
+		{"record version", func(answer []byte) { answer[2] = 0x01 }, "version"},
+	} {
+		client, server := net.Pipe()
+
+		done := make(chan []byte, 1)
+		go func() {
+			done <- fakeTLSProxy(t, server, testProxySecret, test.tamper)
+		}()
+
+		conn, err := fakeTLSHandshake(client, testProxySecret, "example.com")
+		_ = client.Close() // unblock the proxy if the answer has been rejected before its end
+		hello := <-done
+		_ = server.Close()
+
+		if test.err == "" {
+			if err != nil || conn == nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if name := helloServerName(t, hello); name != "example.com" {
+				t.Fatalf("server name %q", name)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestFakeTLSRecords(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn := &fakeTLSConn{conn: client}
+	data := bytes.Repeat([]byte{1, 2, 3, 4}, fakeTLSMaxRecord/2) // split in two records
+
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.write(data)
+	}()
+
+	ccs := make([]byte, len(tlsChangeCipherSpec))
+	if _, err := io.ReadFull(server, ccs); err != nil || !bytes.Equal(ccs, tlsChangeCipherSpec) {
+		t.Fatal("ChangeCipherSpec not sent first", err)
+	}
+	var received []byte
+	for len(received) < len(data) {
+		header, payload, err := readTLSRecord(server)
+		if err != nil || header[0] != tlsRecordApplicationData || len(payload) > fakeTLSMaxRecord {
+			t.Fatal(header, err)
+		}
+		received = append(received, payload...)
+	}
+	if err := <-done; err != nil || !bytes.Equal(received, data) {
+		t.Fatal("wrong application data", err)
+	}
+
+	// Reads span records
+	go func() {
+		_, _ = server.Write([]byte{tlsRecordApplicationData, 0x03, 0x03, 0x00, 0x03, 1, 2, 3})
+		_, _ = server.Write([]byte{tlsRecordApplicationData, 0x03, 0x03, 0x00, 0x02, 4, 5})
+		_, _ = server.Write([]byte{tlsRecordHandshake, 0x03, 0x03, 0x00, 0x01, 6})
+	}()
+	if got, err := conn.read(4); err != nil || !bytes.Equal(got, []byte{1, 2, 3, 4}) {
+		t.Fatal(got, err)
+	}
+	if got, err := conn.read(1); err != nil || !bytes.Equal(got, []byte{5}) {
+		t.Fatal(got, err)
+	}
+	if _, err := conn.read(1); err == nil {
+		t.Fatal("handshake record accepted as data")
+	}
+}
+
+func TestConnectFakeTLSProxy(t *testing.T) {
+	proxy, err := ParseProxyLink("tg://proxy?server=proxy&port=443&secret=ee00112233445566778899aabbccddeeff6578616d706c652e636f6d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tamper := range []bool{false, true} {
+		dialer := pipeDialerNew()
+		client := &PaddedIntermediate{Dialer: dialer}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- client.ConnectProxyContext(context.Background(), proxy, -2)
+		}()
+
+		server := <-dialer.servers
+		var tamperFunc func([]byte)
+		if tamper {
+			tamperFunc = func(answer []byte) { answer[11] ^= 1 }
+		}
+		hello := fakeTLSProxy(t, server, proxy.Secret, tamperFunc)
+		if name := helloServerName(t, hello); name != proxy.Domain {
+			t.Fatalf("server name %q", name)
+		}
+
+		if tamper {
+			if err := <-done; err == nil {
+				t.Fatal("tampered ServerHello accepted")
+			}
+			_ = server.Close()
+			continue
+		}
+
+		// ChangeCipherSpec and the obfuscation init inside an application data record
+		ccs := make([]byte, len(tlsChangeCipherSpec))
+		if _, err := io.ReadFull(server, ccs); err != nil || !bytes.Equal(ccs, tlsChangeCipherSpec) {
+			t.Fatal("ChangeCipherSpec not sent", err)
+		}
+		_, init, err := readTLSRecord(server)
+		if err != nil || len(init) != 64 {
+			t.Fatal(len(init), err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		// Decrypt the init with the proxy secret: PaddedIntermediate tag and DC -2
+		key := sha256.Sum256(append(append([]byte{}, init[8:40]...), proxy.Secret...))
+		decrypted := append([]byte{}, init...)
+		aes.AES256CTRNew(key[:], init[40:56]).EncryptDecrypt(decrypted)
+		if !bytes.Equal(decrypted[56:60], []byte{0xDD, 0xDD, 0xDD, 0xDD}) || int16(binary.LittleEndian.Uint16(decrypted[60:62])) != -2 {
+			t.Fatalf("wrong init %x", decrypted[56:64])
+		}
+
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
@@ -17,9 +17,10 @@
 package tcp
 
 import (
+	"context"
 	"encoding/binary"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto"
 	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto/aes"
-	"math/rand"
 )
 
 // Padded intermediate
@@ -30,44 +31,66 @@ import (
 // Minimum envelope length: random
 // Maximum envelope length: random
 type PaddedIntermediate struct{
-	*tcpConnection                  // TCP connection
+	*tcpConnection                  // connection (TCP, proxy or any net.Conn)
 	encrypt, decrypt *aes.AES256CTR // AES-256 CTR encrypt/decrypt (only with obfuscation true)
+	Dialer           Dialer         // dialer of the connection (nil for a direct TCP connection)
+	Timeouts         Timeouts       // dial, handshake and idle timeouts (zero for none)
+	QuickAck         func(uint32)   // called with the quick ACK tokens received from the server (optional)
 }
 
 func (pad *PaddedIntermediate) Connect(address string, obfuscation bool) error {
-	pad.tcpConnection = tcpNew()
+	return pad.ConnectContext(context.Background(), address, obfuscation)
+}
+
+// Connect within ctx and the dial and handshake timeouts
+func (pad *PaddedIntermediate) ConnectContext(ctx context.Context, address string, obfuscation bool) error {
+	pad.tcpConnection = tcpNew(pad.Dialer, pad.Timeouts)
 
-	err := pad.tcpConnection.connect(address)
+	err := pad.tcpConnection.connect(ctx, address)
 	if err != nil {
 		return err
 	}
 
-	if obfuscation {
-		nonce, reversedNonce := obfuscationCTRGenerator(0xDD)
-
-		pad.encrypt = aes.AES256CTRNew(nonce[8:40], nonce[40:56])
-		pad.decrypt = aes.AES256CTRNew(reversedNonce[8:40], reversedNonce[40:56])
+	return pad.tcpConnection.handshake(ctx, func() error {
+		if obfuscation {
+			var err error
+			pad.encrypt, pad.decrypt, err = pad.tcpConnection.obfuscate(0xDD, nil, 0)
+			return err
+		}
 
-		// Add aes encrypted to nonce
-		aesNonce := make([]byte, 64); copy(aesNonce, nonce)
-		pad.encrypt.EncryptDecrypt(aesNonce)
-
-		// Send encrypted nonce to server (when connect)
-		err = pad.tcpConnection.sendAll(append(nonce[:56], aesNonce[56:64]...))
-	} else {
 		// Telegram docs:
 		// Before sending anything into the underlying socket (see transports), the client must first send 0xdddddddd as the first int (four bytes, the server will not send 0xdddddddd as the first int in the first reply).
-		err = pad.tcpConnection.sendAll([]byte{0xDD, 0xDD, 0xDD, 0xDD})
-	}
+		return pad.tcpConnection.sendAll([]byte{0xDD, 0xDD, 0xDD, 0xDD})
+	})
+}
 
+// Padded intermediate TCP transport through an MTProxy (any secret type)
+// dcID is the destination DC (negative for media DCs)
+func (pad *PaddedIntermediate) ConnectProxy(proxy *MTProxy, dcID int16) error {
+	return pad.ConnectProxyContext(context.Background(), proxy, dcID)
+}
+
+// Connect through an MTProxy within ctx and the dial and handshake timeouts
+func (pad *PaddedIntermediate) ConnectProxyContext(ctx context.Context, proxy *MTProxy, dcID int16) error {
+	pad.tcpConnection = tcpNew(pad.Dialer, pad.Timeouts)
+
+	err := pad.tcpConnection.connect(ctx, proxy.Address())
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return pad.tcpConnection.handshake(ctx, func() error {
+		err := pad.tcpConnection.proxyHandshake(proxy)
+		if err != nil {
+			return err
+		}
+
+		pad.encrypt, pad.decrypt, err = pad.tcpConnection.obfuscate(0xDD, proxy.Secret, dcID)
+		return err
+	})
 }
 
-// Send data to Telegram server using Intermediate TCP
+// Write a frame using Padded intermediate TCP
 //
 // +----+----...----+----...----+
 // |tLen|  payload  |  padding  |
@@ -76,16 +99,55 @@ func (pad *PaddedIntermediate) Connect(address string, obfuscation bool) error {
 // Total length: payload+padding length encoded as 4 length bytes (little endian)
 // Payload: the MTProto payload
 // Padding: A random padding string of length 0-15
-func (pad *PaddedIntermediate) Send(data []byte) error {
+func (pad *PaddedIntermediate) WriteFrame(data []byte) error {
+	return pad.WriteFrameContext(context.Background(), data)
+}
+
+// Write a frame within ctx and the idle timeout
+func (pad *PaddedIntermediate) WriteFrameContext(ctx context.Context, data []byte) error {
+	if pad.tcpConnection == nil {
+		return ErrNotConnected
+	}
+
+	return pad.tcpConnection.writeFrameContext(ctx, data, func() error {
+		return pad.writeFrame(data, false)
+	})
+}
+
+// Write a frame and request a quick ACK, the server token is passed to QuickAck
+func (pad *PaddedIntermediate) WriteFrameQuickAck(ctx context.Context, data []byte) error {
+	if pad.tcpConnection == nil {
+		return ErrNotConnected
+	}
+
+	return pad.tcpConnection.writeFrameContext(ctx, data, func() error {
+		return pad.writeFrame(data, true)
+	})
+}
+
+// Encode, encrypt and send a frame
+// quickAck sets the most significant bit of the length
+func (pad *PaddedIntermediate) writeFrame(data []byte, quickAck bool) error {
 	// Generate a random number between 0 and 15
-	padding := make([]byte, rand.Intn(16))
+	paddingLength, err := crypto.RandomInt(16)
+	if err != nil {
+		return err
+	}
+
+	padding := make([]byte, paddingLength)
 	if len(padding) != 0 {
-		rand.Read(padding)
+		_, err = crypto.ReadRandom(padding)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Parse length to 4 bytes slice
 	length := make([]byte, 4)
 	binary.LittleEndian.PutUint32(length, uint32(len(data) + len(padding)))
+	if quickAck {
+		length[3] |= 0x80
+	}
 
 	// Add data and padding
 	data = append(append(length, data...), padding...)
@@ -94,7 +156,7 @@ func (pad *PaddedIntermediate) Send(data []byte) error {
 		pad.encrypt.EncryptDecrypt(data)
 	}
 
-	err := pad.tcpConnection.sendAll(data)
+	err = pad.tcpConnection.sendAll(data)
 	if err != nil {
 		return err
 	}
@@ -102,15 +164,50 @@ func (pad *PaddedIntermediate) Send(data []byte) error {
 	return nil
 }
 
-// Receive n data to Telegram server using Intermediate TCP
+// Read a frame using Padded intermediate TCP (the frame includes the random padding, ignored by MTProto)
 //
 // +----+----...----+----...----+
 // |tLen|  payload  |  padding  |
 // +----+----...----+----...----+
-func (pad *PaddedIntermediate) Receive(data []byte) error {
+func (pad *PaddedIntermediate) ReadFrame() ([]byte, error) {
+	return pad.ReadFrameContext(context.Background())
+}
+
+// Read a frame within ctx and the idle timeout
+func (pad *PaddedIntermediate) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	if pad.tcpConnection == nil {
+		return nil, ErrNotConnected
+	}
+
+	data, _, err := pad.tcpConnection.readFrameContext(ctx, pad.readFrame, pad.QuickAck)
+	return data, err
+}
+
+// Read a frame received by the server, quickAck is true if the client has requested a quick ACK
+func (pad *PaddedIntermediate) readFrameQuickAck(ctx context.Context) ([]byte, bool, error) {
+	return pad.tcpConnection.readFrameContext(ctx, pad.readFrame, nil)
+}
+
+// Send a quick ACK token to the client (4 bytes, little endian)
+func (pad *PaddedIntermediate) writeQuickAck(ctx context.Context, token uint32) error {
+	return pad.tcpConnection.writeFrameContext(ctx, nil, func() error {
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, token|0x80000000)
+
+		if pad.encrypt != nil {
+			pad.encrypt.EncryptDecrypt(data)
+		}
+
+		return pad.tcpConnection.sendAll(data)
+	})
+}
+
+// Receive, decrypt and decode a frame
+// The most significant bit of the length is a quick ACK request (server) or a quick ACK token (client)
+func (pad *PaddedIntermediate) readFrame() ([]byte, bool, error) {
 	length, err := pad.tcpConnection.receiveAll(4)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
 	// Decrypt length
@@ -118,13 +215,28 @@ func (pad *PaddedIntermediate) Receive(data []byte) error {
 		pad.decrypt.EncryptDecrypt(length)
 	}
 
+	quickAck := length[3] & 0x80 != 0
+
+	// Quick ACK token: the length itself
+	if quickAck && !pad.tcpConnection.server {
+		token := make([]byte, 4)
+		binary.BigEndian.PutUint32(token, binary.LittleEndian.Uint32(length))
+		return token, true, nil
+	}
+
+	length[3] &= 0x7F
+
 	// Get length of data as int
 	lenInt := int(binary.LittleEndian.Uint32(length))
 
+	if lenInt > MaxFrameSize {
+		return nil, false, ErrFrameTooLarge
+	}
+
 	// Get n bytes
-	data, err = pad.tcpConnection.receiveAll(lenInt)
+	data, err := pad.tcpConnection.receiveAll(lenInt)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
 	// Decrypt received data
@@ -132,5 +244,5 @@ func (pad *PaddedIntermediate) Receive(data []byte) error {
 		pad.decrypt.EncryptDecrypt(data)
 	}
 
-	return nil
+	return data, quickAck, nil
 }
\ No newline at end of file
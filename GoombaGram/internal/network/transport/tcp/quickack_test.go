@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// Client transport with quick ACK
+type quickAckTransport interface {
+	testTransport
+	WriteFrameQuickAck(ctx context.Context, data []byte) error
+}
+
+func TestQuickAck(t *testing.T) {
+	const token = 0x81234567
+	framings := []string{"abridged", "intermediate", "paddedIntermediate"}
+
+	for _, framing := range framings {
+		for _, obfuscation := range []bool{false, true} {
+			for _, size := range []int{16, 1000} {
+				dialer := pipeDialerNew()
+				tokens := make(chan uint32, 1)
+				quickAck := func(token uint32) { tokens <- token }
+
+				var client quickAckTransport
+				switch framing {
+				case "abridged":
+					client = &Abridged{Dialer: dialer, QuickAck: quickAck}
+				case "intermediate":
+					client = &Intermediate{Dialer: dialer, QuickAck: quickAck}
+				default:
+					client = &PaddedIntermediate{Dialer: dialer, QuickAck: quickAck}
+				}
+
+				servers := make(chan *ServerConnection, 1)
+				go func() {
+					server, err := ServerConnectionNew(<-dialer.servers, nil)
+					if err != nil {
+						t.Error(err)
+					}
+					servers <- server
+				}()
+
+				ctx := context.Background()
+				if err := client.ConnectContext(ctx, "pipe", obfuscation); err != nil {
+					t.Fatal(err)
+				}
+				server := <-servers
+
+				want := bytes.Repeat([]byte{3}, size)
+
+				// Quick ACK requested
+				done := make(chan error, 1)
+				go func() { done <- client.WriteFrameQuickAck(ctx, want) }()
+				data, ack, err := server.ReadFrameQuickAck(ctx)
+				if err != nil || !ack {
+					t.Fatalf("%s obfuscated=%v size %d: ack=%v %v", framing, obfuscation, size, ack, err)
+				}
+				<-done
+				checkFrame(t, framing, data, want)
+
+				// Quick ACK not requested
+				go func() { done <- client.WriteFrame(want) }()
+				data, ack, err = server.ReadFrameQuickAck(ctx)
+				if err != nil || ack {
+					t.Fatalf("%s obfuscated=%v size %d: ack=%v %v", framing, obfuscation, size, ack, err)
+				}
+				<-done
+				checkFrame(t, framing, data, want)
+
+				// The token goes to QuickAck, ReadFrame returns the next frame
+				go func() {
+					err := server.WriteQuickAck(ctx, token)
+					if err == nil {
+						err = server.WriteFrame([]byte("response"))
+					}
+					done <- err
+				}()
+				data, err = client.ReadFrame()
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkFrame(t, framing, data, []byte("response"))
+				if err := <-done; err != nil {
+					t.Fatal(err)
+				}
+				if got := <-tokens; got != token {
+					t.Fatalf("%s: token %#x received", framing, got)
+				}
+
+				_ = client.Close()
+			}
+		}
+	}
+}
+
+func TestQuickAckWithoutCallback(t *testing.T) {
+	client, server := connectPipe(t, "intermediate", true)
+
+	done := make(chan error, 1)
+	go func() {
+		err := server().WriteQuickAck(context.Background(), 0x80000001)
+		if err == nil {
+			err = server().WriteFrame([]byte("response"))
+		}
+		done <- err
+	}()
+
+	data, err := client.ReadFrame()
+	if err != nil || string(data) != "response" {
+		t.Fatal(data, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuickAckFull(t *testing.T) {
+	client, server := connectPipe(t, "full", false)
+
+	go func() { _ = client.WriteFrame([]byte("detect the transport")) }()
+	if _, err := server().ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server().WriteQuickAck(context.Background(), 0x80000001); err == nil {
+		t.Fatal("full transport has no quick ACK")
+	}
+}
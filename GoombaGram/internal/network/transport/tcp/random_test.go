@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto"
+)
+
+// Run f twice with the same deterministic source, it returns both results
+func reproduce(t *testing.T, f func(t *testing.T) []byte) (first, second []byte) {
+	t.Helper()
+
+	var results [][]byte
+	for i := 0; i < 2; i++ {
+		t.Run("", func(t *testing.T) {
+			t.Cleanup(crypto.SetRandomSource(crypto.DeterministicSource([]byte("test vector"))))
+			results = append(results, f(t))
+		})
+	}
+	if len(results) != 2 {
+		t.FailNow()
+	}
+
+	return results[0], results[1]
+}
+
+func TestObfuscationNonceReproducible(t *testing.T) {
+	generate := func(t *testing.T) []byte {
+		nonce, reversed, err := obfuscationCTRGenerator(0xDD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range nonce {
+			if reversed[63-i] != nonce[i] {
+				t.Fatal("wrong reversed nonce")
+			}
+		}
+		return nonce
+	}
+
+	first, second := reproduce(t, generate)
+	if !bytes.Equal(first, second) || !bytes.Equal(first[56:60], []byte{0xDD, 0xDD, 0xDD, 0xDD}) {
+		t.Fatalf("nonces %x and %x", first, second)
+	}
+
+	if other := generate(t); bytes.Equal(other, first) {
+		t.Fatal("same nonce with crypto/rand")
+	}
+}
+
+func TestObfuscationNonceFilter(t *testing.T) {
+	good := bytes.Repeat([]byte{0x42}, 64)
+
+	// Nonces the server would take for another protocol
+	var source []byte
+	for _, prefix := range [][]byte{
+		{0xEF, 1, 1, 1},
+		[]byte("HEAD"), []byte("POST"), []byte("GET "), []byte("OPTI"), []byte("PVrG"),
+		{0xEE, 0xEE, 0xEE, 0xEE}, {0xDD, 0xDD, 0xDD, 0xDD},
+		{0x16, 0x03, 0x01, 0x02},
+		{1, 1, 1, 1, 0, 0, 0, 0},
+	} {
+		bad := append([]byte{}, good...)
+		copy(bad, prefix)
+		source = append(source, bad...)
+	}
+	source = append(source, good...)
+
+	t.Cleanup(crypto.SetRandomSource(bytes.NewReader(source)))
+	nonce, _, err := obfuscationCTRGenerator(0xEF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(nonce[:56], good[:56]) || !bytes.Equal(nonce[60:], good[60:]) {
+		t.Fatalf("nonce %x accepted", nonce)
+	}
+}
+
+func TestObfuscationNonceSourceError(t *testing.T) {
+	t.Cleanup(crypto.SetRandomSource(bytes.NewReader(make([]byte, 10))))
+	if _, _, err := obfuscationCTRGenerator(0xEF); err == nil {
+		t.Fatal("no error from a short source")
+	}
+
+	client := &Abridged{Dialer: pipeDialerNew()}
+	if err := client.Connect("149.154.167.50:443", true); err == nil {
+		_ = client.Close()
+		t.Fatal("connected without a nonce")
+	}
+}
+
+func TestPaddingReproducible(t *testing.T) {
+	payload := bytes.Repeat([]byte{1, 2, 3, 4}, 10)
+
+	send := func(t *testing.T) []byte {
+		dialer := pipeDialerNew()
+		client := &PaddedIntermediate{Dialer: dialer}
+
+		done := make(chan error, 1)
+		go func() {
+			err := client.Connect("149.154.167.50:443", false)
+			if err == nil {
+				err = client.WriteFrame(payload)
+			}
+			done <- err
+		}()
+
+		server := <-dialer.servers
+		defer server.Close()
+		defer func() { _ = client.Close() }()
+
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(server, header); err != nil {
+			t.Fatal(err)
+		}
+		frame := make([]byte, binary.LittleEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(server, frame); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(frame[:len(payload)], payload) || len(frame)-len(payload) > 15 {
+			t.Fatalf("frame %x", frame)
+		}
+		return frame
+	}
+
+	first, second := reproduce(t, send)
+	if !bytes.Equal(first, second) {
+		t.Fatalf("padded frames %x and %x", first, second)
+	}
+}
+
+func TestFakeTLSHelloReproducible(t *testing.T) {
+	hello := func(t *testing.T) []byte {
+		data, err := fakeTLSClientHello("example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// Record and handshake headers, zero random, session id and the GREASE cipher suite
+	// (the x25519 key share doesn't come from the entropy source)
+	first, second := reproduce(t, hello)
+	if !bytes.Equal(first[:80], second[:80]) {
+		t.Fatalf("hellos %x and %x", first[:80], second[:80])
+	}
+	if first[43] != 32 || !bytes.Equal(first[11:43], make([]byte, 32)) {
+		t.Fatalf("wrong random or session id %x", first[:80])
+	}
+
+	if other := hello(t); bytes.Equal(other[44:76], first[44:76]) {
+		t.Fatal("same session id with crypto/rand")
+	}
+}
@@ -0,0 +1,340 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto/aes"
+	"net"
+	"sync"
+	"time"
+)
+
+// Server side of the TCP transports, for local fake Telegram servers and MTProxy
+
+// Handshake timeout of the accepted connections if Timeouts.Handshake is zero
+const defaultServerHandshakeTimeout = 10 * time.Second
+
+// Transport frames, implemented by Abridged, Intermediate, PaddedIntermediate and Full
+type frameTransport interface {
+	WriteFrameContext(ctx context.Context, data []byte) error
+	ReadFrameContext(ctx context.Context) ([]byte, error)
+	readFrameQuickAck(ctx context.Context) ([]byte, bool, error)
+	writeQuickAck(ctx context.Context, token uint32) error
+}
+
+// Listener accepts Abridged, Intermediate, PaddedIntermediate (plain or obfuscated) and Full connections.
+// The transport of every connection is detected in its own goroutine, so a slow client doesn't block the others.
+type Listener struct {
+	Timeouts         Timeouts                         // handshake (10s if zero) and idle timeouts of the accepted connections
+	OnHandshakeError func(remote net.Addr, err error) // called when the handshake of a client fails (optional)
+
+	listener net.Listener
+	secret   []byte // MTProxy secret (16 bytes), only obfuscated connections are accepted
+
+	start    sync.Once
+	accepted chan *ServerConnection
+	stopped  chan struct{} // closed when the listener stops accepting connections
+	err      error         // error that stopped the listener
+}
+
+// Server connection, with the transport chosen by the client
+type ServerConnection struct {
+	conn       *tcpConnection
+	transport  frameTransport
+	protocol   byte // 0xEF (Abridged), 0xEE (Intermediate), 0xDD (PaddedIntermediate) or 0x00 (Full)
+	obfuscated bool
+	dcID       int16 // DC id from the obfuscation init (0 if not obfuscated)
+}
+
+// Listen for transport connections on a TCP address
+func Listen(address string) (*Listener, error) {
+	return ListenProxy(address, nil)
+}
+
+// Listen for MTProxy connections, obfuscation keys are derived from secret
+func ListenProxy(address string, secret []byte) (*Listener, error) {
+	if secret != nil && len(secret) != 16 {
+		return nil, errors.New("mtproxy secret must be 16 bytes long")
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return ListenerNew(listener, secret), nil
+}
+
+// Accept transport connections from any net.Listener (secret is nil if it isn't an MTProxy)
+func ListenerNew(listener net.Listener, secret []byte) *Listener {
+	return &Listener{
+		listener: listener,
+		secret:   secret,
+		accepted: make(chan *ServerConnection),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Listening address
+func (ln *Listener) Addr() net.Addr {
+	return ln.listener.Addr()
+}
+
+// Stop listening
+func (ln *Listener) Close() error {
+	return ln.listener.Close()
+}
+
+// Wait for a connection whose transport has been detected.
+// Connections are accepted from the first call, clients that fail the handshake are dropped
+// (see OnHandshakeError): only errors of the listener are returned.
+func (ln *Listener) Accept() (*ServerConnection, error) {
+	ln.start.Do(func() {
+		go ln.acceptLoop()
+	})
+
+	select {
+	case server := <-ln.accepted:
+		return server, nil
+	case <-ln.stopped:
+		return nil, ln.err
+	}
+}
+
+// Accept connections until the listener is closed, every handshake runs in its own goroutine
+func (ln *Listener) acceptLoop() {
+	timeouts := ln.Timeouts
+	if timeouts.Handshake <= 0 {
+		timeouts.Handshake = defaultServerHandshakeTimeout
+	}
+
+	for {
+		conn, err := ln.listener.Accept()
+		if err != nil {
+			ln.err = err
+			close(ln.stopped)
+			return
+		}
+
+		go ln.handshake(conn, timeouts)
+	}
+}
+
+func (ln *Listener) handshake(conn net.Conn, timeouts Timeouts) {
+	remote := conn.RemoteAddr()
+
+	server, err := ServerConnectionContext(context.Background(), conn, ln.secret, timeouts)
+	if err != nil {
+		_ = conn.Close()
+		if ln.OnHandshakeError != nil {
+			ln.OnHandshakeError(remote, err)
+		}
+		return
+	}
+
+	select {
+	case ln.accepted <- server:
+	case <-ln.stopped:
+		_ = server.Close()
+	}
+}
+
+// Server side of an established connection (secret is nil if it isn't an MTProxy)
+func ServerConnectionNew(conn net.Conn, secret []byte) (*ServerConnection, error) {
+	return ServerConnectionContext(context.Background(), conn, secret, Timeouts{})
+}
+
+// Server side of an established connection, the transport detection runs within ctx and the handshake timeout
+func ServerConnectionContext(ctx context.Context, conn net.Conn, secret []byte, timeouts Timeouts) (*ServerConnection, error) {
+	if secret != nil && len(secret) != 16 {
+		_ = conn.Close()
+		return nil, errors.New("mtproxy secret must be 16 bytes long")
+	}
+
+	tcpConn := tcpNew(nil, timeouts)
+	tcpConn.attach(conn)
+
+	var server *ServerConnection
+	err := tcpConn.handshake(ctx, func() error {
+		var err error
+		server, err = serverHandshake(tcpConn, secret)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// Read the first bytes sent by the client
+//
+// 0xef                  Abridged
+// 0xeeeeeeee            Intermediate
+// 0xdddddddd            PaddedIntermediate
+// 0x00000000 at 4-8     Full (no init, seqno 0 of the first frame)
+// 64 bytes random init  obfuscated, protocol in bytes 56-59
+func serverHandshake(tcpConn *tcpConnection, secret []byte) (*ServerConnection, error) {
+	if secret == nil {
+		first, err := tcpConn.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if first[0] == 0xEF {
+			_, err = tcpConn.reader.Discard(1)
+			if err != nil {
+				return nil, err
+			}
+			return serverTransportNew(tcpConn, 0xEF, nil, nil, false, 0)
+		}
+
+		header, err := tcpConn.reader.Peek(4)
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.Equal(header, []byte{0xEE, 0xEE, 0xEE, 0xEE}) || bytes.Equal(header, []byte{0xDD, 0xDD, 0xDD, 0xDD}) {
+			protocol := header[0]
+			_, err = tcpConn.reader.Discard(4)
+			if err != nil {
+				return nil, err
+			}
+			return serverTransportNew(tcpConn, protocol, nil, nil, false, 0)
+		}
+
+		// An obfuscated init never has zeros in bytes 4-8
+		header, err = tcpConn.reader.Peek(8)
+		if err != nil {
+			return nil, err
+		}
+
+		if binary.LittleEndian.Uint32(header[4:8]) == 0 {
+			return serverTransportNew(tcpConn, 0x00, nil, nil, false, 0)
+		}
+	}
+
+	nonce, err := tcpConn.receiveAll(64)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client encrypts with nonce[8:40] (key) and nonce[40:56] (iv),
+	// it decrypts with the same bytes reversed
+	reversedNonce := make([]byte, 64)
+	for i := 63; i >= 0; i-- {
+		reversedNonce[63-i] = nonce[i]
+	}
+
+	decryptKey, encryptKey := nonce[8:40], reversedNonce[8:40]
+	if secret != nil {
+		decryptHash := sha256.Sum256(append(append([]byte{}, decryptKey...), secret...))
+		encryptHash := sha256.Sum256(append(append([]byte{}, encryptKey...), secret...))
+		decryptKey, encryptKey = decryptHash[:], encryptHash[:]
+	}
+
+	decrypt := aes.AES256CTRNew(decryptKey, nonce[40:56])
+	encrypt := aes.AES256CTRNew(encryptKey, reversedNonce[40:56])
+
+	// Decrypt the whole init to read protocol and DC id
+	plainNonce := make([]byte, 64)
+	copy(plainNonce, nonce)
+	decrypt.EncryptDecrypt(plainNonce)
+
+	protocol := plainNonce[56]
+	if (protocol != 0xEF && protocol != 0xEE && protocol != 0xDD) || !bytes.Equal(plainNonce[56:60], []byte{protocol, protocol, protocol, protocol}) {
+		return nil, errors.New("unknown transport")
+	}
+
+	dcID := int16(binary.LittleEndian.Uint16(plainNonce[60:62]))
+	return serverTransportNew(tcpConn, protocol, encrypt, decrypt, true, dcID)
+}
+
+func serverTransportNew(tcpConn *tcpConnection, protocol byte, encrypt, decrypt *aes.AES256CTR, obfuscated bool, dcID int16) (*ServerConnection, error) {
+	server := &ServerConnection{conn: tcpConn, protocol: protocol, obfuscated: obfuscated, dcID: dcID}
+	tcpConn.server = true
+
+	switch protocol {
+	case 0xEF:
+		server.transport = &Abridged{tcpConnection: tcpConn, encrypt: encrypt, decrypt: decrypt}
+	case 0xEE:
+		server.transport = &Intermediate{tcpConnection: tcpConn, encrypt: encrypt, decrypt: decrypt}
+	case 0xDD:
+		server.transport = &PaddedIntermediate{tcpConnection: tcpConn, encrypt: encrypt, decrypt: decrypt}
+	case 0x00:
+		server.transport = &Full{tcpConnection: tcpConn}
+	default:
+		return nil, errors.New("unknown transport")
+	}
+
+	return server, nil
+}
+
+// Transport protocol: 0xEF (Abridged), 0xEE (Intermediate), 0xDD (PaddedIntermediate) or 0x00 (Full)
+func (server *ServerConnection) Protocol() byte {
+	return server.protocol
+}
+
+// Connection uses the obfuscation
+func (server *ServerConnection) Obfuscated() bool {
+	return server.obfuscated
+}
+
+// DC id requested by the client (only obfuscated connections)
+func (server *ServerConnection) DCID() int16 {
+	return server.dcID
+}
+
+// Send a frame to the client
+func (server *ServerConnection) WriteFrame(data []byte) error {
+	return server.transport.WriteFrameContext(context.Background(), data)
+}
+
+// Send a frame to the client within ctx and the idle timeout
+func (server *ServerConnection) WriteFrameContext(ctx context.Context, data []byte) error {
+	return server.transport.WriteFrameContext(ctx, data)
+}
+
+// Receive a frame from the client
+func (server *ServerConnection) ReadFrame() ([]byte, error) {
+	return server.transport.ReadFrameContext(context.Background())
+}
+
+// Receive a frame from the client within ctx and the idle timeout
+func (server *ServerConnection) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	return server.transport.ReadFrameContext(ctx)
+}
+
+// Receive a frame from the client, quickAck is true if the client has requested a quick ACK
+func (server *ServerConnection) ReadFrameQuickAck(ctx context.Context) ([]byte, bool, error) {
+	return server.transport.readFrameQuickAck(ctx)
+}
+
+// Send a quick ACK token (its most significant bit must be set)
+func (server *ServerConnection) WriteQuickAck(ctx context.Context, token uint32) error {
+	return server.transport.writeQuickAck(ctx, token)
+}
+
+// Close the connection
+func (server *ServerConnection) Close() error {
+	return server.conn.close()
+}
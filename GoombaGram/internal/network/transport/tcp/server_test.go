@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tcp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T, timeouts Timeouts) (ln *Listener, handshakeErrors chan error) {
+	t.Helper()
+
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	handshakeErrors = make(chan error, 10)
+	ln.Timeouts = timeouts
+	ln.OnHandshakeError = func(remote net.Addr, err error) {
+		handshakeErrors <- err
+	}
+
+	return ln, handshakeErrors
+}
+
+// Accept a connection in background, wait fails if it isn't accepted within a second
+func acceptAsync(t *testing.T, ln *Listener) (wait func() *ServerConnection) {
+	type result struct {
+		server *ServerConnection
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		server, err := ln.Accept()
+		done <- result{server, err}
+	}()
+
+	return func() *ServerConnection {
+		t.Helper()
+
+		select {
+		case res := <-done:
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			return res.server
+		case <-time.After(time.Second):
+			t.Fatal("no connection accepted")
+			return nil
+		}
+	}
+}
+
+func TestListenerSlowClient(t *testing.T) {
+	ln, handshakeErrors := listen(t, Timeouts{Handshake: 100 * time.Millisecond})
+	accept := acceptAsync(t, ln)
+
+	// A client that never sends the init doesn't block the other ones
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	client := &Intermediate{}
+	if err := client.Connect(ln.Addr().String(), true); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server := accept()
+	defer server.Close()
+	if server.Protocol() != 0xEE || !server.Obfuscated() {
+		t.Fatalf("protocol %#x obfuscated=%v", server.Protocol(), server.Obfuscated())
+	}
+
+	// The silent client is dropped after the handshake timeout
+	select {
+	case err := <-handshakeErrors:
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("silent client not dropped")
+	}
+
+	_ = silent.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err == nil {
+		t.Fatal("silent client still connected")
+	}
+}
+
+func TestListenerHandshakeError(t *testing.T) {
+	ln, handshakeErrors := listen(t, Timeouts{})
+	accept := acceptAsync(t, ln)
+
+	// Obfuscation init with an unknown protocol
+	bad, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	if _, err := bad.Write(bytes.Repeat([]byte{1}, 64)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-handshakeErrors:
+		if err == nil {
+			t.Fatal("nil handshake error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handshake error not reported")
+	}
+
+	// Accept goes on with the next client
+	client := &Abridged{}
+	if err := client.Connect(ln.Addr().String(), false); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	done := writeAsync(client.WriteFrame, []byte("abcd"))
+	server := accept()
+	defer server.Close()
+
+	data, err := server.ReadFrame()
+	if err != nil || string(data) != "abcd" {
+		t.Fatal(data, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	ln, _ := listen(t, Timeouts{})
+
+	// Connection not accepted yet
+	client := &Abridged{}
+	if err := client.Connect(ln.Addr().String(), true); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		for err == nil {
+			_, err = ln.Accept()
+		}
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept not stopped by Close")
+	}
+
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal(err)
+	}
+}
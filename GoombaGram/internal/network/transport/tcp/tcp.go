@@ -18,41 +18,249 @@
 package tcp
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
-	"math/rand"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto/aes"
+	"io"
 	"net"
+	"sync"
+	"time"
 )
 
+// Maximum length of a frame payload, bigger frames are rejected
+const MaxFrameSize = 16 * 1024 * 1024
+
+var (
+	ErrFrameTooLarge = errors.New("frame is too large")
+	ErrNotConnected  = errors.New("tcp hasn't been connected")
+)
+
+// Transport timeouts, zero means no timeout
+type Timeouts struct{
+	Dial      time.Duration // connection by the Dialer (proxy handshake included)
+	Handshake time.Duration // fake TLS and transport init
+	Idle      time.Duration // maximum time to read or write a frame (unless the context deadline is nearer)
+}
+
+// Connection parts that a deadline applies to
+const (
+	deadlineRead = iota
+	deadlineWrite
+	deadlineBoth
+)
+
+// Dialer opens the connection used by a transport (net.Dialer, proxy.Config, TLS, in-memory pipes...)
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
 type tcpConnection struct{
-	*net.TCPConn
+	net.Conn
+	dialer    Dialer        // net.Dialer by default
+	timeouts  Timeouts
+	reader    *bufio.Reader // buffered reader of Conn
+	fakeTLS   *fakeTLSConn  // fake TLS layer (only MTProxy with ee secret)
+	readLock  sync.Mutex    // a frame is read (and decrypted) by one goroutine at a time
+	writeLock sync.Mutex    // a frame is encrypted and written by one goroutine at a time
+	server    bool          // server side (quick ACK requests are received, tokens are sent)
 }
 
-func tcpNew() *tcpConnection {
+func tcpNew(dialer Dialer, timeouts Timeouts) *tcpConnection {
 	tcpNew := new(tcpConnection)
+	tcpNew.dialer = dialer
+	tcpNew.timeouts = timeouts
+	if tcpNew.dialer == nil {
+		tcpNew.dialer = new(net.Dialer)
+	}
 	return tcpNew
 }
 
-func (tcpConn *tcpConnection) connect(address string) error {
-	remoteAddress, err := net.ResolveTCPAddr("tcp", address)
+// Dial address, within the dial timeout
+func (tcpConn *tcpConnection) connect(ctx context.Context, address string) error {
+	if tcpConn.timeouts.Dial > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tcpConn.timeouts.Dial)
+		defer cancel()
+	}
+
+	conn, err := tcpConn.dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return err
 	}
 
-	tcpConn.TCPConn, err = net.DialTCP("tcp", nil, remoteAddress)
+	tcpConn.attach(conn)
+	return nil
+}
+
+// Use an established connection
+func (tcpConn *tcpConnection) attach(conn net.Conn) {
+	tcpConn.Conn = conn
+	tcpConn.reader = bufio.NewReader(conn)
+}
+
+// Buffered reader and raw writer of the connection
+func (tcpConn *tcpConnection) stream() io.ReadWriter {
+	return struct{
+		io.Reader
+		io.Writer
+	}{tcpConn.reader, tcpConn.Conn}
+}
+
+// Run the connection init within the handshake timeout, the connection is closed if it fails
+func (tcpConn *tcpConnection) handshake(ctx context.Context, init func() error) error {
+	finish := tcpConn.deadline(ctx, deadlineBoth, tcpConn.timeouts.Handshake)
+
+	err := finish(init())
 	if err != nil {
+		_ = tcpConn.Conn.Close()
 		return err
 	}
 
-	return nil
+	return tcpConn.Conn.SetDeadline(time.Time{})
+}
+
+// Fake TLS handshake with an MTProxy, if required by the secret
+func (tcpConn *tcpConnection) proxyHandshake(proxy *MTProxy) error {
+	if proxy.Mode != ProxyFakeTLS {
+		return nil
+	}
+
+	var err error
+	tcpConn.fakeTLS, err = fakeTLSHandshake(tcpConn.stream(), proxy.Secret, proxy.Domain)
+	return err
+}
+
+// Bind an operation to ctx and timeout.
+// The nearest of the ctx deadline and timeout becomes the connection deadline, cancelling ctx closes
+// the connection to unblock the operation. finish must be called with the operation result: it returns
+// ctx.Err() if ctx has been cancelled and it closes the connection after a timeout, because a frame
+// could have been read or written partially.
+func (tcpConn *tcpConnection) deadline(ctx context.Context, part int, timeout time.Duration) (finish func(err error) error) {
+	conn := tcpConn.Conn
+	if conn == nil {
+		return func(err error) error { return err }
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if timeout > 0 {
+		timeoutDeadline := time.Now().Add(timeout)
+		if !hasDeadline || timeoutDeadline.Before(deadline) {
+			deadline, hasDeadline = timeoutDeadline, true
+		}
+	}
+	if !hasDeadline {
+		deadline = time.Time{}
+	}
+
+	switch part {
+	case deadlineRead:
+		_ = conn.SetReadDeadline(deadline)
+	case deadlineWrite:
+		_ = conn.SetWriteDeadline(deadline)
+	default:
+		_ = conn.SetDeadline(deadline)
+	}
+
+	stop := func() bool { return true }
+	if ctx.Done() != nil {
+		stop = context.AfterFunc(ctx, func() {
+			_ = conn.Close()
+		})
+	}
+
+	return func(err error) error {
+		// The connection has been closed by ctx
+		if !stop() {
+			return ctx.Err()
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			_ = conn.Close()
+
+			// The deadline of ctx has been reached, but its timer hasn't cancelled it yet
+			if ctxDeadline, ok := ctx.Deadline(); ok && !time.Now().Before(ctxDeadline) {
+				return context.DeadlineExceeded
+			}
+		}
+
+		return err
+	}
+}
+
+// Write a frame within ctx and the idle timeout
+func (tcpConn *tcpConnection) writeFrameContext(ctx context.Context, data []byte, writeFrame func() error) error {
+	if len(data) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	tcpConn.writeLock.Lock()
+	defer tcpConn.writeLock.Unlock()
+
+	finish := tcpConn.deadline(ctx, deadlineWrite, tcpConn.timeouts.Idle)
+	return finish(writeFrame())
+}
+
+// Read a frame within ctx and the idle timeout.
+// readFrame returns if the quick ACK bit is set: on the client side the frame is a quick ACK token
+// (4 bytes, big endian), it's passed to quickAck and the next frame is read; on the server side
+// the client has requested a quick ACK of the frame.
+// Transport errors sent by the server are returned as *TransportError.
+func (tcpConn *tcpConnection) readFrameContext(ctx context.Context, readFrame func() ([]byte, bool, error), quickAck func(token uint32)) ([]byte, bool, error) {
+	tcpConn.readLock.Lock()
+	defer tcpConn.readLock.Unlock()
+
+	for {
+		finish := tcpConn.deadline(ctx, deadlineRead, tcpConn.timeouts.Idle)
+		data, quickAckBit, err := readFrame()
+		err = finish(err)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if tcpConn.server {
+			return data, quickAckBit, nil
+		}
+
+		if quickAckBit {
+			if quickAck != nil {
+				quickAck(binary.BigEndian.Uint32(data))
+			}
+			continue
+		}
+
+		// Server error instead of a payload (-404, -429...)
+		err = ParseTransportError(data)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return data, false, nil
+	}
 }
 
 func (tcpConn *tcpConnection) sendAll(data []byte) error {
-	if tcpConn.TCPConn == nil {
-		return errors.New("tcp hasn't been connected")
+	if tcpConn.Conn == nil {
+		return ErrNotConnected
 	}
 
-	_, err := tcpConn.TCPConn.Write(data)
+	if tcpConn.fakeTLS != nil {
+		return tcpConn.fakeTLS.write(data)
+	}
+
+	_, err := tcpConn.Conn.Write(data)
 
 	if err != nil {
 		return err
@@ -62,41 +270,43 @@ func (tcpConn *tcpConnection) sendAll(data []byte) error {
 }
 
 func (tcpConn *tcpConnection) receiveAll(length int) ([]byte, error) {
-	if tcpConn.TCPConn == nil {
-		return nil, errors.New("tcp hasn't been connected")
+	if tcpConn.Conn == nil {
+		return nil, ErrNotConnected
 	}
 
-	data := make([]byte, length)
-	num, err := tcpConn.TCPConn.Read(data)
+	if tcpConn.fakeTLS != nil {
+		return tcpConn.fakeTLS.read(length)
+	}
 
+	data := make([]byte, length)
+	_, err := io.ReadFull(tcpConn.reader, data)
 	if err != nil {
 		return nil, err
 	}
 
-	if length > num {
-		return nil, errors.New("some bytes are missing")
-	}
-
 	return data, nil
 }
 
 func (tcpConn *tcpConnection) close() error {
-	if tcpConn.TCPConn == nil {
-		return errors.New("tcp hasn't been connected")
+	if tcpConn.Conn == nil {
+		return ErrNotConnected
 	}
 
-	return tcpConn.TCPConn.Close()
+	return tcpConn.Conn.Close()
 }
 
-func obfuscationCTRGenerator (protocol byte) ([]byte, []byte) {
+func obfuscationCTRGenerator (protocol byte) ([]byte, []byte, error) {
 	nonce := make([]byte, 64)
 	for {
 		// 64 random bytes
-		rand.Read(nonce)
+		_, err := crypto.ReadRandom(nonce)
+		if err != nil {
+			return nil, nil, err
+		}
 
-		// first byte different from 0xEF, bytes 0-4 different from "HEAD", "POST", "GET", "PVrG", 0xEEEEEEEE, 0xDDDDDD, bytes 4-8 different from 0x00000000
+		// first byte different from 0xEF, bytes 0-4 different from "HEAD", "POST", "GET ", "OPTI", "PVrG", 0xEEEEEEEE, 0xDDDDDDDD, 0x02010316 (TLS), bytes 4-8 different from 0x00000000
 		firstFourInt := binary.LittleEndian.Uint32(nonce[:4])
-		if nonce[0] != 0xEF && firstFourInt != 0x44414548 && firstFourInt != 0x54534F50 && firstFourInt != 0x20544547 && firstFourInt != 0x4954504F && firstFourInt != 0xDDDDDDDD && firstFourInt != 0xEEEEEEEE && binary.LittleEndian.Uint32(nonce[4:8]) == 0x00000000 {
+		if nonce[0] != 0xEF && firstFourInt != 0x44414548 && firstFourInt != 0x54534F50 && firstFourInt != 0x20544547 && firstFourInt != 0x4954504F && firstFourInt != 0x47725650 && firstFourInt != 0xDDDDDDDD && firstFourInt != 0xEEEEEEEE && firstFourInt != 0x02010316 && binary.LittleEndian.Uint32(nonce[4:8]) != 0x00000000 {
 			nonce[56] = protocol; nonce[57] = protocol; nonce[58] = protocol; nonce[59] = protocol
 			break
 		}
@@ -108,5 +318,38 @@ func obfuscationCTRGenerator (protocol byte) ([]byte, []byte) {
 		reversedNonce[63-i] = nonce[i]
 	}
 
-	return nonce, reversedNonce
-}
\ No newline at end of file
+	return nonce, reversedNonce, nil
+}
+
+// Send the obfuscation init to the server and return the AES-256 CTR encrypt/decrypt
+// With an MTProxy the keys are SHA256(key + secret) and the DC id is in bytes 60-61
+func (tcpConn *tcpConnection) obfuscate(protocol byte, secret []byte, dcID int16) (*aes.AES256CTR, *aes.AES256CTR, error) {
+	nonce, reversedNonce, err := obfuscationCTRGenerator(protocol)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encryptKey, decryptKey := nonce[8:40], reversedNonce[8:40]
+	if secret != nil {
+		binary.LittleEndian.PutUint16(nonce[60:62], uint16(dcID))
+
+		encryptHash := sha256.Sum256(append(append([]byte{}, encryptKey...), secret...))
+		decryptHash := sha256.Sum256(append(append([]byte{}, decryptKey...), secret...))
+		encryptKey, decryptKey = encryptHash[:], decryptHash[:]
+	}
+
+	encrypt := aes.AES256CTRNew(encryptKey, nonce[40:56])
+	decrypt := aes.AES256CTRNew(decryptKey, reversedNonce[40:56])
+
+	// Add aes encrypted to nonce
+	aesNonce := make([]byte, 64); copy(aesNonce, nonce)
+	encrypt.EncryptDecrypt(aesNonce)
+
+	// Send encrypted nonce to server (when connect)
+	err = tcpConn.sendAll(append(nonce[:56], aesNonce[56:64]...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encrypt, decrypt, nil
+}
@@ -0,0 +1,365 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// https://tools.ietf.org/html/rfc6455
+
+// Accept key suffix (RFC 6455, section 1.3)
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Maximum length of a received message frame
+const maxPayload = 1 << 30
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Dialer of the TCP connection under the WebSocket
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Client WebSocket connection, binary messages are read and written as a byte stream (net.Conn)
+type Conn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	remaining uint64 // bytes left in the current data frame
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+	closeOnce sync.Once
+	closed    bool // close frame received
+}
+
+// Open a WebSocket connection to a ws:// or wss:// URL, with the binary subprotocol
+func Dial(ctx context.Context, dialer Dialer, tlsConfig *tls.Config, rawURL string, header http.Header) (*Conn, error) {
+	wsURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	address := wsURL.Host
+	switch wsURL.Scheme {
+	case "ws":
+		if wsURL.Port() == "" {
+			address = net.JoinHostPort(wsURL.Hostname(), "80")
+		}
+	case "wss":
+		if wsURL.Port() == "" {
+			address = net.JoinHostPort(wsURL.Hostname(), "443")
+		}
+	default:
+		return nil, errors.New("websocket: unsupported scheme " + wsURL.Scheme)
+	}
+
+	if dialer == nil {
+		dialer = new(net.Dialer)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Handshake within ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+
+	ws, err := handshake(ctx, conn, tlsConfig, wsURL, header)
+
+	// The connection has been closed or timed out by ctx
+	if !stop() || (err != nil && ctx.Err() != nil) {
+		err = ctx.Err()
+	} else if deadline, ok := ctx.Deadline(); ok && err != nil && !time.Now().Before(deadline) {
+		// The ctx deadline has been reached, but its timer hasn't cancelled it yet
+		err = context.DeadlineExceeded
+	}
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return ws, ws.conn.SetDeadline(time.Time{})
+}
+
+// TLS (wss) and HTTP upgrade
+func handshake(ctx context.Context, conn net.Conn, tlsConfig *tls.Config, wsURL *url.URL, header http.Header) (*Conn, error) {
+	if wsURL.Scheme == "wss" {
+		config := new(tls.Config)
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = wsURL.Hostname()
+		}
+
+		tlsConn := tls.Client(conn, config)
+		err := tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	keyBytes := make([]byte, 16)
+	_, err := crypto.ReadRandom(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	path := wsURL.RequestURI()
+	request := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + wsURL.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Protocol: binary\r\n"
+
+	for name, values := range header {
+		for _, value := range values {
+			request += name + ": " + value + "\r\n"
+		}
+	}
+	request += "\r\n"
+
+	_, err = conn.Write([]byte(request))
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("websocket: handshake failed, " + response.Status)
+	}
+
+	if !strings.EqualFold(response.Header.Get("Upgrade"), "websocket") || !strings.Contains(strings.ToLower(response.Header.Get("Connection")), "upgrade") {
+		return nil, errors.New("websocket: server didn't upgrade the connection")
+	}
+
+	accept := sha1.Sum([]byte(key + acceptGUID))
+	if response.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		return nil, errors.New("websocket: wrong Sec-WebSocket-Accept")
+	}
+
+	return &Conn{conn: conn, reader: reader}, nil
+}
+
+// Read data of binary messages
+func (ws *Conn) Read(b []byte) (int, error) {
+	ws.readLock.Lock()
+	defer ws.readLock.Unlock()
+
+	for ws.remaining == 0 {
+		if ws.closed {
+			return 0, io.EOF
+		}
+
+		err := ws.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > ws.remaining {
+		b = b[:ws.remaining]
+	}
+
+	n, err := ws.reader.Read(b)
+	ws.remaining -= uint64(n)
+	return n, err
+}
+
+// Read a frame header, control frames are handled here
+func (ws *Conn) nextFrame() error {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(ws.reader, header)
+	if err != nil {
+		return err
+	}
+
+	opcode := header[0] & 0x0F
+	if header[1]&0x80 != 0 {
+		return errors.New("websocket: masked frame from server")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(ws.reader, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(ws.reader, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if err != nil {
+		return err
+	}
+
+	if length > maxPayload {
+		return errors.New("websocket: frame is too large")
+	}
+
+	switch opcode {
+	case opBinary, opContinuation:
+		ws.remaining = length
+		return nil
+
+	case opClose, opPing, opPong:
+		if length > 125 {
+			return errors.New("websocket: control frame is too large")
+		}
+
+		payload := make([]byte, length)
+		_, err = io.ReadFull(ws.reader, payload)
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case opPing:
+			return ws.writeFrame(opPong, payload)
+		case opClose:
+			ws.closed = true
+			// Echo the status code
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			ws.closeOnce.Do(func() {
+				_ = ws.writeFrame(opClose, payload)
+			})
+		}
+		return nil
+
+	case opText:
+		return errors.New("websocket: unexpected text message")
+
+	default:
+		return errors.New("websocket: unknown opcode")
+	}
+}
+
+// Write b as one binary message
+func (ws *Conn) Write(b []byte) (int, error) {
+	err := ws.writeFrame(opBinary, b)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Send a masked frame
+func (ws *Conn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	switch length := len(payload); {
+	case length <= 125:
+		frame = append(frame, 0x80|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 0x80|126, byte(length>>8), byte(length))
+	default:
+		extended := make([]byte, 8)
+		binary.BigEndian.PutUint64(extended, uint64(length))
+		frame = append(append(frame, 0x80|127), extended...)
+	}
+
+	mask := make([]byte, 4)
+	_, err := crypto.ReadRandom(mask)
+	if err != nil {
+		return err
+	}
+	frame = append(frame, mask...)
+
+	start := len(frame)
+	frame = append(frame, payload...)
+	for i := range frame[start:] {
+		frame[start+i] ^= mask[i%4]
+	}
+
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+
+	_, err = ws.conn.Write(frame)
+	return err
+}
+
+// Send a close frame (normal closure) and close the connection
+func (ws *Conn) Close() error {
+	ws.closeOnce.Do(func() {
+		_ = ws.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = ws.writeFrame(opClose, []byte{0x03, 0xE8})
+	})
+
+	return ws.conn.Close()
+}
+
+func (ws *Conn) LocalAddr() net.Addr {
+	return ws.conn.LocalAddr()
+}
+
+func (ws *Conn) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
+
+func (ws *Conn) SetDeadline(t time.Time) error {
+	return ws.conn.SetDeadline(t)
+}
+
+func (ws *Conn) SetReadDeadline(t time.Time) error {
+	return ws.conn.SetReadDeadline(t)
+}
+
+func (ws *Conn) SetWriteDeadline(t time.Time) error {
+	return ws.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// https://core.telegram.org/mtproto/transports#websocket
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/network/transport/tcp"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// WebSocket
+//
+// MTProto over WebSocket (/apiws endpoints), as used by Telegram Web.
+// The obfuscated Intermediate or PaddedIntermediate framing of the tcp package is sent
+// inside binary messages, so obfuscation, AES-256 CTR and timeouts are the same.
+type WebSocket struct {
+	URL       string       // ws:// or wss:// URL (empty for wss://<address>/apiws)
+	Header    http.Header  // extra handshake headers (Origin, User-Agent...)
+	Padded    bool         // PaddedIntermediate instead of Intermediate framing
+	Dialer    tcp.Dialer   // dialer of the TCP connection (nil for a direct connection)
+	TLSConfig *tls.Config  // TLS configuration of wss (nil for the default)
+	Timeouts  tcp.Timeouts // dial (TCP, TLS and upgrade), handshake and idle timeouts
+	QuickAck  func(uint32) // called with the quick ACK tokens received from the server (optional)
+
+	transport frameTransport
+}
+
+// Transport used inside the WebSocket
+type frameTransport interface {
+	ConnectContext(ctx context.Context, address string, obfuscation bool) error
+	WriteFrameContext(ctx context.Context, data []byte) error
+	WriteFrameQuickAck(ctx context.Context, data []byte) error
+	ReadFrameContext(ctx context.Context) ([]byte, error)
+	Close() error
+}
+
+// Opens the WebSocket instead of a TCP connection
+type wsDialer struct {
+	ws *WebSocket
+}
+
+func (dialer wsDialer) DialContext(ctx context.Context, _, address string) (net.Conn, error) {
+	return Dial(ctx, dialer.ws.Dialer, dialer.ws.TLSConfig, dialer.ws.url(address), dialer.ws.Header)
+}
+
+// WebSocket URL, address is a host (venus.web.telegram.org) or a host:port
+func (ws *WebSocket) url(address string) string {
+	if ws.URL != "" {
+		return ws.URL
+	}
+
+	if host, port, err := net.SplitHostPort(address); err == nil && port == "443" {
+		address = host
+	}
+
+	return "wss://" + address + "/apiws"
+}
+
+// WebSocket transport, Telegram servers require obfuscation
+func (ws *WebSocket) Connect(address string, obfuscation bool) error {
+	return ws.ConnectContext(context.Background(), address, obfuscation)
+}
+
+// Connect within ctx and the dial and handshake timeouts
+func (ws *WebSocket) ConnectContext(ctx context.Context, address string, obfuscation bool) error {
+	if address == "" && ws.URL == "" {
+		return errors.New("websocket: address is missing")
+	}
+
+	if ws.URL != "" && !strings.HasPrefix(ws.URL, "ws://") && !strings.HasPrefix(ws.URL, "wss://") {
+		return errors.New("websocket: URL must be ws:// or wss://")
+	}
+
+	if ws.Padded {
+		ws.transport = &tcp.PaddedIntermediate{Dialer: wsDialer{ws}, Timeouts: ws.Timeouts, QuickAck: ws.QuickAck}
+	} else {
+		ws.transport = &tcp.Intermediate{Dialer: wsDialer{ws}, Timeouts: ws.Timeouts, QuickAck: ws.QuickAck}
+	}
+
+	err := ws.transport.ConnectContext(ctx, address, obfuscation)
+	if err != nil {
+		ws.transport = nil
+		return err
+	}
+
+	return nil
+}
+
+// Write a frame in a binary message
+func (ws *WebSocket) WriteFrame(data []byte) error {
+	return ws.WriteFrameContext(context.Background(), data)
+}
+
+// Write a frame within ctx and the idle timeout
+func (ws *WebSocket) WriteFrameContext(ctx context.Context, data []byte) error {
+	if ws.transport == nil {
+		return tcp.ErrNotConnected
+	}
+
+	return ws.transport.WriteFrameContext(ctx, data)
+}
+
+// Write a frame and request a quick ACK, the server token is passed to QuickAck
+func (ws *WebSocket) WriteFrameQuickAck(ctx context.Context, data []byte) error {
+	if ws.transport == nil {
+		return tcp.ErrNotConnected
+	}
+
+	return ws.transport.WriteFrameQuickAck(ctx, data)
+}
+
+// Read a frame (frames can span more messages)
+func (ws *WebSocket) ReadFrame() ([]byte, error) {
+	return ws.ReadFrameContext(context.Background())
+}
+
+// Read a frame within ctx and the idle timeout
+func (ws *WebSocket) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	if ws.transport == nil {
+		return nil, tcp.ErrNotConnected
+	}
+
+	return ws.transport.ReadFrameContext(ctx)
+}
+
+// Close the WebSocket
+func (ws *WebSocket) Close() error {
+	if ws.transport == nil {
+		return tcp.ErrNotConnected
+	}
+
+	return ws.transport.Close()
+}
@@ -0,0 +1,434 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/network/transport/tcp"
+)
+
+// Server side of a WebSocket: reads masked frames of the client, writes unmasked frames
+type serverConn struct {
+	net.Conn
+	t      *testing.T
+	reader *bufio.Reader
+
+	remaining uint64 // bytes left in the current data frame (Read)
+}
+
+// Read a client frame, it must be masked
+func (conn *serverConn) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn.reader, header); err != nil {
+		return 0, nil, err
+	}
+	if header[1]&0x80 == 0 {
+		return 0, nil, errors.New("unmasked client frame")
+	}
+
+	length, err := conn.readLength(header[1] & 0x7F)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	mask := make([]byte, 4)
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn.reader, mask); err != nil {
+		return 0, nil, err
+	}
+	if _, err := io.ReadFull(conn.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return header[0], payload, nil
+}
+
+func (conn *serverConn) readLength(length byte) (uint64, error) {
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err := io.ReadFull(conn.reader, extended)
+		return uint64(binary.BigEndian.Uint16(extended)), err
+	case 127:
+		extended := make([]byte, 8)
+		_, err := io.ReadFull(conn.reader, extended)
+		return binary.BigEndian.Uint64(extended), err
+	default:
+		return uint64(length), nil
+	}
+}
+
+// Write an unmasked frame (first byte is FIN and opcode)
+func (conn *serverConn) writeFrame(first byte, payload []byte) error {
+	frame := []byte{first}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		extended := make([]byte, 8)
+		binary.BigEndian.PutUint64(extended, uint64(len(payload)))
+		frame = append(append(frame, 127), extended...)
+	}
+
+	_, err := conn.Conn.Write(append(frame, payload...))
+	return err
+}
+
+// Data of binary messages as a stream, for tcp.ServerConnectionNew
+func (conn *serverConn) Read(b []byte) (int, error) {
+	for conn.remaining == 0 {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn.reader, header); err != nil {
+			return 0, err
+		}
+		if header[0]&0x0F != opBinary && header[0]&0x0F != opContinuation {
+			return 0, errors.New("not a data frame")
+		}
+		length, err := conn.readLength(header[1] & 0x7F)
+		if err != nil {
+			return 0, err
+		}
+
+		// Read the whole frame to unmask it
+		mask := make([]byte, 4)
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(conn.reader, mask); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(conn.reader, payload); err != nil {
+			return 0, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		conn.reader = bufio.NewReader(io.MultiReader(bytes.NewReader(payload), conn.reader))
+		conn.remaining = length
+	}
+
+	if uint64(len(b)) > conn.remaining {
+		b = b[:conn.remaining]
+	}
+	n, err := conn.reader.Read(b)
+	conn.remaining -= uint64(n)
+	return n, err
+}
+
+func (conn *serverConn) Write(b []byte) (int, error) {
+	if err := conn.writeFrame(0x80|opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Accept header of a client key
+func acceptKey(key string) string {
+	accept := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(accept[:])
+}
+
+// WebSocket server on /apiws, accept replaces the Sec-WebSocket-Accept header if not empty
+func wsServer(t *testing.T, accept string, handle func(conn *serverConn)) (*httptest.Server, string) {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apiws" || r.Header.Get("Sec-WebSocket-Version") != "13" || r.Header.Get("Sec-WebSocket-Protocol") != "binary" ||
+			!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Origin") != "https://web.telegram.org" {
+			http.Error(w, "bad handshake", http.StatusBadRequest)
+			return
+		}
+
+		if accept == "" {
+			accept = acceptKey(r.Header.Get("Sec-WebSocket-Key"))
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Protocol: binary\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n")
+		if err := rw.Flush(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		handle(&serverConn{Conn: conn, t: t, reader: rw.Reader})
+	}))
+	t.Cleanup(server.Close)
+
+	return server, "ws://" + server.Listener.Addr().String() + "/apiws"
+}
+
+var testHeader = http.Header{"Origin": {"https://web.telegram.org"}}
+
+func TestDialAccept(t *testing.T) {
+	_, url := wsServer(t, "", func(conn *serverConn) {})
+	conn, err := Dial(context.Background(), nil, nil, url, testHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	// Wrong Sec-WebSocket-Accept
+	_, url = wsServer(t, acceptKey("other key"), func(conn *serverConn) {})
+	if _, err := Dial(context.Background(), nil, nil, url, testHeader); err == nil || !strings.Contains(err.Error(), "Sec-WebSocket-Accept") {
+		t.Fatal(err)
+	}
+
+	// Not upgraded
+	if _, err := Dial(context.Background(), nil, nil, url, nil); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatal(err)
+	}
+
+	if _, err := Dial(context.Background(), nil, nil, "http://example.com/apiws", nil); err == nil {
+		t.Fatal("http URL accepted")
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	// Server that never answers the upgrade
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := Dial(ctx, nil, nil, "ws://"+listener.Addr().String()+"/apiws", nil); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
+
+func TestConnMessages(t *testing.T) {
+	served := make(chan error, 1)
+	_, url := wsServer(t, "", func(conn *serverConn) {
+		served <- func() error {
+			// Client messages are masked binary frames
+			first, payload, err := conn.readFrame()
+			if err != nil {
+				return err
+			}
+			if first != 0x80|opBinary || string(payload) != "hello" {
+				return errors.New("wrong client message")
+			}
+			first, payload, err = conn.readFrame()
+			if err != nil || first != 0x80|opBinary || !bytes.Equal(payload, bytes.Repeat([]byte{7}, 70000)) {
+				return errors.New("wrong long client message")
+			}
+
+			// A message split in frames, with a ping between them
+			_ = conn.writeFrame(opBinary, []byte("split "))
+			_ = conn.writeFrame(0x80|opPing, []byte("ping data"))
+			_ = conn.writeFrame(opContinuation, []byte("over "))
+			_ = conn.writeFrame(0x80|opContinuation, []byte("frames"))
+
+			first, payload, err = conn.readFrame()
+			if err != nil || first != 0x80|opPong || string(payload) != "ping data" {
+				return errors.New("wrong pong")
+			}
+
+			// Close handshake started by the server, the client echoes the status code
+			_ = conn.writeFrame(0x80|opClose, []byte{0x03, 0xE8, 'b', 'y', 'e'})
+			first, payload, err = conn.readFrame()
+			if err != nil || first != 0x80|opClose || !bytes.Equal(payload, []byte{0x03, 0xE8}) {
+				return errors.New("wrong close frame")
+			}
+
+			// No other close frame after Close
+			if _, _, err := conn.readFrame(); err != io.EOF {
+				return errors.New("frame after the close handshake")
+			}
+			return nil
+		}()
+	})
+
+	conn, err := Dial(context.Background(), nil, nil, url, testHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(bytes.Repeat([]byte{7}, 70000)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "split over frames" {
+		t.Fatalf("%q %v", data, err)
+	}
+
+	_ = conn.Close()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	closed := make(chan []byte, 1)
+	_, url := wsServer(t, "", func(conn *serverConn) {
+		first, payload, err := conn.readFrame()
+		if err != nil || first != 0x80|opClose {
+			closed <- nil
+			return
+		}
+		closed <- payload
+	})
+
+	conn, err := Dial(context.Background(), nil, nil, url, testHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Normal closure
+	if payload := <-closed; !bytes.Equal(payload, []byte{0x03, 0xE8}) {
+		t.Fatalf("close frame %x", payload)
+	}
+}
+
+func TestConnWrongFrames(t *testing.T) {
+	for name, frame := range map[string][]byte{
+		"text":     {0x80 | opText, 1, 'a'},
+		"masked":   {0x80 | opBinary, 0x81, 0, 0, 0, 0, 'a'},
+		"opcode":   {0x80 | 0x3, 0},
+		"big ping": append([]byte{0x80 | opPing, 126, 0, 200}, make([]byte, 200)...),
+	} {
+		_, url := wsServer(t, "", func(conn *serverConn) {
+			_, _ = conn.Conn.Write(frame)
+			_, _ = io.Copy(io.Discard, conn.reader)
+		})
+
+		conn, err := Dial(context.Background(), nil, nil, url, testHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Read(make([]byte, 10)); err == nil || err == io.EOF {
+			t.Fatalf("%s: %v", name, err)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	for _, padded := range []bool{false, true} {
+		served := make(chan error, 1)
+		_, url := wsServer(t, "", func(conn *serverConn) {
+			server, err := tcp.ServerConnectionNew(conn, nil)
+			if err != nil {
+				served <- err
+				return
+			}
+
+			// Echo a frame
+			data, err := server.ReadFrame()
+			if err == nil && !server.Obfuscated() {
+				err = errors.New("connection not obfuscated")
+			}
+			if err == nil {
+				err = server.WriteFrame(data)
+			}
+			served <- err
+			_, _ = io.Copy(io.Discard, conn.reader)
+		})
+
+		client := &WebSocket{URL: url, Header: testHeader, Padded: padded}
+		if err := client.ConnectContext(context.Background(), "", true); err != nil {
+			t.Fatal(err)
+		}
+
+		want := bytes.Repeat([]byte{1, 2, 3, 4}, 1000)
+		if err := client.WriteFrame(want); err != nil {
+			t.Fatal(err)
+		}
+		got, err := client.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Padding of the client and of the echo
+		if padded && len(got) >= len(want) && len(got) <= len(want)+30 {
+			got = got[:len(want)]
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("padded=%v: wrong echo of %d bytes", padded, len(got))
+		}
+
+		if err := <-served; err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWebSocketNotConnected(t *testing.T) {
+	client := new(WebSocket)
+	if err := client.WriteFrame([]byte{1, 2, 3, 4}); err != tcp.ErrNotConnected {
+		t.Fatal(err)
+	}
+	if _, err := client.ReadFrame(); err != tcp.ErrNotConnected {
+		t.Fatal(err)
+	}
+	if err := client.Connect("", true); err == nil {
+		t.Fatal("connected without address")
+	}
+	if err := (&WebSocket{URL: "https://example.com/apiws"}).Connect("", true); err == nil {
+		t.Fatal("https URL accepted")
+	}
+
+	for address, url := range map[string]string{
+		"venus.web.telegram.org":      "wss://venus.web.telegram.org/apiws",
+		"venus.web.telegram.org:443":  "wss://venus.web.telegram.org/apiws",
+		"venus.web.telegram.org:8443": "wss://venus.web.telegram.org:8443/apiws",
+	} {
+		if got := client.url(address); got != url {
+			t.Fatalf("%s: %s", address, got)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// https://core.telegram.org/passport#decrypting-data
+package passport
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto/aes"
+)
+
+// Padding length is stored in the first byte and it is between 32 and 255 bytes
+const minPadding = 32
+
+// Parse the bot private key (PKCS#1 "RSA PRIVATE KEY" or PKCS#8 "PRIVATE KEY")
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("passport: PEM block not found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("passport: the key isn't an RSA key")
+		}
+		return rsaKey, nil
+
+	default:
+		return nil, errors.New("passport: unknown PEM block " + block.Type)
+	}
+}
+
+// Decrypt data encrypted with a secret and its hash
+//
+// secret_hash = SHA512(secret + hash)
+// key = substr(secret_hash, 0, 32), iv = substr(secret_hash, 32, 16)
+// AES-256-CBC decrypt, check SHA256(decrypted) == hash, remove padding (first byte = padding length)
+func decrypt(data, hash, secret []byte) ([]byte, error) {
+	if len(hash) != sha256.Size {
+		return nil, errors.New("passport: wrong hash length")
+	}
+
+	secretHash := sha512.Sum512(append(append([]byte{}, secret...), hash...))
+
+	cbc := aes.AES256CBCNew(secretHash[:32], secretHash[32:48])
+	if cbc == nil {
+		return nil, errors.New("passport: wrong key")
+	}
+
+	if len(data) == 0 {
+		return nil, errors.New("passport: encrypted data is empty")
+	}
+
+	decrypted, err := cbc.Decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dataHash := sha256.Sum256(decrypted)
+	if !bytes.Equal(dataHash[:], hash) {
+		return nil, errors.New("passport: hash mismatch")
+	}
+
+	padding := int(decrypted[0])
+	if padding < minPadding || padding > len(decrypted) {
+		return nil, errors.New("passport: wrong padding")
+	}
+
+	return decrypted[padding:], nil
+}
+
+// Decrypt secureCredentialsEncrypted (data, hash, secret) with the bot private key
+func DecryptCredentials(privateKey *rsa.PrivateKey, data, hash, secret []byte) (*Credentials, error) {
+	// The secret is encrypted with RSA-OAEP (SHA1)
+	credentialsSecret, err := rsa.DecryptOAEP(sha1.New(), nil, privateKey, secret, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := decrypt(data, hash, credentialsSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := new(Credentials)
+	err = json.Unmarshal(decrypted, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+// Decrypt the data field of a secureValue (JSON)
+func DecryptData(data []byte, credentials *DataCredentials) ([]byte, error) {
+	if credentials == nil {
+		return nil, errors.New("passport: data credentials are missing")
+	}
+
+	return decrypt(data, credentials.DataHash, credentials.Secret)
+}
+
+// Decrypt a file of a secureValue (scans, selfie, translation, sides)
+func DecryptFile(file []byte, credentials *FileCredentials) ([]byte, error) {
+	if credentials == nil {
+		return nil, errors.New("passport: file credentials are missing")
+	}
+
+	return decrypt(file, credentials.FileHash, credentials.Secret)
+}
+
+// Decrypt the data of a secureValue and parse it in v
+func decryptJSON(data []byte, credentials *DataCredentials, v interface{}) error {
+	decrypted, err := DecryptData(data, credentials)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(decrypted, v)
+}
+
+// Decrypt personal_details
+func DecryptPersonalDetails(data []byte, credentials *DataCredentials) (*PersonalDetails, error) {
+	details := new(PersonalDetails)
+	err := decryptJSON(data, credentials, details)
+	if err != nil {
+		return nil, err
+	}
+
+	return details, nil
+}
+
+// Decrypt the data of passport, driver_license, identity_card or internal_passport
+func DecryptIDDocument(data []byte, credentials *DataCredentials) (*IDDocumentData, error) {
+	document := new(IDDocumentData)
+	err := decryptJSON(data, credentials, document)
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+// Decrypt address
+func DecryptResidentialAddress(data []byte, credentials *DataCredentials) (*ResidentialAddress, error) {
+	address := new(ResidentialAddress)
+	err := decryptJSON(data, credentials, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return address, nil
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package passport
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// Bot key, generated once for all the tests
+func botKey(t *testing.T) *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testKey = key
+	})
+	return testKey
+}
+
+func randomBytes(t *testing.T, length int) []byte {
+	data := make([]byte, length)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Encrypt like Telegram: padding (first byte is its length) + data, AES-256-CBC with SHA512(secret + hash).
+// It returns the encrypted data and data_hash.
+func encryptWithPadding(t *testing.T, data, secret []byte, padding int) ([]byte, []byte) {
+	t.Helper()
+
+	padded := randomBytes(t, padding)
+	padded[0] = byte(padding)
+	padded = append(padded, data...)
+
+	hash := sha256.Sum256(padded)
+	secretHash := sha512.Sum512(append(append([]byte{}, secret...), hash[:]...))
+	block, err := aes.NewCipher(secretHash[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCBCEncrypter(block, secretHash[32:48]).CryptBlocks(padded, padded)
+
+	return padded, hash[:]
+}
+
+func encrypt(t *testing.T, data, secret []byte) ([]byte, []byte) {
+	// Total length multiple of 16, at least 32 bytes of padding
+	padding := 32 + (16-len(data)%16)%16
+	return encryptWithPadding(t, data, secret, padding)
+}
+
+func TestDecryptCredentials(t *testing.T) {
+	key := botKey(t)
+
+	details, _ := json.Marshal(&PersonalDetails{FirstName: "Anna", LastName: "Rossi", BirthDate: "01.02.1990", Gender: "female", CountryCode: "IT"})
+	document, _ := json.Marshal(&IDDocumentData{DocumentNo: "AB1234567", ExpiryDate: "01.02.2030"})
+	address, _ := json.Marshal(&ResidentialAddress{StreetLine1: "Via Roma 1", City: "Milano", CountryCode: "IT", PostCode: "20100"})
+	scan := bytes.Repeat([]byte{0xFF, 0xD8, 0xFF}, 1000)
+
+	detailsSecret, documentSecret, addressSecret, scanSecret := randomBytes(t, 32), randomBytes(t, 32), randomBytes(t, 32), randomBytes(t, 32)
+	detailsData, detailsHash := encrypt(t, details, detailsSecret)
+	documentData, documentHash := encrypt(t, document, documentSecret)
+	addressData, addressHash := encrypt(t, address, addressSecret)
+	scanFile, scanHash := encrypt(t, scan, scanSecret)
+
+	credentials := &Credentials{Nonce: "payload nonce"}
+	credentials.SecureData.PersonalDetails = &SecureValue{Data: &DataCredentials{DataHash: detailsHash, Secret: detailsSecret}}
+	credentials.SecureData.Passport = &SecureValue{
+		Data:      &DataCredentials{DataHash: documentHash, Secret: documentSecret},
+		FrontSide: &FileCredentials{FileHash: scanHash, Secret: scanSecret},
+	}
+	credentials.SecureData.Address = &SecureValue{Data: &DataCredentials{DataHash: addressHash, Secret: addressSecret}}
+	credentialsJSON, _ := json.Marshal(credentials)
+
+	// secureCredentialsEncrypted
+	credentialsSecret := randomBytes(t, 32)
+	data, hash := encrypt(t, credentialsJSON, credentialsSecret)
+	secret, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &key.PublicKey, credentialsSecret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := DecryptCredentials(key, data, hash, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.Nonce != "payload nonce" || decrypted.SecureData.PersonalDetails == nil || decrypted.SecureData.Passport == nil {
+		t.Fatalf("%+v", decrypted)
+	}
+
+	personalDetails, err := DecryptPersonalDetails(detailsData, decrypted.SecureData.PersonalDetails.Data)
+	if err != nil || personalDetails.FirstName != "Anna" || personalDetails.CountryCode != "IT" {
+		t.Fatal(personalDetails, err)
+	}
+	idDocument, err := DecryptIDDocument(documentData, decrypted.SecureData.Passport.Data)
+	if err != nil || idDocument.DocumentNo != "AB1234567" {
+		t.Fatal(idDocument, err)
+	}
+	residentialAddress, err := DecryptResidentialAddress(addressData, decrypted.SecureData.Address.Data)
+	if err != nil || residentialAddress.City != "Milano" {
+		t.Fatal(residentialAddress, err)
+	}
+	file, err := DecryptFile(scanFile, decrypted.SecureData.Passport.FrontSide)
+	if err != nil || !bytes.Equal(file, scan) {
+		t.Fatal("wrong file", err)
+	}
+
+	// Secret encrypted for another bot
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if _, err := DecryptCredentials(otherKey, data, hash, secret); err == nil {
+		t.Fatal("credentials decrypted with another key")
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	secret := randomBytes(t, 32)
+	data, hash := encrypt(t, []byte(`{"document_no":"1"}`), secret)
+
+	if decrypted, err := DecryptData(data, &DataCredentials{DataHash: hash, Secret: secret}); err != nil || string(decrypted) != `{"document_no":"1"}` {
+		t.Fatal(decrypted, err)
+	}
+
+	wrongHash := append([]byte{}, hash...)
+	wrongHash[0] ^= 1
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-1] ^= 1
+	shortPadding, shortPaddingHash := encryptWithPadding(t, bytes.Repeat([]byte{1}, 16), secret, 16)
+	longPadding, longPaddingHash := encrypt(t, bytes.Repeat([]byte{1}, 16), secret)
+
+	for _, test := range []struct {
+		name        string
+		data        []byte
+		credentials *DataCredentials
+		err         string
+	}{
+		{"wrong data_hash", data, &DataCredentials{DataHash: wrongHash, Secret: secret}, "hash mismatch"},
+		{"tampered data", tampered, &DataCredentials{DataHash: hash, Secret: secret}, "hash mismatch"},
+		{"wrong secret", data, &DataCredentials{DataHash: hash, Secret: randomBytes(t, 32)}, "hash mismatch"},
+		{"short hash", data, &DataCredentials{DataHash: hash[:16], Secret: secret}, "hash length"},
+		{"padding under 32 bytes", shortPadding, &DataCredentials{DataHash: shortPaddingHash, Secret: secret}, "padding"},
+		{"empty data", nil, &DataCredentials{DataHash: hash, Secret: secret}, "empty"},
+		{"partial block", data[:len(data)-1], &DataCredentials{DataHash: hash, Secret: secret}, ""},
+		{"missing credentials", data, nil, "missing"},
+	} {
+		_, err := DecryptData(test.data, test.credentials)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+	}
+
+	if _, err := DecryptData(longPadding, &DataCredentials{DataHash: longPaddingHash, Secret: secret}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptFile(data, nil); err == nil {
+		t.Fatal("file without credentials")
+	}
+	if _, err := DecryptPersonalDetails([]byte("not encrypted data!!!!!!!!!!!!!!"), &DataCredentials{DataHash: hash, Secret: secret}); err == nil {
+		t.Fatal("wrong data parsed")
+	}
+}
+
+func TestDecryptPaddingTooLong(t *testing.T) {
+	secret := randomBytes(t, 32)
+
+	// First byte says 255 bytes of padding, only 48 bytes are decrypted
+	padded := append([]byte{255}, randomBytes(t, 47)...)
+	hash := sha256.Sum256(padded)
+	secretHash := sha512.Sum512(append(append([]byte{}, secret...), hash[:]...))
+	block, _ := aes.NewCipher(secretHash[:32])
+	cipher.NewCBCEncrypter(block, secretHash[32:48]).CryptBlocks(padded, padded)
+
+	if _, err := DecryptData(padded, &DataCredentials{DataHash: hash[:], Secret: secret}); err == nil || !strings.Contains(err.Error(), "padding") {
+		t.Fatal(err)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key := botKey(t)
+
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pkcs8Bytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Bytes})
+
+	for _, data := range [][]byte{pkcs1, pkcs8} {
+		parsed, err := ParsePrivateKey(data)
+		if err != nil || !parsed.Equal(key) {
+			t.Fatal(err)
+		}
+	}
+
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+	for _, data := range [][]byte{nil, []byte("not a key"), publicKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1, 2, 3}})} {
+		if _, err := ParsePrivateKey(data); err == nil {
+			t.Fatalf("%q accepted", data)
+		}
+	}
+}
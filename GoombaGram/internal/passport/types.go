@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package passport
+
+// https://core.telegram.org/passport#fields
+
+// Decrypted credentials (the secret of every value)
+type Credentials struct {
+	SecureData SecureData `json:"secure_data"`
+	Nonce      string     `json:"nonce"`
+}
+
+// Credentials of the values shared by the user
+type SecureData struct {
+	PersonalDetails       *SecureValue `json:"personal_details,omitempty"`
+	Passport              *SecureValue `json:"passport,omitempty"`
+	InternalPassport      *SecureValue `json:"internal_passport,omitempty"`
+	DriverLicense         *SecureValue `json:"driver_license,omitempty"`
+	IdentityCard          *SecureValue `json:"identity_card,omitempty"`
+	Address               *SecureValue `json:"address,omitempty"`
+	UtilityBill           *SecureValue `json:"utility_bill,omitempty"`
+	BankStatement         *SecureValue `json:"bank_statement,omitempty"`
+	RentalAgreement       *SecureValue `json:"rental_agreement,omitempty"`
+	PassportRegistration  *SecureValue `json:"passport_registration,omitempty"`
+	TemporaryRegistration *SecureValue `json:"temporary_registration,omitempty"`
+}
+
+// Credentials of a value (data and files)
+type SecureValue struct {
+	Data        *DataCredentials  `json:"data,omitempty"`
+	FrontSide   *FileCredentials  `json:"front_side,omitempty"`
+	ReverseSide *FileCredentials  `json:"reverse_side,omitempty"`
+	Selfie      *FileCredentials  `json:"selfie,omitempty"`
+	Translation []FileCredentials `json:"translation,omitempty"`
+	Files       []FileCredentials `json:"files,omitempty"`
+}
+
+// Credentials to decrypt the data of a value (base64 in JSON)
+type DataCredentials struct {
+	DataHash []byte `json:"data_hash"`
+	Secret   []byte `json:"secret"`
+}
+
+// Credentials to decrypt a file (base64 in JSON)
+type FileCredentials struct {
+	FileHash []byte `json:"file_hash"`
+	Secret   []byte `json:"secret"`
+}
+
+// personal_details
+type PersonalDetails struct {
+	FirstName            string `json:"first_name"`
+	LastName             string `json:"last_name"`
+	MiddleName           string `json:"middle_name,omitempty"`
+	BirthDate            string `json:"birth_date"` // DD.MM.YYYY
+	Gender               string `json:"gender"`     // male or female
+	CountryCode          string `json:"country_code"`
+	ResidenceCountryCode string `json:"residence_country_code"`
+	FirstNameNative      string `json:"first_name_native,omitempty"`
+	LastNameNative       string `json:"last_name_native,omitempty"`
+	MiddleNameNative     string `json:"middle_name_native,omitempty"`
+}
+
+// passport, driver_license, identity_card, internal_passport
+type IDDocumentData struct {
+	DocumentNo string `json:"document_no"`
+	ExpiryDate string `json:"expiry_date,omitempty"` // DD.MM.YYYY
+}
+
+// address
+type ResidentialAddress struct {
+	StreetLine1 string `json:"street_line1"`
+	StreetLine2 string `json:"street_line2,omitempty"`
+	City        string `json:"city"`
+	State       string `json:"state,omitempty"`
+	CountryCode string `json:"country_code"`
+	PostCode    string `json:"post_code"`
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package secretchat
+
+import (
+	"time"
+)
+
+// Secret chat state
+type State int
+
+const (
+	StateWaiting   State = iota // requested, waiting for the other participant
+	StateReady                  // key exchanged, messages can be sent
+	StateDiscarded              // chat closed
+)
+
+// The key must be changed after it has been used for this number of messages...
+const RekeyMessages = 100
+
+// ...or after this time
+const RekeyInterval = 7 * 24 * time.Hour
+
+// Sent messages kept to answer decryptedMessageActionResend
+const sentHistory = 1000
+
+// Records appended to the storage before the whole chat is saved again
+const chatRecords = 100
+
+// Secret chat state, saved in the storage (encrypted) after every change
+type Chat struct {
+	ID         int32
+	AccessHash int64
+	Originator bool // true if this client created the chat (admin_id)
+	State      State
+	Layer      int32 // layer used by the other participant
+
+	// Diffie-Hellman parameters used for the chat (and to change the key)
+	G int32
+	P []byte
+
+	// Current key, with the number of messages encrypted/decrypted and its creation time
+	Key            []byte
+	KeyFingerprint int64
+	KeyUsed        int
+	KeyCreated     time.Time
+
+	// Previous key, to decrypt messages sent before a key change
+	OldKey            []byte
+	OldKeyFingerprint int64
+
+	// Key exchange in progress (chat creation or key change)
+	ExchangeID      int64
+	ExchangePrivate []byte // a or b
+	ExchangeKey     []byte // key computed by the participant that accepted the exchange
+
+	// Number of messages received and sent (raw sequence numbers)
+	RawInSeqNo  int32
+	RawOutSeqNo int32
+
+	// Encrypted messages sent by raw out sequence number (for resend requests)
+	Sent map[int32][]byte
+
+	// Messages time to live (seconds, 0 = disabled)
+	TTL int32
+
+	// Self-destruct time of the messages by random_id
+	Destruct map[int64]time.Time
+
+	// Messages received after a gap, waiting for the missing ones (not saved)
+	pending map[int32]*Message
+
+	// Records appended since the chat has been saved (not saved)
+	records int
+}
+
+// Changes of a chat after a message sent or received, appended to the storage instead of the whole chat.
+// Counters only grow while a key is used, so old records applied again don't change the chat.
+type chatRecord struct {
+	KeyFingerprint int64 // key of the chat when the record was appended
+	KeyUsed        int
+	RawInSeqNo     int32
+	RawOutSeqNo    int32
+	Layer          int32
+	Sent           []byte // encrypted message sent with raw out sequence number RawOutSeqNo-1 (optional)
+}
+
+// x used to encrypt messages sent by this client
+func (chat *Chat) outX() int {
+	if chat.Originator {
+		return 0
+	}
+	return 8
+}
+
+// x used to decrypt messages received by this client
+func (chat *Chat) inX() int {
+	return 8 - chat.outX()
+}
+
+// Parity of out_seq_no for messages sent by this client
+// (odd for the chat creator, even for the other participant)
+func (chat *Chat) outParity() int32 {
+	if chat.Originator {
+		return 1
+	}
+	return 0
+}
+
+// Parity of out_seq_no for messages received by this client
+func (chat *Chat) inParity() int32 {
+	return 1 - chat.outParity()
+}
+
+// Sequence numbers of the next message sent
+// out_seq_no = 2 * raw_out_seq_no + outParity, in_seq_no = 2 * raw_in_seq_no + inParity
+func (chat *Chat) seqNo(rawOut int32) (inSeqNo, outSeqNo int32) {
+	return 2*chat.RawInSeqNo + chat.inParity(), 2*rawOut + chat.outParity()
+}
+
+// Check if the key must be changed
+func (chat *Chat) NeedsRekey(now time.Time) bool {
+	return chat.State == StateReady && chat.ExchangeID == 0 &&
+		(chat.KeyUsed >= RekeyMessages || now.Sub(chat.KeyCreated) >= RekeyInterval)
+}
+
+// Use a new key, keeping the previous one for messages in transit
+func (chat *Chat) setKey(key []byte, now time.Time) {
+	if chat.Key != nil {
+		chat.OldKey = chat.Key
+		chat.OldKeyFingerprint = chat.KeyFingerprint
+	}
+
+	chat.Key = key
+	chat.KeyFingerprint = keyFingerprint(key)
+	chat.KeyUsed = 0
+	chat.KeyCreated = now
+
+	chat.ExchangeID = 0
+	chat.ExchangePrivate = nil
+	chat.ExchangeKey = nil
+}
+
+// Record of the chat counters, sent is the encrypted message sent (nil if none)
+func (chat *Chat) record(sent []byte) *chatRecord {
+	return &chatRecord{
+		KeyFingerprint: chat.KeyFingerprint,
+		KeyUsed:        chat.KeyUsed,
+		RawInSeqNo:     chat.RawInSeqNo,
+		RawOutSeqNo:    chat.RawOutSeqNo,
+		Layer:          chat.Layer,
+		Sent:           sent,
+	}
+}
+
+// Apply a record loaded from the storage, records appended before a key change are ignored
+func (chat *Chat) apply(record *chatRecord) {
+	if record.KeyFingerprint != chat.KeyFingerprint {
+		return
+	}
+
+	if record.Sent != nil && record.RawOutSeqNo > chat.RawOutSeqNo {
+		chat.remember(record.RawOutSeqNo-1, record.Sent)
+	}
+
+	if record.KeyUsed > chat.KeyUsed {
+		chat.KeyUsed = record.KeyUsed
+	}
+	if record.RawInSeqNo > chat.RawInSeqNo {
+		chat.RawInSeqNo = record.RawInSeqNo
+	}
+	if record.RawOutSeqNo > chat.RawOutSeqNo {
+		chat.RawOutSeqNo = record.RawOutSeqNo
+	}
+	if record.Layer > chat.Layer {
+		chat.Layer = record.Layer
+	}
+}
+
+// Save an encrypted message sent for resend requests, removing the oldest ones
+func (chat *Chat) remember(rawOut int32, message []byte) {
+	if chat.Sent == nil {
+		chat.Sent = make(map[int32][]byte)
+	}
+
+	chat.Sent[rawOut] = message
+	delete(chat.Sent, rawOut-sentHistory)
+}
+
+// Start the self-destruct timer of a message (when it has been read)
+func (chat *Chat) scheduleDestruct(randomID int64, ttl int32, now time.Time) {
+	if ttl <= 0 {
+		return
+	}
+
+	if chat.Destruct == nil {
+		chat.Destruct = make(map[int64]time.Time)
+	}
+
+	chat.Destruct[randomID] = now.Add(time.Duration(ttl) * time.Second)
+}
+
+// Remove and return the messages that must be deleted
+func (chat *Chat) expired(now time.Time) []int64 {
+	result := make([]int64, 0)
+	for randomID, deadline := range chat.Destruct {
+		if !now.Before(deadline) {
+			result = append(result, randomID)
+			delete(chat.Destruct, randomID)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package secretchat
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto/aes"
+	"math/big"
+)
+
+// Random padding length (MTProto 2.0 for secret chats requires 12..1024 bytes)
+const (
+	minPadding = 12
+	maxPadding = 1024
+)
+
+// Length of a secret chat key (bytes)
+const keyLength = 256
+
+// key_fingerprint = substr(SHA1(key), 12, 8) as little endian long
+func keyFingerprint(key []byte) int64 {
+	hash := sha1.Sum(key)
+	return int64(binary.LittleEndian.Uint64(hash[12:20]))
+}
+
+// Random Diffie-Hellman exponent and its public value g^a mod p
+func dhGenerate(g int32, p *big.Int) (private, public []byte, err error) {
+	generator := big.NewInt(int64(g))
+
+	for {
+		private = make([]byte, keyLength)
+		_, err = crypto.ReadRandom(private)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		value := new(big.Int).Exp(generator, new(big.Int).SetBytes(private), p)
+		if crypto.CheckDHValue(value, p) == nil {
+			return private, padKey(value), nil
+		}
+	}
+}
+
+// Shared key = (public)^private mod p, public is checked before use
+func dhKey(private, public []byte, p *big.Int) ([]byte, error) {
+	value := new(big.Int).SetBytes(public)
+	err := crypto.CheckDHValue(value, p)
+	if err != nil {
+		return nil, err
+	}
+
+	return padKey(new(big.Int).Exp(value, new(big.Int).SetBytes(private), p)), nil
+}
+
+// Big endian number padded to 256 bytes
+func padKey(number *big.Int) []byte {
+	result := make([]byte, keyLength)
+	number.FillBytes(result)
+	return result
+}
+
+// Encrypt a serialized DecryptedMessageLayer with MTProto 2.0
+// x = 0 for messages sent by the chat originator and 8 for messages sent by the other participant
+//
+// +-----------+---------+---------------------------------------+
+// |fingerprint| msg_key |  AES-IGE(length + layer + padding)    |
+// +-----------+---------+---------------------------------------+
+func encryptMessage(key []byte, fingerprint int64, layer []byte, x int) ([]byte, error) {
+	// Random padding of 12..1024 bytes, total length divisible by 16
+	paddingLength := minPadding + (16-(4+len(layer)+minPadding)%16)%16
+	extra := make([]byte, 1)
+	_, err := crypto.ReadRandom(extra)
+	if err != nil {
+		return nil, err
+	}
+	paddingLength += 16 * int(extra[0]%4)
+
+	plaintext := make([]byte, 4+len(layer)+paddingLength)
+	binary.LittleEndian.PutUint32(plaintext, uint32(len(layer)))
+	copy(plaintext[4:], layer)
+	_, err = crypto.ReadRandom(plaintext[4+len(layer):])
+	if err != nil {
+		return nil, err
+	}
+
+	msgKey := crypto.MessageKey(key, plaintext, x)
+	aesKey, aesIV := crypto.KDF(key, msgKey, x)
+	ige, err := aes.AES256IGENew(aesKey, aesIV)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, 24+len(plaintext))
+	binary.LittleEndian.PutUint64(result, uint64(fingerprint))
+	copy(result[8:24], msgKey)
+
+	err = ige.EncryptTo(result[24:], plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Decrypt a message encrypted with encryptMessage, returns the serialized DecryptedMessageLayer
+func decryptMessage(key []byte, data []byte, x int) ([]byte, error) {
+	if len(data) < 24+16 || (len(data)-24)%16 != 0 {
+		return nil, errors.New("secret chat: wrong encrypted message length")
+	}
+
+	msgKey := data[8:24]
+	aesKey, aesIV := crypto.KDF(key, msgKey, x)
+	ige, err := aes.AES256IGENew(aesKey, aesIV)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := ige.Decrypt(data[24:])
+	if err != nil {
+		return nil, err
+	}
+
+	// msg_key must be computed again on the decrypted data
+	if !bytes.Equal(crypto.MessageKey(key, plaintext, x), msgKey) {
+		return nil, errors.New("secret chat: msg_key mismatch")
+	}
+
+	length := int(binary.LittleEndian.Uint32(plaintext))
+	padding := len(plaintext) - 4 - length
+	if length < 0 || padding < minPadding || padding > maxPadding {
+		return nil, errors.New("secret chat: wrong message length")
+	}
+
+	return plaintext[4 : 4+length], nil
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package secretchat
+
+import (
+	"crypto/cipher"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto/aes"
+	"hash"
+	"io"
+)
+
+// https://core.telegram.org/api/end-to-end#sending-encrypted-files
+
+// Size of the upload parts
+const FilePartSize = 512 * 1024
+
+// Files bigger than this must be sent as inputEncryptedFileBigUploaded
+const BigFileSize = 10 * 1024 * 1024
+
+// Data encrypted/decrypted at once by the streams (multiple of the AES block)
+const fileChunk = 64 * 1024
+
+// Random AES-256-IGE key and iv of an encrypted file
+type FileKey struct {
+	Key []byte
+	IV  []byte
+}
+
+// Create a random key for a new file
+func FileKeyNew() (*FileKey, error) {
+	random := make([]byte, 64)
+	_, err := crypto.ReadRandom(random)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileKey{
+		Key: random[:32],
+		IV:  random[32:],
+	}, nil
+}
+
+// key_fingerprint of inputEncryptedFileUploaded
+// digest = md5(key + iv), fingerprint = substr(digest, 0, 4) XOR substr(digest, 4, 4)
+func (key *FileKey) Fingerprint() int32 {
+	digest := md5.Sum(append(append([]byte{}, key.Key...), key.IV...))
+	return int32(binary.LittleEndian.Uint32(digest[0:4]) ^ binary.LittleEndian.Uint32(digest[4:8]))
+}
+
+// Size of a file after the encryption (padded to 16 bytes)
+func EncryptedSize(size int64) int64 {
+	return (size + 15) / 16 * 16
+}
+
+// Number of upload parts of a file
+func FileParts(size int64) int32 {
+	return int32((EncryptedSize(size) + FilePartSize - 1) / FilePartSize)
+}
+
+// Check if a file must be uploaded as inputEncryptedFileBigUploaded
+func IsBigFile(size int64) bool {
+	return EncryptedSize(size) > BigFileSize
+}
+
+func (key *FileKey) ige() (*aes.AES256IGE, error) {
+	return aes.AES256IGENew(key.Key, key.IV)
+}
+
+// Reader that encrypts a file while it is uploaded
+type FileEncrypter struct {
+	src      io.Reader
+	mode     cipher.BlockMode
+	checksum hash.Hash
+	buffer   []byte
+	ready    []byte // encrypted bytes not read yet
+	size     int64  // encrypted bytes produced
+	done     bool
+}
+
+// Encrypt src (the file content) while it is read
+func (key *FileKey) EncryptReader(src io.Reader) (*FileEncrypter, error) {
+	ige, err := key.ige()
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileEncrypter{
+		src:      src,
+		mode:     ige.Encrypter(),
+		checksum: md5.New(),
+		buffer:   make([]byte, fileChunk),
+	}, nil
+}
+
+// Read encrypted data, the last block is padded to 16 bytes with random bytes
+func (enc *FileEncrypter) Read(p []byte) (int, error) {
+	for len(enc.ready) == 0 {
+		if enc.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(enc.src, enc.buffer)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			enc.done = true
+		} else if err != nil {
+			return 0, err
+		}
+
+		// Padding of the last block
+		padded := int(EncryptedSize(int64(n)))
+		if padded != n {
+			_, err = crypto.ReadRandom(enc.buffer[n:padded])
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		enc.mode.CryptBlocks(enc.buffer[:padded], enc.buffer[:padded])
+		enc.checksum.Write(enc.buffer[:padded])
+		enc.size += int64(padded)
+		enc.ready = enc.buffer[:padded]
+	}
+
+	n := copy(p, enc.ready)
+	enc.ready = enc.ready[n:]
+	return n, nil
+}
+
+// Encrypted size, valid when all the data has been read
+func (enc *FileEncrypter) Size() int64 {
+	return enc.size
+}
+
+// md5_checksum of inputEncryptedFileUploaded (MD5 of the encrypted data as hex),
+// valid when all the data has been read
+func (enc *FileEncrypter) MD5() string {
+	return hex.EncodeToString(enc.checksum.Sum(nil))
+}
+
+// Reader that decrypts a file while it is downloaded
+type FileDecrypter struct {
+	src       io.Reader
+	mode      cipher.BlockMode
+	buffer    []byte
+	ready     []byte
+	size      int64 // original size (from decryptedMessageMediaDocument)
+	remaining int64 // plaintext bytes not returned yet
+	encrypted int64 // encrypted bytes read
+	done      bool
+}
+
+// Decrypt src (the downloaded encrypted file) while it is read, size is the original file size
+func (key *FileKey) DecryptReader(src io.Reader, size int64) (*FileDecrypter, error) {
+	if size < 0 {
+		return nil, errors.New("secret chat: wrong file size")
+	}
+
+	ige, err := key.ige()
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileDecrypter{
+		src:       src,
+		mode:      ige.Decrypter(),
+		buffer:    make([]byte, fileChunk),
+		size:      size,
+		remaining: size,
+	}, nil
+}
+
+// Read decrypted data, padding is removed and the final size is checked
+func (dec *FileDecrypter) Read(p []byte) (int, error) {
+	for len(dec.ready) == 0 {
+		if dec.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(dec.src, dec.buffer)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			dec.done = true
+		} else if err != nil {
+			return 0, err
+		}
+
+		if n%16 != 0 {
+			return 0, errors.New("secret chat: encrypted file length isn't a multiple of 16")
+		}
+
+		dec.encrypted += int64(n)
+		if dec.encrypted > EncryptedSize(dec.size) {
+			return 0, errors.New("secret chat: encrypted file is bigger than expected")
+		}
+		if dec.done && dec.encrypted != EncryptedSize(dec.size) {
+			return 0, errors.New("secret chat: encrypted file is smaller than expected")
+		}
+
+		dec.mode.CryptBlocks(dec.buffer[:n], dec.buffer[:n])
+
+		// Remove padding
+		if int64(n) > dec.remaining {
+			n = int(dec.remaining)
+		}
+		dec.remaining -= int64(n)
+		dec.ready = dec.buffer[:n]
+	}
+
+	n := copy(p, dec.ready)
+	dec.ready = dec.ready[n:]
+	return n, nil
+}
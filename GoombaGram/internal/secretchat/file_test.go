@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package secretchat
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto/aes"
+)
+
+// Key 00..1f, iv 20..3f
+func testFileKey() *FileKey {
+	random := make([]byte, 64)
+	for i := range random {
+		random[i] = byte(i)
+	}
+	return &FileKey{Key: random[:32], IV: random[32:]}
+}
+
+func testFile(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	return data
+}
+
+func encryptFile(t *testing.T, key *FileKey, data []byte) ([]byte, *FileEncrypter) {
+	t.Helper()
+
+	enc, err := key.EncryptReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := ioutil.ReadAll(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted, enc
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	key, err := FileKeyNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, 15, 16, 17, fileChunk - 1, fileChunk, fileChunk + 1, 3*fileChunk + 100} {
+		data := testFile(size)
+		encrypted, enc := encryptFile(t, key, data)
+
+		if int64(len(encrypted)) != EncryptedSize(int64(size)) || enc.Size() != int64(len(encrypted)) {
+			t.Fatalf("size %d: %d encrypted bytes", size, len(encrypted))
+		}
+		checksum := md5.Sum(encrypted)
+		if enc.MD5() != hex.EncodeToString(checksum[:]) {
+			t.Fatalf("size %d: wrong md5_checksum", size)
+		}
+
+		// The stream is AES-256-IGE of the whole padded file
+		ige, err := aes.AES256IGENew(key.Key, key.IV)
+		if err != nil {
+			t.Fatal(err)
+		}
+		whole := append([]byte{}, encrypted...)
+		ige.Decrypter().CryptBlocks(whole, whole)
+		if !bytes.Equal(whole[:size], data) {
+			t.Fatalf("size %d: stream differs from the whole file encryption", size)
+		}
+
+		// Decrypted one byte at a time
+		dec, err := key.DecryptReader(iotest.OneByteReader(bytes.NewReader(encrypted)), int64(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := ioutil.ReadAll(iotest.OneByteReader(dec))
+		if err != nil || !bytes.Equal(decrypted, data) {
+			t.Fatalf("size %d: %v", size, err)
+		}
+	}
+}
+
+func TestFileEncryptReaderSmallReads(t *testing.T) {
+	key := testFileKey()
+	data := testFile(fileChunk + 5)
+
+	enc, err := key.EncryptReader(iotest.HalfReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := ioutil.ReadAll(iotest.OneByteReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec, _ := key.DecryptReader(bytes.NewReader(encrypted), int64(len(data)))
+	if decrypted, err := ioutil.ReadAll(dec); err != nil || !bytes.Equal(decrypted, data) {
+		t.Fatal(err)
+	}
+}
+
+func TestFileDecryptSizeMismatch(t *testing.T) {
+	key := testFileKey()
+	data := testFile(100)
+	encrypted, _ := encryptFile(t, key, data)
+
+	for _, test := range []struct {
+		name      string
+		encrypted []byte
+		size      int64
+	}{
+		{"bigger size", encrypted, 100 + 16},
+		{"smaller size", encrypted, 100 - 16},
+		{"truncated block", encrypted[:len(encrypted)-1], 100},
+		{"missing block", encrypted[:len(encrypted)-16], 100},
+		{"extra block", append(append([]byte{}, encrypted...), make([]byte, 16)...), 100},
+	} {
+		dec, err := key.DecryptReader(bytes.NewReader(test.encrypted), test.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(dec); err == nil {
+			t.Fatalf("%s: no error", test.name)
+		}
+	}
+
+	if _, err := key.DecryptReader(bytes.NewReader(encrypted), -1); err == nil {
+		t.Fatal("negative size accepted")
+	}
+
+	// Padding inside the last block is removed, any size rounding to the same blocks is valid
+	dec, _ := key.DecryptReader(bytes.NewReader(encrypted), 97)
+	if decrypted, err := ioutil.ReadAll(dec); err != nil || !bytes.Equal(decrypted, data[:97]) {
+		t.Fatal(err)
+	}
+}
+
+func TestFileWrongKey(t *testing.T) {
+	key := testFileKey()
+	data := testFile(1000)
+	encrypted, _ := encryptFile(t, key, data)
+
+	wrongKey := testFileKey()
+	wrongKey.Key[0] ^= 1
+	wrongIV := testFileKey()
+	wrongIV.IV[0] ^= 1
+
+	for _, other := range []*FileKey{wrongKey, wrongIV} {
+		dec, err := other.DecryptReader(bytes.NewReader(encrypted), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := ioutil.ReadAll(dec)
+		if err != nil || bytes.Equal(decrypted[:16], data[:16]) {
+			t.Fatal("decrypted with the wrong key", err)
+		}
+	}
+
+	// Keys must be 32 bytes and iv 32 bytes
+	short := &FileKey{Key: key.Key[:16], IV: key.IV}
+	if _, err := short.EncryptReader(bytes.NewReader(data)); err == nil {
+		t.Fatal("short key accepted")
+	}
+	if _, err := short.DecryptReader(bytes.NewReader(encrypted), 1000); err == nil {
+		t.Fatal("short key accepted")
+	}
+}
+
+func TestFileKeyFingerprint(t *testing.T) {
+	// md5(00..3f) = b2d3f56bc197fd985d5965079b5e7148, 0x6bf5d3b2 ^ 0x98fd97c1
+	if fingerprint := testFileKey().Fingerprint(); fingerprint != -217561997 {
+		t.Fatal(fingerprint)
+	}
+
+	key, err := FileKeyNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := FileKeyNew()
+	if len(key.Key) != 32 || len(key.IV) != 32 || bytes.Equal(key.Key, other.Key) || key.Fingerprint() == other.Fingerprint() {
+		t.Fatal("wrong random keys")
+	}
+}
+
+func TestFileSizes(t *testing.T) {
+	for _, test := range []struct {
+		size      int64
+		encrypted int64
+		parts     int32
+		big       bool
+	}{
+		{0, 0, 0, false},
+		{1, 16, 1, false},
+		{16, 16, 1, false},
+		{FilePartSize, FilePartSize, 1, false},
+		{FilePartSize + 1, FilePartSize + 16, 2, false},
+		{BigFileSize, BigFileSize, BigFileSize / FilePartSize, false},
+		{BigFileSize + 1, BigFileSize + 16, BigFileSize/FilePartSize + 1, true},
+	} {
+		if EncryptedSize(test.size) != test.encrypted || FileParts(test.size) != test.parts || IsBigFile(test.size) != test.big {
+			t.Fatalf("size %d: %d bytes, %d parts, big %v", test.size, EncryptedSize(test.size), FileParts(test.size), IsBigFile(test.size))
+		}
+	}
+}
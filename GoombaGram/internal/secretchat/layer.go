@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// https://core.telegram.org/api/end-to-end
+package secretchat
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Secret chat layer used for outgoing messages
+const Layer = 101
+
+// Minimum layer that uses MTProto 2.0 for secret chats
+const minLayer = 73
+
+// decryptedMessageLayer#1be31789 random_bytes:bytes layer:int in_seq_no:int out_seq_no:int message:DecryptedMessage = DecryptedMessageLayer;
+const crcDecryptedMessageLayer = 0x1be31789
+
+// Minimum length of random_bytes
+const layerRandomBytes = 15
+
+// Decrypted message with its layer and sequence numbers (DecryptedMessageLayer)
+type Message struct {
+	Layer    int32
+	InSeqNo  int32
+	OutSeqNo int32
+	Message  []byte // serialized DecryptedMessage
+}
+
+// Serialize a DecryptedMessageLayer
+func encodeLayer(message *Message, randomBytes []byte) []byte {
+	result := make([]byte, 4, 4+len(randomBytes)+4+12+len(message.Message))
+	binary.LittleEndian.PutUint32(result, crcDecryptedMessageLayer)
+	result = appendTLBytes(result, randomBytes)
+
+	ints := make([]byte, 12)
+	binary.LittleEndian.PutUint32(ints[0:], uint32(message.Layer))
+	binary.LittleEndian.PutUint32(ints[4:], uint32(message.InSeqNo))
+	binary.LittleEndian.PutUint32(ints[8:], uint32(message.OutSeqNo))
+	result = append(result, ints...)
+
+	return append(result, message.Message...)
+}
+
+// Parse a DecryptedMessageLayer
+func decodeLayer(data []byte) (*Message, error) {
+	if len(data) < 4 || binary.LittleEndian.Uint32(data) != crcDecryptedMessageLayer {
+		return nil, errors.New("secret chat: message isn't a decryptedMessageLayer")
+	}
+
+	randomBytes, offset, err := readTLBytes(data, 4)
+	if err != nil {
+		return nil, err
+	}
+	if len(randomBytes) < layerRandomBytes {
+		return nil, errors.New("secret chat: random_bytes is too short")
+	}
+
+	if offset+12 > len(data) {
+		return nil, errors.New("secret chat: too few bytes to decode")
+	}
+
+	message := make([]byte, len(data)-offset-12)
+	copy(message, data[offset+12:])
+
+	return &Message{
+		Layer:    int32(binary.LittleEndian.Uint32(data[offset:])),
+		InSeqNo:  int32(binary.LittleEndian.Uint32(data[offset+4:])),
+		OutSeqNo: int32(binary.LittleEndian.Uint32(data[offset+8:])),
+		Message:  message,
+	}, nil
+}
+
+// Append TL bytes (length, data and padding to 4 bytes)
+func appendTLBytes(dst, data []byte) []byte {
+	var header []byte
+	if len(data) <= 253 {
+		header = []byte{byte(len(data))}
+	} else {
+		header = []byte{254, byte(len(data)), byte(len(data) >> 8), byte(len(data) >> 16)}
+	}
+
+	dst = append(dst, header...)
+	dst = append(dst, data...)
+
+	padding := (4 - (len(header)+len(data))%4) % 4
+	return append(dst, make([]byte, padding)...)
+}
+
+// Read TL bytes starting from offset, returns data and the new offset
+func readTLBytes(data []byte, offset int) ([]byte, int, error) {
+	if offset >= len(data) {
+		return nil, 0, errors.New("secret chat: too few bytes to decode")
+	}
+
+	size := int(data[offset])
+	header := 1
+	if size == 254 {
+		if offset+4 > len(data) {
+			return nil, 0, errors.New("secret chat: too few bytes to decode")
+		}
+		size = int(data[offset+1]) | int(data[offset+2])<<8 | int(data[offset+3])<<16
+		header = 4
+	}
+
+	end := offset + header + size
+	padded := end + (4-(header+size)%4)%4
+	if padded > len(data) {
+		return nil, 0, errors.New("secret chat: wrong bytes length")
+	}
+
+	return data[offset+header : end], padded, nil
+}
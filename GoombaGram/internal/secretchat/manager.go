@@ -0,0 +1,858 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package secretchat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Message already received (replay or duplicate)
+var ErrDuplicate = errors.New("secret chat: duplicate message")
+
+// Some messages are missing, decryptedMessageActionResend(Start, End) must be sent.
+// The message that revealed the gap is kept and returned when the missing ones arrive.
+type GapError struct {
+	Start, End int32 // out_seq_no of the first and last missing messages
+}
+
+func (gap *GapError) Error() string {
+	return fmt.Sprintf("secret chat: missing messages from seq_no %d to %d", gap.Start, gap.End)
+}
+
+// New secret chat created by this client, before messages.requestEncryption
+type Exchange struct {
+	G       int32
+	P       []byte
+	GA      []byte // g_a for messages.requestEncryption
+	private []byte
+}
+
+// Secret chats manager
+//
+// Chat creation (this client):  Request -> messages.requestEncryption -> Waiting -> (encryptedChat) Complete
+// Chat creation (other client): (encryptedChatRequested) Accept -> messages.acceptEncryption
+// Key change (this client):     StartRekey -> requestKey -> (acceptKey) CommitRekey -> commitKey -> SwitchKey
+// Key change (other client):    (requestKey) AcceptRekey -> acceptKey -> (commitKey) FinishRekey -> noop
+type Manager struct {
+	mutex      sync.Mutex
+	chats      map[int32]*Chat
+	storage    Storage // nil: chats are kept only in memory
+	passphrase []byte
+	key        *crypto.EnvelopeKey // key of the stored chats, derived at the first use
+}
+
+// Create a manager and load the chats saved in storage, encrypted with passphrase (PBKDF2 key, AES-256-GCM envelope)
+func ManagerNew(storage Storage, passphrase []byte) (*Manager, error) {
+	manager := &Manager{
+		chats:      make(map[int32]*Chat),
+		storage:    storage,
+		passphrase: passphrase,
+	}
+
+	if storage == nil {
+		return manager, nil
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("secret chat: storage passphrase is empty")
+	}
+
+	saved, err := storage.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for chatID, data := range saved {
+		chat, err := manager.load(data)
+		if err != nil {
+			return nil, fmt.Errorf("secret chat %d: %v", chatID, err)
+		}
+		manager.chats[chatID] = chat
+	}
+
+	return manager, nil
+}
+
+// Decrypt a chat and its records
+func (m *Manager) load(data [][]byte) (*Chat, error) {
+	plaintext, err := m.open(data[0])
+	if err != nil {
+		return nil, err
+	}
+
+	chat, err := unmarshalChat(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	records := data[1:]
+	for i, envelope := range records {
+		record, err := m.loadRecord(envelope)
+		if err != nil {
+			// The last record may have been broken by a crash, the chat is still usable without it.
+			// Save the chat again so the next records aren't appended after the broken one.
+			if i == len(records)-1 {
+				return chat, m.save(chat)
+			}
+			return nil, err
+		}
+		chat.apply(record)
+	}
+
+	return chat, nil
+}
+
+// Decrypt a record of a chat
+func (m *Manager) loadRecord(envelope []byte) (*chatRecord, error) {
+	plaintext, err := m.open(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalRecord(plaintext)
+}
+
+// Encrypt data for the storage
+func (m *Manager) seal(data []byte) ([]byte, error) {
+	if m.key == nil {
+		key, err := crypto.EnvelopeKeyNew(m.passphrase)
+		if err != nil {
+			return nil, err
+		}
+		m.key = key
+	}
+
+	return m.key.Seal(data)
+}
+
+// Decrypt data of the storage
+func (m *Manager) open(envelope []byte) ([]byte, error) {
+	if m.key != nil && m.key.Matches(envelope) {
+		return m.key.Open(envelope)
+	}
+
+	data, key, err := crypto.OpenEnvelope(m.passphrase, envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys with old parameters are replaced at the next save
+	if !key.Outdated() {
+		m.key = key
+	}
+
+	return data, nil
+}
+
+// Save a chat in the storage
+func (m *Manager) save(chat *Chat) error {
+	if m.storage == nil {
+		return nil
+	}
+
+	data, err := marshalChat(chat)
+	if err != nil {
+		return err
+	}
+
+	envelope, err := m.seal(data)
+	if err != nil {
+		return err
+	}
+
+	err = m.storage.Save(chat.ID, envelope)
+	if err != nil {
+		return err
+	}
+
+	chat.records = 0
+	return nil
+}
+
+// Append the changes after a message to the storage (sent is the encrypted message sent, nil if none).
+// The whole chat is saved again after chatRecords records.
+func (m *Manager) append(chat *Chat, sent []byte) error {
+	if m.storage == nil {
+		return nil
+	}
+	if chat.records >= chatRecords {
+		return m.save(chat)
+	}
+
+	data, err := marshalRecord(chat.record(sent))
+	if err != nil {
+		return err
+	}
+
+	envelope, err := m.seal(data)
+	if err != nil {
+		return err
+	}
+
+	err = m.storage.Append(chat.ID, envelope)
+	if err != nil {
+		return err
+	}
+
+	chat.records++
+	return nil
+}
+
+// Get a chat (the caller must hold the mutex)
+func (m *Manager) chat(chatID int32) (*Chat, error) {
+	chat, ok := m.chats[chatID]
+	if !ok {
+		return nil, fmt.Errorf("secret chat %d doesn't exist", chatID)
+	}
+
+	return chat, nil
+}
+
+// Get a chat ready to send and receive messages (the caller must hold the mutex)
+func (m *Manager) readyChat(chatID int32) (*Chat, error) {
+	chat, err := m.chat(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	if chat.State != StateReady {
+		return nil, fmt.Errorf("secret chat %d isn't ready", chatID)
+	}
+
+	return chat, nil
+}
+
+// Check Diffie-Hellman parameters from messages.getDhConfig
+func dhParams(g int32, p []byte) (*big.Int, error) {
+	prime := new(big.Int).SetBytes(p)
+	err := crypto.CheckDHParams(g, prime)
+	if err != nil {
+		return nil, err
+	}
+
+	return prime, nil
+}
+
+// Random exchange id
+func randomInt64() (int64, error) {
+	buffer := make([]byte, 8)
+	_, err := crypto.ReadRandom(buffer)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(binary.LittleEndian.Uint64(buffer)), nil
+}
+
+// Start a new secret chat, g and p come from messages.getDhConfig
+func (m *Manager) Request(g int32, p []byte) (*Exchange, error) {
+	prime, err := dhParams(g, p)
+	if err != nil {
+		return nil, err
+	}
+
+	private, public, err := dhGenerate(g, prime)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Exchange{
+		G:       g,
+		P:       p,
+		GA:      public,
+		private: private,
+	}, nil
+}
+
+// Save the chat returned by messages.requestEncryption (encryptedChatWaiting)
+func (m *Manager) Waiting(chatID int32, accessHash int64, exchange *Exchange) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat := &Chat{
+		ID:              chatID,
+		AccessHash:      accessHash,
+		Originator:      true,
+		State:           StateWaiting,
+		Layer:           minLayer,
+		G:               exchange.G,
+		P:               exchange.P,
+		ExchangePrivate: exchange.private,
+	}
+	m.chats[chatID] = chat
+
+	return m.save(chat)
+}
+
+// Complete a chat created by this client when encryptedChat is received
+func (m *Manager) Complete(chatID int32, gB []byte, fingerprint int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.chat(chatID)
+	if err != nil {
+		return err
+	}
+	if chat.State != StateWaiting || !chat.Originator {
+		return fmt.Errorf("secret chat %d isn't waiting for the key", chatID)
+	}
+
+	key, err := dhKey(chat.ExchangePrivate, gB, new(big.Int).SetBytes(chat.P))
+	if err != nil {
+		return err
+	}
+
+	if keyFingerprint(key) != fingerprint {
+		return errors.New("secret chat: key fingerprint mismatch")
+	}
+
+	chat.setKey(key, time.Now())
+	chat.State = StateReady
+
+	return m.save(chat)
+}
+
+// Accept a chat requested by another user (encryptedChatRequested).
+// It returns g_b and key_fingerprint for messages.acceptEncryption.
+func (m *Manager) Accept(chatID int32, accessHash int64, g int32, p, gA []byte) ([]byte, int64, error) {
+	prime, err := dhParams(g, p)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	private, public, err := dhGenerate(g, prime)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	key, err := dhKey(private, gA, prime)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat := &Chat{
+		ID:         chatID,
+		AccessHash: accessHash,
+		State:      StateReady,
+		Layer:      minLayer,
+		G:          g,
+		P:          p,
+	}
+	chat.setKey(key, time.Now())
+	m.chats[chatID] = chat
+
+	err = m.save(chat)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return public, chat.KeyFingerprint, nil
+}
+
+// Close a chat (encryptedChatDiscarded or messages.discardEncryption) and remove it from the storage
+func (m *Manager) Discard(chatID int32) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.chats, chatID)
+
+	if m.storage == nil {
+		return nil
+	}
+	return m.storage.Delete(chatID)
+}
+
+// Get the state of a chat
+func (m *Manager) State(chatID int32) (State, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.chat(chatID)
+	if err != nil {
+		return 0, err
+	}
+
+	return chat.State, nil
+}
+
+// Get the fingerprint of the current key of a chat
+func (m *Manager) KeyFingerprint(chatID int32) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.readyChat(chatID)
+	if err != nil {
+		return 0, err
+	}
+
+	return chat.KeyFingerprint, nil
+}
+
+// Encrypt a message with the given raw out sequence number (the caller must hold the mutex)
+func (m *Manager) encrypt(chat *Chat, rawOut int32, message []byte) ([]byte, error) {
+	randomBytes := make([]byte, layerRandomBytes)
+	_, err := crypto.ReadRandom(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	inSeqNo, outSeqNo := chat.seqNo(rawOut)
+	layer := encodeLayer(&Message{
+		Layer:    Layer,
+		InSeqNo:  inSeqNo,
+		OutSeqNo: outSeqNo,
+		Message:  message,
+	}, randomBytes)
+
+	result, err := encryptMessage(chat.Key, chat.KeyFingerprint, layer, chat.outX())
+	if err != nil {
+		return nil, err
+	}
+
+	chat.KeyUsed++
+	return result, nil
+}
+
+// Encrypt a serialized DecryptedMessage for messages.sendEncrypted (or sendEncryptedService)
+func (m *Manager) Encrypt(chatID int32, message []byte) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.readyChat(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := m.encrypt(chat, chat.RawOutSeqNo, message)
+	if err != nil {
+		return nil, err
+	}
+
+	chat.remember(chat.RawOutSeqNo, result)
+	chat.RawOutSeqNo++
+
+	err = m.append(chat, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Messages requested by decryptedMessageActionResend (out_seq_no from start to end), as they were sent.
+// Messages sent with the previous key are encrypted again with the current one.
+func (m *Manager) Resend(chatID int32, startSeqNo, endSeqNo int32) ([][]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.readyChat(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	parity := chat.outParity()
+	if (startSeqNo-parity)%2 != 0 || (endSeqNo-parity)%2 != 0 || startSeqNo > endSeqNo {
+		return nil, errors.New("secret chat: wrong resend range")
+	}
+
+	start, end := (startSeqNo-parity)/2, (endSeqNo-parity)/2
+	if start < 0 || end >= chat.RawOutSeqNo {
+		return nil, errors.New("secret chat: resend range contains messages never sent")
+	}
+
+	result := make([][]byte, 0, end-start+1)
+	reencrypted := false
+	for rawOut := start; rawOut <= end; rawOut++ {
+		sent, ok := chat.Sent[rawOut]
+		if !ok || len(sent) < 8 {
+			return nil, fmt.Errorf("secret chat: message %d isn't available anymore", 2*rawOut+parity)
+		}
+
+		fingerprint := int64(binary.LittleEndian.Uint64(sent))
+		if fingerprint == chat.KeyFingerprint {
+			result = append(result, sent)
+			continue
+		}
+		if chat.OldKey == nil || fingerprint != chat.OldKeyFingerprint {
+			return nil, fmt.Errorf("secret chat: message %d isn't available anymore", 2*rawOut+parity)
+		}
+
+		layer, err := decryptMessage(chat.OldKey, sent, chat.outX())
+		if err != nil {
+			return nil, err
+		}
+
+		encrypted, err := encryptMessage(chat.Key, chat.KeyFingerprint, layer, chat.outX())
+		if err != nil {
+			return nil, err
+		}
+		chat.KeyUsed++
+		reencrypted = true
+
+		result = append(result, encrypted)
+	}
+
+	if !reencrypted {
+		return result, nil
+	}
+
+	err = m.append(chat, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Decrypt an encrypted message (encryptedMessage or encryptedMessageService bytes).
+// It returns the messages that can be processed in order: empty on a gap (GapError),
+// or more than one when a gap is filled.
+func (m *Manager) Decrypt(chatID int32, data []byte) ([]*Message, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.readyChat(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 8 {
+		return nil, errors.New("secret chat: message is too short")
+	}
+
+	// Select the key using the fingerprint
+	fingerprint := int64(binary.LittleEndian.Uint64(data))
+	var key []byte
+	switch {
+	case fingerprint == chat.KeyFingerprint:
+		key = chat.Key
+	case chat.OldKey != nil && fingerprint == chat.OldKeyFingerprint:
+		key = chat.OldKey
+	default:
+		return nil, errors.New("secret chat: unknown key fingerprint")
+	}
+
+	plaintext, err := decryptMessage(key, data, chat.inX())
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := decodeLayer(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.Layer < minLayer {
+		return nil, fmt.Errorf("secret chat: layer %d isn't supported", message.Layer)
+	}
+
+	if fingerprint == chat.KeyFingerprint {
+		chat.KeyUsed++
+	}
+
+	// Check sequence numbers parity
+	if (message.OutSeqNo-chat.inParity())%2 != 0 || (message.InSeqNo-chat.outParity())%2 != 0 {
+		return nil, errors.New("secret chat: wrong sequence number parity")
+	}
+
+	// The other participant can't have received more messages than the ones sent
+	if (message.InSeqNo-chat.outParity())/2 > chat.RawOutSeqNo {
+		return nil, errors.New("secret chat: in_seq_no is bigger than the sent messages")
+	}
+
+	rawOut := (message.OutSeqNo - chat.inParity()) / 2
+	switch {
+	case rawOut < chat.RawInSeqNo || chat.pending[rawOut] != nil:
+		return nil, ErrDuplicate
+
+	case rawOut > chat.RawInSeqNo:
+		if chat.pending == nil {
+			chat.pending = make(map[int32]*Message)
+		}
+		chat.pending[rawOut] = message
+
+		return nil, &GapError{
+			Start: 2*chat.RawInSeqNo + chat.inParity(),
+			End:   2*(rawOut-1) + chat.inParity(),
+		}
+	}
+
+	// Message in order, deliver it with the pending messages that follow it
+	result := []*Message{message}
+	chat.RawInSeqNo++
+	for {
+		next, ok := chat.pending[chat.RawInSeqNo]
+		if !ok {
+			break
+		}
+		delete(chat.pending, chat.RawInSeqNo)
+		result = append(result, next)
+		chat.RawInSeqNo++
+	}
+
+	for _, received := range result {
+		if received.Layer > chat.Layer {
+			chat.Layer = received.Layer
+		}
+	}
+
+	err = m.append(chat, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Check if the key of a chat must be changed (100 messages or a week)
+func (m *Manager) NeedsRekey(chatID int32) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.readyChat(chatID)
+	if err != nil {
+		return false
+	}
+
+	return chat.NeedsRekey(time.Now())
+}
+
+// Start a key change, returns exchange_id and g_a for decryptedMessageActionRequestKey
+func (m *Manager) StartRekey(chatID int32) (int64, []byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.readyChat(chatID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if chat.ExchangeID != 0 {
+		return 0, nil, errors.New("secret chat: key change already in progress")
+	}
+
+	exchangeID, err := randomInt64()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	private, public, err := dhGenerate(chat.G, new(big.Int).SetBytes(chat.P))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	chat.ExchangeID = exchangeID
+	chat.ExchangePrivate = private
+
+	err = m.save(chat)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return exchangeID, public, nil
+}
+
+// Accept a key change (decryptedMessageActionRequestKey).
+// It returns g_b and key_fingerprint for decryptedMessageActionAcceptKey.
+// If both clients started a key change, the one with the bigger exchange_id wins.
+func (m *Manager) AcceptRekey(chatID int32, exchangeID int64, gA []byte) ([]byte, int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.readyChat(chatID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if chat.ExchangeID != 0 && chat.ExchangeID > exchangeID {
+		return nil, 0, errors.New("secret chat: key change already in progress")
+	}
+
+	prime := new(big.Int).SetBytes(chat.P)
+	private, public, err := dhGenerate(chat.G, prime)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	key, err := dhKey(private, gA, prime)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	chat.ExchangeID = exchangeID
+	chat.ExchangePrivate = nil
+	chat.ExchangeKey = key
+
+	err = m.save(chat)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return public, keyFingerprint(key), nil
+}
+
+// Check the key accepted by the other client (decryptedMessageActionAcceptKey).
+// It returns key_fingerprint for decryptedMessageActionCommitKey, that must be sent
+// with the old key before calling SwitchKey.
+func (m *Manager) CommitRekey(chatID int32, exchangeID int64, gB []byte, fingerprint int64) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.readyChat(chatID)
+	if err != nil {
+		return 0, err
+	}
+	if chat.ExchangeID != exchangeID || chat.ExchangePrivate == nil {
+		return 0, errors.New("secret chat: unknown key exchange")
+	}
+
+	key, err := dhKey(chat.ExchangePrivate, gB, new(big.Int).SetBytes(chat.P))
+	if err != nil {
+		return 0, err
+	}
+
+	if keyFingerprint(key) != fingerprint {
+		return 0, errors.New("secret chat: key fingerprint mismatch")
+	}
+
+	chat.ExchangePrivate = nil
+	chat.ExchangeKey = key
+
+	err = m.save(chat)
+	if err != nil {
+		return 0, err
+	}
+
+	return fingerprint, nil
+}
+
+// Start using the new key after decryptedMessageActionCommitKey has been sent
+func (m *Manager) SwitchKey(chatID int32, exchangeID int64) error {
+	return m.switchKey(chatID, exchangeID, 0, false)
+}
+
+// Start using the new key when decryptedMessageActionCommitKey is received.
+// A decryptedMessageActionNoop should then be sent with the new key.
+func (m *Manager) FinishRekey(chatID int32, exchangeID int64, fingerprint int64) error {
+	return m.switchKey(chatID, exchangeID, fingerprint, true)
+}
+
+func (m *Manager) switchKey(chatID int32, exchangeID int64, fingerprint int64, checkFingerprint bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.readyChat(chatID)
+	if err != nil {
+		return err
+	}
+	if chat.ExchangeID != exchangeID || chat.ExchangeKey == nil {
+		return errors.New("secret chat: unknown key exchange")
+	}
+
+	if checkFingerprint && keyFingerprint(chat.ExchangeKey) != fingerprint {
+		return errors.New("secret chat: key fingerprint mismatch")
+	}
+
+	chat.setKey(chat.ExchangeKey, time.Now())
+
+	return m.save(chat)
+}
+
+// Cancel a key change (decryptedMessageActionAbortKey)
+func (m *Manager) AbortRekey(chatID int32, exchangeID int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.chat(chatID)
+	if err != nil {
+		return err
+	}
+	if chat.ExchangeID != exchangeID {
+		return nil
+	}
+
+	chat.ExchangeID = 0
+	chat.ExchangePrivate = nil
+	chat.ExchangeKey = nil
+
+	return m.save(chat)
+}
+
+// Set the messages time to live of a chat (decryptedMessageActionSetMessageTTL)
+func (m *Manager) SetTTL(chatID int32, ttl int32) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.chat(chatID)
+	if err != nil {
+		return err
+	}
+
+	chat.TTL = ttl
+	return m.save(chat)
+}
+
+// Start the self-destruct timer of a message when it has been read.
+// ttl is the message ttl, 0 to use the chat one.
+func (m *Manager) MessageRead(chatID int32, randomID int64, ttl int32) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chat, err := m.chat(chatID)
+	if err != nil {
+		return err
+	}
+
+	if ttl == 0 {
+		ttl = chat.TTL
+	}
+	if ttl <= 0 {
+		return nil
+	}
+
+	chat.scheduleDestruct(randomID, ttl, time.Now())
+	return m.save(chat)
+}
+
+// Return (and forget) the random_id of the messages that must be deleted, by chat
+func (m *Manager) ExpiredMessages(now time.Time) (map[int32][]int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := make(map[int32][]int64)
+	for chatID, chat := range m.chats {
+		expired := chat.expired(now)
+		if len(expired) == 0 {
+			continue
+		}
+
+		result[chatID] = expired
+		err := m.save(chat)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
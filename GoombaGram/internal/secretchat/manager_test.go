@@ -0,0 +1,377 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package secretchat
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 2048-bit safe prime of messages.getDhConfig (g = 3)
+const testPrime = "c71caeb9c6b1c9048e6c522f70f13f73980d40238e3e21c14934d037563d930f48198a0aa7c14058229493d22530f4dbfa336f6e0ac925139543aed44cce7c3720fd51f69458705ac68cd4fe6b6b13abdc9746512969328454f18faf8c595f642477fe96bb2a941d5bcd1d4ac8cc49880708fa9b378e3c4f3a9060bee67cf9a4a4a695811051907e162753b56b0f6b410dba74d8a84b2a14b3144e0ef1284754fd17ed950d5965b4b9dd46582db1178d169c6bc465b0d6ff9ca3928fef5b9ae4e418fc15e83ebea0f87fa9ff5eed70050ded2849f47bf959d956850ce929851f0d8115f635b105ee2e4e15d04b2454bf6f4fadf034b10403119cd8e3b92fcc5b"
+
+const testChatID = 7
+
+// Secret chat between alice (creator) and bob
+func testChat(t *testing.T, alice, bob *Manager) {
+	t.Helper()
+
+	prime, _ := new(big.Int).SetString(testPrime, 16)
+	exchange, err := alice.Request(3, prime.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Waiting(testChatID, 1, exchange); err != nil {
+		t.Fatal(err)
+	}
+
+	gB, fingerprint, err := bob.Accept(testChatID, 1, 3, prime.Bytes(), exchange.GA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Complete(testChatID, gB, fingerprint); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Change the key of the chat, started by alice
+func testRekey(t *testing.T, alice, bob *Manager) {
+	t.Helper()
+
+	exchangeID, gA, err := alice.StartRekey(testChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gB, fingerprint, err := bob.AcceptRekey(testChatID, exchangeID, gA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := alice.CommitRekey(testChatID, exchangeID, gB, fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SwitchKey(testChatID, exchangeID); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.FinishRekey(testChatID, exchangeID, commit); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func send(t *testing.T, from, to *Manager, message string) {
+	t.Helper()
+
+	encrypted, err := from.Encrypt(testChatID, []byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := to.Decrypt(testChatID, encrypted)
+	if err != nil || len(received) != 1 || string(received[0].Message) != message {
+		t.Fatal(received, err)
+	}
+}
+
+func TestManager(t *testing.T) {
+	alice, _ := ManagerNew(nil, nil)
+	bob, _ := ManagerNew(nil, nil)
+	testChat(t, alice, bob)
+
+	send(t, alice, bob, "hello")
+	send(t, bob, alice, "hi")
+
+	// bob receives the second message first
+	first, _ := alice.Encrypt(testChatID, []byte("first"))
+	second, _ := alice.Encrypt(testChatID, []byte("second"))
+
+	_, err := bob.Decrypt(testChatID, second)
+	var gap *GapError
+	if !errors.As(err, &gap) || gap.Start != 3 || gap.End != 3 {
+		t.Fatal(err)
+	}
+
+	resent, err := alice.Resend(testChatID, gap.Start, gap.End)
+	if err != nil || len(resent) != 1 {
+		t.Fatal(err)
+	}
+	received, err := bob.Decrypt(testChatID, resent[0])
+	if err != nil || len(received) != 2 || string(received[0].Message) != "first" || string(received[1].Message) != "second" {
+		t.Fatal(received, err)
+	}
+	if _, err := bob.Decrypt(testChatID, first); err != ErrDuplicate {
+		t.Fatal(err)
+	}
+
+	if _, err := alice.Resend(testChatID, 1, 9); err == nil {
+		t.Fatal("messages never sent resent")
+	}
+	if _, err := alice.Resend(testChatID, 2, 2); err == nil {
+		t.Fatal("wrong parity accepted")
+	}
+}
+
+func TestManagerResendAfterRekey(t *testing.T) {
+	alice, _ := ManagerNew(nil, nil)
+	bob, _ := ManagerNew(nil, nil)
+	testChat(t, alice, bob)
+
+	// Lost message, sent with the first key
+	if _, err := alice.Encrypt(testChatID, []byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+
+	testRekey(t, alice, bob)
+
+	// The message is encrypted again with the new key, bob has already dropped the first one
+	bob.chats[testChatID].OldKey = nil
+	resent, err := alice.Resend(testChatID, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := bob.Decrypt(testChatID, resent[0])
+	if err != nil || string(received[0].Message) != "lost" || received[0].OutSeqNo != 1 {
+		t.Fatal(received, err)
+	}
+
+	// Messages sent two keys ago can't be decrypted anymore
+	testRekey(t, alice, bob)
+	if _, err := alice.Resend(testChatID, 1, 1); err == nil {
+		t.Fatal("message of an old key resent")
+	}
+}
+
+func TestManagerStorage(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := FileStorageNew(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ManagerNew(storage, nil); err == nil {
+		t.Fatal("storage without passphrase")
+	}
+
+	alice, err := ManagerNew(storage, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, _ := ManagerNew(nil, nil)
+	testChat(t, alice, bob)
+
+	saved, err := ioutil.ReadFile(filepath.Join(dir, "7.chat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages are appended, the chat isn't saved again
+	for i := 0; i < 10; i++ {
+		send(t, alice, bob, "secret message")
+		send(t, bob, alice, "secret answer")
+	}
+	current, _ := ioutil.ReadFile(filepath.Join(dir, "7.chat"))
+	if !bytes.Equal(saved, current) {
+		t.Fatal("chat saved after every message")
+	}
+
+	// Neither keys nor messages are stored in plaintext
+	key := alice.chats[testChatID].Key
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		for _, secret := range [][]byte{key, key[:16], []byte("secret"), []byte("Key")} {
+			if bytes.Contains(data, secret) {
+				t.Fatalf("%s contains %q", file.Name(), secret)
+			}
+		}
+	}
+
+	if _, err := ManagerNew(storage, []byte("wrong")); err == nil {
+		t.Fatal("wrong passphrase accepted")
+	}
+
+	// After a restart the counters continue and sent messages can be resent
+	restarted, err := ManagerNew(storage, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, after := alice.chats[testChatID], restarted.chats[testChatID]
+	if after.RawInSeqNo != before.RawInSeqNo || after.RawOutSeqNo != before.RawOutSeqNo || after.KeyUsed != before.KeyUsed || len(after.Sent) != len(before.Sent) {
+		t.Fatalf("chat after restart %+v, expected %+v", after, before)
+	}
+	send(t, restarted, bob, "after restart")
+
+	resent, err := restarted.Resend(testChatID, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resent[0], before.Sent[0]) {
+		t.Fatal("resent message differs")
+	}
+
+	// A key change saves the chat and drops the records
+	testRekey(t, restarted, bob)
+	if _, err := os.Stat(filepath.Join(dir, "7.log")); !os.IsNotExist(err) {
+		t.Fatal("records kept after a save", err)
+	}
+
+	if err := restarted.Discard(testChatID); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatal("files left after discard", files)
+	}
+}
+
+func TestManagerStorageCompaction(t *testing.T) {
+	dir := t.TempDir()
+	storage, _ := FileStorageNew(dir)
+	alice, _ := ManagerNew(storage, []byte("passphrase"))
+	bob, _ := ManagerNew(nil, nil)
+	testChat(t, alice, bob)
+
+	for i := 0; i <= chatRecords; i++ {
+		send(t, alice, bob, "message")
+	}
+
+	saved, err := storage.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := len(saved[testChatID]) - 1; records > chatRecords {
+		t.Fatalf("%d records, the chat should have been saved", records)
+	}
+
+	restarted, err := ManagerNew(storage, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seqNo := restarted.chats[testChatID].RawOutSeqNo; seqNo != chatRecords+1 {
+		t.Fatalf("raw out_seq_no %d after restart", seqNo)
+	}
+}
+
+func TestManagerStorageBrokenRecord(t *testing.T) {
+	dir := t.TempDir()
+	storage, _ := FileStorageNew(dir)
+	alice, _ := ManagerNew(storage, []byte("passphrase"))
+	bob, _ := ManagerNew(nil, nil)
+	testChat(t, alice, bob)
+	send(t, alice, bob, "first")
+
+	// Complete record that can't be decrypted, written by a crash
+	if err := storage.Append(testChatID, []byte("broken")); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := ManagerNew(storage, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seqNo := restarted.chats[testChatID].RawOutSeqNo; seqNo != 1 {
+		t.Fatalf("raw out_seq_no %d after restart", seqNo)
+	}
+
+	// The chat has been saved again without the broken record, the next records can be loaded
+	send(t, restarted, bob, "second")
+	restarted, err = ManagerNew(storage, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seqNo := restarted.chats[testChatID].RawOutSeqNo; seqNo != 2 {
+		t.Fatalf("raw out_seq_no %d after restart", seqNo)
+	}
+
+	// A broken record before other records is still an error
+	if err := storage.Append(testChatID, []byte("broken")); err != nil {
+		t.Fatal(err)
+	}
+	send(t, restarted, bob, "third")
+	if _, err := ManagerNew(storage, []byte("passphrase")); err == nil {
+		t.Fatal("broken record in the middle accepted")
+	}
+}
+
+func TestChatApply(t *testing.T) {
+	chat := &Chat{KeyFingerprint: 1, KeyUsed: 5, RawInSeqNo: 3, RawOutSeqNo: 4, Layer: 46}
+
+	// Records older than the chat don't change it
+	chat.apply(&chatRecord{KeyFingerprint: 1, KeyUsed: 2, RawInSeqNo: 1, RawOutSeqNo: 2, Layer: 17, Sent: []byte{1}})
+	chat.apply(&chatRecord{KeyFingerprint: 2, KeyUsed: 50, RawInSeqNo: 1, RawOutSeqNo: 2})
+	if chat.KeyUsed != 5 || chat.RawInSeqNo != 3 || chat.RawOutSeqNo != 4 || chat.Layer != 46 || len(chat.Sent) != 0 {
+		t.Fatalf("chat changed by an old record: %+v", chat)
+	}
+
+	chat.apply(&chatRecord{KeyFingerprint: 1, KeyUsed: 6, RawInSeqNo: 3, RawOutSeqNo: 5, Layer: 46, Sent: []byte{2}})
+	if chat.KeyUsed != 6 || chat.RawOutSeqNo != 5 || !bytes.Equal(chat.Sent[4], []byte{2}) {
+		t.Fatalf("record not applied: %+v", chat)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	storage, _ := FileStorageNew(dir)
+
+	if err := storage.Save(1, []byte("chat")); err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []string{"first", "second"} {
+		if err := storage.Append(1, []byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Record cut by a crash
+	log, _ := os.OpenFile(filepath.Join(dir, "1.log"), os.O_WRONLY|os.O_APPEND, 0600)
+	_, _ = log.Write([]byte{10, 0, 0, 0, 't', 'h'})
+	_ = log.Close()
+
+	saved, err := storage.LoadAll()
+	if err != nil || len(saved) != 1 || len(saved[1]) != 3 || string(saved[1][0]) != "chat" || string(saved[1][2]) != "second" {
+		t.Fatalf("%q %v", saved, err)
+	}
+
+	// The cut record has been removed, the next record follows the complete ones
+	if err := storage.Append(1, []byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	saved, err = storage.LoadAll()
+	if err != nil || len(saved[1]) != 4 || string(saved[1][2]) != "second" || string(saved[1][3]) != "third" {
+		t.Fatalf("%q %v", saved, err)
+	}
+
+	if err := storage.Save(1, []byte("new chat")); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ = storage.LoadAll()
+	if len(saved[1]) != 1 || string(saved[1][0]) != "new chat" {
+		t.Fatalf("%q", saved)
+	}
+
+	if err := storage.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ = storage.LoadAll(); len(saved) != 0 {
+		t.Fatalf("%q", saved)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package secretchat
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Storage of the secret chats state, so chats survive restarts.
+// A chat is saved again only after key changes and other rare events, every message sent or received
+// appends a small record. Chats and records are encrypted by the Manager before they are stored.
+type Storage interface {
+	Save(chatID int32, data []byte) error     // replace the chat and its records
+	Append(chatID int32, record []byte) error // add a record to the saved chat
+	LoadAll() (map[int32][][]byte, error)     // every chat followed by its records
+	Delete(chatID int32) error
+}
+
+// Storage that saves every chat in a file inside a directory (<chat id>.chat),
+// with the records appended to another file (<chat id>.log)
+type FileStorage struct {
+	dir string
+}
+
+func FileStorageNew(dir string) (*FileStorage, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStorage{dir: dir}, nil
+}
+
+func (fs *FileStorage) path(chatID int32, extension string) string {
+	return filepath.Join(fs.dir, strconv.Itoa(int(chatID))+extension)
+}
+
+// Write the chat in a temporary file and then rename it, so a crash doesn't corrupt the old state.
+// Records left by a crash before the log removal are older than the chat, the Manager ignores them.
+func (fs *FileStorage) Save(chatID int32, data []byte) error {
+	temp := fs.path(chatID, ".chat.tmp")
+
+	err := ioutil.WriteFile(temp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(temp, fs.path(chatID, ".chat"))
+	if err != nil {
+		return err
+	}
+
+	return removeFile(fs.path(chatID, ".log"))
+}
+
+// Append a record with its length (uint32, little endian).
+// A record cut by a crash is removed by LoadAll, a failed write is removed at once,
+// so the next records are never written after a broken one.
+func (fs *FileStorage) Append(chatID int32, record []byte) error {
+	file, err := os.OpenFile(fs.path(chatID, ".log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	data := make([]byte, 4, 4+len(record))
+	binary.LittleEndian.PutUint32(data, uint32(len(record)))
+
+	_, err = file.Write(append(data, record...))
+	if err != nil {
+		_ = file.Truncate(info.Size())
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func (fs *FileStorage) LoadAll() (map[int32][][]byte, error) {
+	files, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[int32][][]byte)
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".chat") {
+			continue
+		}
+
+		chatID, err := strconv.Atoi(strings.TrimSuffix(name, ".chat"))
+		if err != nil {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(fs.dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		logPath := fs.path(int32(chatID), ".log")
+		log, err := ioutil.ReadFile(logPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		records, length := splitRecords(log)
+
+		// Remove a record cut by a crash, before the next Append writes after it
+		if length < len(log) {
+			err = os.Truncate(logPath, int64(length))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		result[int32(chatID)] = append([][]byte{data}, records...)
+	}
+
+	return result, nil
+}
+
+// Records of a log, without the last one if it's incomplete.
+// It also returns the length of the complete records.
+func splitRecords(log []byte) ([][]byte, int) {
+	var records [][]byte
+	offset := 0
+	for len(log)-offset >= 4 {
+		length := binary.LittleEndian.Uint32(log[offset:])
+		if uint64(length) > uint64(len(log)-offset-4) {
+			break
+		}
+
+		records = append(records, log[offset+4:offset+4+int(length)])
+		offset += 4 + int(length)
+	}
+
+	return records, offset
+}
+
+func (fs *FileStorage) Delete(chatID int32) error {
+	err := removeFile(fs.path(chatID, ".chat"))
+	if err != nil {
+		return err
+	}
+
+	return removeFile(fs.path(chatID, ".log"))
+}
+
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// Serialize a chat for the storage
+func marshalChat(chat *Chat) ([]byte, error) {
+	return json.Marshal(chat)
+}
+
+// Parse a chat saved in the storage
+func unmarshalChat(data []byte) (*Chat, error) {
+	chat := new(Chat)
+	err := json.Unmarshal(data, chat)
+	if err != nil {
+		return nil, err
+	}
+
+	return chat, nil
+}
+
+// Serialize a record for the storage
+func marshalRecord(record *chatRecord) ([]byte, error) {
+	return json.Marshal(record)
+}
+
+// Parse a record saved in the storage
+func unmarshalRecord(data []byte) (*chatRecord, error) {
+	record := new(chatRecord)
+	err := json.Unmarshal(data, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package session
+
+import (
+	"errors"
+	"github.com/GoombaGram/GoombaGram/GoombaGram/internal/crypto"
+	"sync"
+)
+
+// Session saved by the backend isn't encrypted (see EncryptedStorage.AllowPlaintext)
+var ErrNotEncrypted = errors.New("session: saved session isn't encrypted")
+
+// Storage that encrypts the session with a passphrase before passing it to another backend
+// (PBKDF2 key, AES-256-GCM envelope).
+type EncryptedStorage struct {
+	// Load a session saved without encryption (migration), it's encrypted at the next save.
+	// If false, Load returns ErrNotEncrypted: the backend may have been replaced.
+	AllowPlaintext bool
+
+	mutex      sync.Mutex
+	backend    Storage
+	passphrase []byte
+	key        *crypto.EnvelopeKey // derived key, cached after the first use
+}
+
+func EncryptedStorageNew(backend Storage, passphrase []byte) *EncryptedStorage {
+	return &EncryptedStorage{
+		backend:    backend,
+		passphrase: passphrase,
+	}
+}
+
+// Encrypt and save the session
+func (es *EncryptedStorage) Save(data []byte) error {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	return es.save(data)
+}
+
+func (es *EncryptedStorage) save(data []byte) error {
+	if es.key == nil {
+		key, err := crypto.EnvelopeKeyNew(es.passphrase)
+		if err != nil {
+			return err
+		}
+		es.key = key
+	}
+
+	return es.saveWith(es.key, data)
+}
+
+func (es *EncryptedStorage) saveWith(key *crypto.EnvelopeKey, data []byte) error {
+	envelope, err := key.Seal(data)
+	if err != nil {
+		return err
+	}
+
+	return es.backend.Save(envelope)
+}
+
+// Load and decrypt the session
+func (es *EncryptedStorage) Load() ([]byte, error) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	return es.load()
+}
+
+func (es *EncryptedStorage) load() ([]byte, error) {
+	envelope, err := es.backend.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	if !crypto.IsEnvelope(envelope) {
+		if !es.AllowPlaintext {
+			return nil, ErrNotEncrypted
+		}
+		return envelope, nil
+	}
+
+	if es.key != nil && es.key.Matches(envelope) {
+		return es.key.Open(envelope)
+	}
+
+	data, key, err := crypto.OpenEnvelope(es.passphrase, envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys with old parameters are replaced at the next save
+	if !key.Outdated() {
+		es.key = key
+	}
+
+	return data, nil
+}
+
+// Encrypt the saved session again with a new passphrase (and a new salt).
+// No other load or save can happen in the meantime, the new passphrase is used only if the backend saves the session.
+func (es *EncryptedStorage) Rotate(newPassphrase []byte) error {
+	if len(newPassphrase) == 0 {
+		return errors.New("session: new passphrase is empty")
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	data, err := es.load()
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	key, err := crypto.EnvelopeKeyNew(newPassphrase)
+	if err != nil {
+		return err
+	}
+
+	if data != nil {
+		err = es.saveWith(key, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	es.passphrase = newPassphrase
+	es.key = key
+	return nil
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package session
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestEncryptedStorage(t *testing.T) {
+	backend := FileStorageNew(filepath.Join(t.TempDir(), "session"))
+
+	if _, err := EncryptedStorageNew(backend, []byte("passphrase")).Load(); err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	storage := EncryptedStorageNew(backend, []byte("passphrase"))
+	if err := storage.Save([]byte("auth key")); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := backend.Load()
+	if err != nil || bytes.Contains(raw, []byte("auth key")) {
+		t.Fatal("session saved in plaintext", err)
+	}
+
+	data, err := EncryptedStorageNew(backend, []byte("passphrase")).Load()
+	if err != nil || string(data) != "auth key" {
+		t.Fatal(data, err)
+	}
+
+	if _, err := EncryptedStorageNew(backend, []byte("wrong")).Load(); err == nil {
+		t.Fatal("wrong passphrase accepted")
+	}
+}
+
+func TestEncryptedStoragePlaintext(t *testing.T) {
+	backend := new(MemoryStorage)
+	if err := backend.Save([]byte("auth key")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := EncryptedStorageNew(backend, []byte("passphrase")).Load(); err != ErrNotEncrypted {
+		t.Fatal(err)
+	}
+
+	// Migration
+	storage := EncryptedStorageNew(backend, []byte("passphrase"))
+	storage.AllowPlaintext = true
+
+	data, err := storage.Load()
+	if err != nil || string(data) != "auth key" {
+		t.Fatal(data, err)
+	}
+	if err := storage.Save(data); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = EncryptedStorageNew(backend, []byte("passphrase")).Load()
+	if err != nil || string(data) != "auth key" {
+		t.Fatal(data, err)
+	}
+}
+
+func TestEncryptedStorageRotate(t *testing.T) {
+	backend := new(MemoryStorage)
+	storage := EncryptedStorageNew(backend, []byte("old"))
+
+	if err := storage.Rotate(nil); err == nil {
+		t.Fatal("empty passphrase accepted")
+	}
+
+	if err := storage.Save([]byte("auth key")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saves during the rotation are encrypted with the old or the new passphrase, never lost
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		_ = storage.Save([]byte("new auth key"))
+	}()
+
+	if err := storage.Rotate([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	wait.Wait()
+
+	data, err := EncryptedStorageNew(backend, []byte("new")).Load()
+	if err != nil || (string(data) != "auth key" && string(data) != "new auth key") {
+		t.Fatal(data, err)
+	}
+	if _, err := EncryptedStorageNew(backend, []byte("old")).Load(); err == nil {
+		t.Fatal("old passphrase accepted")
+	}
+}
+
+// Backend whose saves fail
+type failingStorage struct {
+	MemoryStorage
+}
+
+func (storage *failingStorage) Save([]byte) error {
+	return errors.New("disk full")
+}
+
+func TestEncryptedStorageRotateSaveError(t *testing.T) {
+	backend := new(failingStorage)
+	if err := EncryptedStorageNew(&backend.MemoryStorage, []byte("old")).Save([]byte("auth key")); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := EncryptedStorageNew(backend, []byte("old"))
+	if err := storage.Rotate([]byte("new")); err == nil {
+		t.Fatal("rotated without saving")
+	}
+
+	// The old passphrase is still used
+	data, err := storage.Load()
+	if err != nil || string(data) != "auth key" {
+		t.Fatal(data, err)
+	}
+	if err := storage.Save([]byte("auth key")); err == nil {
+		t.Fatal("save error lost")
+	}
+	if _, err := EncryptedStorageNew(backend, []byte("old")).Load(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2020 ErikPelli <https://github.com/ErikPelli>
+ * This file is part of GoombaGram.
+ *
+ * GoombaGram is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * GoombaGram is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ * You should have received a copy of the GNU Affero General Public License
+ * along with GoombaGram.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package session
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Returned by Load when no session has been saved
+var ErrNotFound = errors.New("session not found")
+
+// Session storage backend, it saves the serialized session (auth key, dc, salts...)
+type Storage interface {
+	Save(data []byte) error
+	Load() ([]byte, error)
+}
+
+// Storage that keeps the session in a file
+type FileStorage struct {
+	path string
+}
+
+func FileStorageNew(path string) *FileStorage {
+	return &FileStorage{path: path}
+}
+
+// Write the session in a temporary file and then rename it, so a crash doesn't corrupt the old session
+func (fs *FileStorage) Save(data []byte) error {
+	temp := fs.path + ".tmp"
+
+	err := ioutil.WriteFile(temp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temp, fs.path)
+}
+
+func (fs *FileStorage) Load() ([]byte, error) {
+	data, err := ioutil.ReadFile(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	return data, err
+}
+
+// Storage that keeps the session only in memory
+type MemoryStorage struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+func (ms *MemoryStorage) Save(data []byte) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.data = append([]byte{}, data...)
+	return nil
+}
+
+func (ms *MemoryStorage) Load() ([]byte, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.data == nil {
+		return nil, ErrNotFound
+	}
+
+	return append([]byte{}, ms.data...), nil
+}